@@ -4,24 +4,50 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 // ==================== 常量定义 ====================
@@ -36,11 +62,13 @@ const (
 	ModelIDUpload = "8"
 	ModelIDQuery  = "7"
 
-	MaxRetries     = 500
-	TimeOffset     = 0.105
-	TimeoutSeconds = 30
-	RetryBaseDelay = time.Second
-	RetryLongDelay = time.Second * 3
+	MaxRetries               = 500
+	UploadPartRetries        = 3 // 单个分片上传的最大尝试次数
+	DefaultUploadConcurrency = 4 // 默认同时上传的分片数
+	TimeOffset               = 0.105
+	TimeoutSeconds           = 30
+	RetryBaseDelay           = time.Second
+	RetryLongDelay           = time.Second * 3
 
 	// HTTP 服务
 	HTTP_PORT    = "8080"
@@ -48,6 +76,13 @@ const (
 
 var (
 	DOWNLOAD_DIR = "D:/download" // 改为变量，以便在 main 中根据系统调整
+	CacheDir     = "./cache"     // ASR结果缓存目录，可通过 -cache-dir 或 ASR_CACHE_DIR 修改
+	AICacheDir   = "./cache/ai"  // AI响应缓存目录
+
+	CacheTTL time.Duration // ASR缓存有效期，0 表示永不过期
+
+	// ArchiveLayout 归档目录按日期分层的模板 (Go 时间格式，如 2006-01 → archive/2024-06/)，为空时直接放在 archive 下
+	ArchiveLayout = "2006-01"
 )
 
 // ==================== 数据结构 ====================
@@ -57,6 +92,9 @@ type DataSegment struct {
 	Text      string  `json:"text"`
 	StartTime float64 `json:"start_time"`
 	EndTime   float64 `json:"end_time"`
+	Speaker   string  `json:"speaker,omitempty"` // 说话人，双声道分离识别时为 说话人1 (左) / 说话人2 (右)
+	// 识别置信度 (0-1)，ASR服务未提供时为 0
+	Confidence float64 `json:"confidence,omitempty"`
 }
 
 // SRTItem SRT字幕项
@@ -73,6 +111,18 @@ type AIConfig struct {
 	APIURL      string `json:"api_url"`
 	Model       string `json:"model"`
 	CustomPrompt string `json:"custom_prompt"`
+
+	ResponseCache    bool `json:"response_cache"`     // 是否缓存AI响应
+	ResponseCacheTTL int  `json:"response_cache_ttl"` // 缓存有效期(分钟)，0表示永不过期
+	MaxContextTokens int  `json:"max_context_tokens"` // 模型上下文上限 (tokens)，超出时截断中间内容，0 表示不截断
+	ChunkChars       int  `json:"chunk_chars"`        // 分段总结每块的字符上限，字幕超过时先分块总结再汇总，0 使用默认值
+
+	// 采样参数，为 0 时不发送 (使用服务端默认值，兼容不支持这些参数的服务)
+	Temperature float64 `json:"temperature,omitempty"` // 总结建议调低，头脑风暴式对话可调高
+	MaxTokens   int     `json:"max_tokens,omitempty"`  // 单次回复的最大 token 数
+	TopP        float64 `json:"top_p,omitempty"`
+
+	Vision bool `json:"vision,omitempty"` // 模型支持图片输入时开启，总结时把截图作为图片发送给模型
 }
 
 // AIRequest AI请求
@@ -82,6 +132,7 @@ type AIRequest struct {
 	Segments    []DataSegment `json:"segments"`
 	Screenshots []string      `json:"screenshots"`
 	VideoPath   string        `json:"video_path"` // 必须传入视频路径以进行截图
+	Refresh     bool          `json:"refresh"`    // 忽略总结缓存，重新调用AI
 }
 
 // ChatRequest AI对话请求
@@ -96,37 +147,82 @@ type AIResponse struct {
 	Summary  string   `json:"summary"`
 	Markdown string   `json:"markdown"`
 	Points   []string `json:"points"`
+	Tags     []string `json:"tags,omitempty"`   // 自动生成的主题标签
+	Notice   string   `json:"notice,omitempty"` // 提示信息，如字幕过长已截断
 	Success  bool     `json:"success"`
 }
 
 // FileItem 文件列表项
 type FileItem struct {
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Size     int64  `json:"size"`
-	ModTime  string `json:"mod_time"`
-	Type     string `json:"type"` // video, audio, other
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Size        int64    `json:"size"`
+	ModTime     string   `json:"mod_time"`
+	Type        string   `json:"type"`                   // video, audio, archive, restored (已恢复但原视频不存在)
+	DuplicateOf string   `json:"duplicate_of,omitempty"` // 内容相同的另一文件路径
+	Tags        []string `json:"tags,omitempty"`         // 处理结果关联的标签
 }
 
 // ProcessRequest 处理请求
 type ProcessRequest struct {
-	VideoPath string `json:"video_path"`
-	CheckOnly bool   `json:"check_only"` // 新增：仅检查状态
+	VideoPath         string          `json:"video_path"`          // 本地路径，或 http(s) 直链 (先下载到 DOWNLOAD_DIR)
+	CheckOnly         bool            `json:"check_only"`          // 新增：仅检查状态
+	TargetCount       int             `json:"target_count"`        // 可选：合并到指定段数，0表示不合并
+	MergeGap          float64         `json:"merge_gap"`           // 可选：合并间隔小于该秒数的相邻片段，0表示不合并
+	MergeMaxChars     int             `json:"merge_max_chars"`     // 可选：合并后单条字幕的最大字符数
+	MaxLineChars      int             `json:"max_line_chars"`      // 可选：单条字幕超过该字符数时拆分
+	Clean             CleanOptions    `json:"clean"`               // 可选：片段清洗
+	VTTCueIDs         bool            `json:"vtt_cue_ids"`         // 可选：WebVTT 输出字幕序号标识
+	ParagraphGap      float64         `json:"paragraph_gap"`       // 可选：纯文本稿中间隔超过该秒数才分段
+	Format            string          `json:"format"`              // 可选：额外导出的字幕格式 (ass/lrc)，也可通过 ?format= 传入
+	ASSStyle          ASSStyle        `json:"ass_style"`           // 可选：ASS 样式，未设置时为白字黑边
+	Validate          ValidateOptions `json:"validate"`            // 可选：字幕时长检查阈值
+	LRCMeta           LRCMetadata     `json:"lrc_meta"`            // 可选：LRC 的 [ti:]/[ar:] 等标签
+	Offset            *float64        `json:"offset"`              // 可选：时间戳校正秒数 (可为负)，未设置时为 0.105
+	Provider          string          `json:"provider"`            // 可选：ASR服务名称，默认 bcut
+	FallbackProvider  string          `json:"fallback_provider"`   // 可选：主ASR服务失败时改用的服务
+	WrapChars         int             `json:"wrap_chars"`          // 可选：字幕单行超过该字数时在同一条字幕内换行
+	Language          string          `json:"language"`            // 可选：识别语言，auto 时先检测语言并自动选择ASR服务
+	ScreenshotMode    string          `json:"screenshot_mode"`     // 可选：interval 等间隔截图 / scene 场景切换截图，默认不截图
+	SceneThreshold    float64         `json:"scene_threshold"`     // 可选：场景切换阈值 (0-1)，默认 0.4
+	SplitChannels     bool            `json:"split_channels"`      // 可选：左右声道分别识别并标注说话人 (双人电话录音)
+	Start             float64         `json:"start"`               // 可选：只识别从 start 秒开始的部分，未传 end 时识别到视频结尾
+	End               float64         `json:"end"`                 // 可选：只识别到 end 秒为止，>0 时生效，时间戳仍相对于原视频
+	MinConfidence     float64         `json:"min_confidence"`      // 可选：去掉置信度低于该值 (0-1) 的片段，没有置信度的片段保留
+	FlagLowConfidence bool            `json:"flag_low_confidence"` // 可选：低置信度片段不去掉，改为在 warnings 中标记 low_confidence
+
+	// queued 异步任务 (/api/jobs) 的请求已在任务队列中排过队，等待处理名额时不受排队上限限制
+	queued bool
 }
 
 // ProcessResponse 处理响应
 type ProcessResponse struct {
-	Success       bool          `json:"success"`
-	Message       string        `json:"message,omitempty"`
-	AudioPath     string        `json:"audio_path,omitempty"`
-	SrtPath       string        `json:"srt_path,omitempty"`
-	SrtContent    string        `json:"srt_content,omitempty"`
-	Segments      []DataSegment `json:"segments,omitempty"`
-	Screenshots   []string      `json:"screenshots,omitempty"`
-	OutputDir     string        `json:"output_dir,omitempty"`
-	Duration      float64       `json:"duration,omitempty"`
-	SegmentCount  int           `json:"segment_count,omitempty"`
-	AIResult      *AIResponse   `json:"ai_result,omitempty"` // 新增：返回缓存的AI总结
+	Success       bool           `json:"success"`
+	Message       string         `json:"message,omitempty"`
+	VideoPath     string         `json:"video_path,omitempty"` // 实际处理的本地视频路径 (远程直链为下载后的位置)
+	AudioPath     string         `json:"audio_path,omitempty"`
+	SrtPath       string         `json:"srt_path,omitempty"`
+	SrtContent    string         `json:"srt_content,omitempty"`
+	VttPath       string         `json:"vtt_path,omitempty"`
+	VttContent    string         `json:"vtt_content,omitempty"`
+	TextPath      string         `json:"text_path,omitempty"`
+	TextContent   string         `json:"text_content,omitempty"`
+	Format        string         `json:"format,omitempty"`
+	FormatPath    string         `json:"format_path,omitempty"`
+	FormatContent string         `json:"format_content,omitempty"`
+	Segments      []DataSegment  `json:"segments,omitempty"`
+	Screenshots   []string       `json:"screenshots,omitempty"`
+	SceneShots    []SceneShot    `json:"scene_shots,omitempty"` // screenshot_mode=scene 时每张截图对应的场景切换时间
+	OutputDir     string         `json:"output_dir,omitempty"`
+	Duration      float64        `json:"duration,omitempty"`
+	VideoInfo     *VideoInfo     `json:"video_info,omitempty"` // 分辨率、编码、帧率、码率等
+	SegmentCount  int            `json:"segment_count,omitempty"`
+	AIResult      *AIResponse    `json:"ai_result,omitempty"`     // 新增：返回缓存的AI总结
+	Warnings      []SegmentIssue `json:"warnings,omitempty"`      // 字幕时长越界提示
+	Offset        *float64       `json:"offset,omitempty"`        // 本次识别实际使用的时间戳校正
+	ProviderUsed  string         `json:"provider_used,omitempty"` // 实际产出结果的ASR服务
+	Language      string         `json:"language,omitempty"`      // 识别使用的语言 (auto 时为检测结果)
+	Busy          bool           `json:"busy,omitempty"`          // 处理名额和排队均已满，请求被拒绝
 }
 
 // ProgressCallback 进度回调函数类型
@@ -150,6 +246,28 @@ func getHTTPClient() *http.Client {
 	}
 }
 
+// streamIdleTimeout 流式响应两次收到数据之间的最长间隔
+const streamIdleTimeout = 2 * time.Minute
+
+// getStreamHTTPClient 用于流式响应和大文件上传的客户端：不限制总耗时 (由请求的 ctx 控制)，只限制等待响应头的时间
+func getStreamHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: TimeoutSeconds * time.Second,
+		},
+	}
+}
+
+// getLongHTTPClient 用于同步识别等处理完才返回响应的请求：不设超时，由调用方通过 ctx 设置整体超时
+func getLongHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+}
+
 func Info(format string, v ...interface{}) {
 	log.Printf("[INFO] "+format, v...)
 }
@@ -168,12 +286,23 @@ func GenerateRandomString(n int) string {
 	return hex.EncodeToString(bytes)[:n]
 }
 
+// envOrDefault 读取环境变量，未设置时返回默认值
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
 // ==================== 视频处理工具 ====================
 
 // VideoProcessor 视频处理器
 type VideoProcessor struct {
 	VideoPath string
 	OutputDir string
+
+	hdr  *bool      // HDR 检测结果缓存
+	info *VideoInfo // ffprobe 探测结果缓存
 }
 
 // NewVideoProcessor 创建视频处理器
@@ -203,7 +332,7 @@ func NewVideoProcessor(videoPath string) (*VideoProcessor, error) {
 // ArchiveAndClean 归档并清理 (替代原 DeleteOutput)
 // 1. 删除原视频
 // 2. 清理中间文件(audio, srt, segments)
-// 3. 将 summary.json 和 截图 移动到 archive 目录
+// 3. 将 summary.json 和 截图 移动到 archive 目录 (按 ArchiveLayout 分到日期子目录)
 func (vp *VideoProcessor) ArchiveAndClean() error {
 	// 1. 删除原视频
 	if err := os.Remove(vp.VideoPath); err != nil && !os.IsNotExist(err) {
@@ -218,9 +347,12 @@ func (vp *VideoProcessor) ArchiveAndClean() error {
 
 	// 2. 准备归档目录
 	// 假设 OutputDir 是 D:/download/output_xxx
-	// archiveDir 是 D:/download/archive
+	// archiveDir 是 D:/download/archive/2024-06
 	baseDir := filepath.Dir(vp.OutputDir)
 	archiveRoot := filepath.Join(baseDir, "archive")
+	if ArchiveLayout != "" {
+		archiveRoot = filepath.Join(archiveRoot, filepath.FromSlash(time.Now().Format(ArchiveLayout)))
+	}
 	if err := os.MkdirAll(archiveRoot, 0755); err != nil {
 		return fmt.Errorf("创建归档目录失败: %v", err)
 	}
@@ -237,8 +369,11 @@ func (vp *VideoProcessor) ArchiveAndClean() error {
 		path := filepath.Join(vp.OutputDir, name)
 		ext := strings.ToLower(filepath.Ext(name))
 
-		// 保留 summary.json 和 图片
-		if name == "summary.json" || ext == ".jpg" || ext == ".png" || ext == ".jpeg" {
+		// 保留 summary.json (含带模型名的 summary.<model>.json) 和 图片，tags.json 随之保留但不单独触发归档
+		if name == "tags.json" {
+			continue
+		}
+		if (strings.HasPrefix(name, "summary.") && ext == ".json") || ext == ".jpg" || ext == ".png" || ext == ".jpeg" {
 			hasContent = true
 			continue
 		}
@@ -264,1503 +399,11401 @@ func (vp *VideoProcessor) ArchiveAndClean() error {
 	return nil
 }
 
-// ExtractAudio 从视频提取音频
-func (vp *VideoProcessor) ExtractAudio() (string, error) {
-	audioPath := filepath.Join(vp.OutputDir, "audio.mp3")
+// restoredMarkerName 恢复归档时写入输出目录的标记文件
+const restoredMarkerName = "restored.json"
 
-	// 检查音频文件是否已存在，如果存在则直接复用
-	if _, err := os.Stat(audioPath); err == nil {
-		Info("检测到已存在的音频文件，跳过提取: %s", audioPath)
-		return audioPath, nil
-	}
+// ErrRestoreTargetExists 恢复归档时原输出目录已存在 (如视频已重新处理过)
+var ErrRestoreTargetExists = errors.New("输出目录已存在")
 
-	cmd := exec.Command("ffmpeg", "-i", vp.VideoPath, "-vn", "-acodec", "libmp3lame",
-		"-ac", "2", "-ar", "16000", "-y", audioPath)
+// RestoreInfo 归档恢复结果，同时作为 restored.json 的内容
+type RestoreInfo struct {
+	OutputDir    string `json:"output_dir"`
+	VideoPath    string `json:"video_path"`
+	VideoMissing bool   `json:"video_missing"` // 原视频已不存在，只恢复了总结和截图
+	RestoredAt   string `json:"restored_at"`
+}
 
-	_, err := cmd.CombinedOutput()
+// RestoreArchive 把归档项移回原视频旁的 output_* 目录 (ArchiveAndClean 的逆过程)
+// 归档项位于 <视频目录>/archive/[日期分组/]output_xxx，恢复到 <视频目录>/output_xxx；
+// 原视频还在时按正常流程重新处理即可补回字幕等文件，不在时只恢复总结和截图并标记 video_missing
+// archive 目录的父目录必须是 allowedDirs 之一，恢复目标不会落到允许的目录之外
+func RestoreArchive(archivePath string, allowedDirs []string) (*RestoreInfo, error) {
+	absPath, err := filepath.Abs(archivePath)
 	if err != nil {
-		return "", fmt.Errorf("提取音频失败: %v", err)
+		return nil, fmt.Errorf("解析路径失败: %w", err)
 	}
 
-	Info("音频提取成功: %s", audioPath)
-	return audioPath, nil
-}
-
-// ExtractScreenshots 提取视频截图 (保留此方法工具，但在流程中改为按需提取)
-func (vp *VideoProcessor) ExtractScreenshots(duration float64) ([]string, error) {
-	screenshotCount := 5 // 提取5张截图
-	screenshotInterval := duration / float64(screenshotCount+1)
-
-	screenshots := []string{}
-
-	for i := 1; i <= screenshotCount; i++ {
-		timeOffset := float64(i) * screenshotInterval
-		screenshotPath := filepath.Join(vp.OutputDir, fmt.Sprintf("screenshot_%d.jpg", i))
-
-		cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.2f", timeOffset),
-			"-i", vp.VideoPath, "-vframes", "1", "-q:v", "2", "-y", screenshotPath)
-
-		_, err := cmd.CombinedOutput()
-		if err != nil {
-			Warn("截图 %d 失败: %v", i, err)
-			continue
+	// 向上找到 archive 目录，它的父目录就是原视频所在目录
+	archiveRoot := filepath.Dir(absPath)
+	for filepath.Base(archiveRoot) != "archive" {
+		parent := filepath.Dir(archiveRoot)
+		if parent == archiveRoot {
+			return nil, fmt.Errorf("不是归档目录: %s", archivePath)
 		}
-
-		screenshots = append(screenshots, screenshotPath)
-		Info("创建截图: %s", screenshotPath)
+		archiveRoot = parent
+	}
+	if _, err := os.Stat(filepath.Join(absPath, outputFileName("summary", "", ""))); err != nil {
+		return nil, fmt.Errorf("归档中没有总结文件: %w", err)
 	}
 
-	return screenshots, nil
-}
+	// 早期的平铺归档可能没有 output_ 前缀
+	name := filepath.Base(absPath)
+	if !strings.HasPrefix(name, "output_") {
+		name = "output_" + name
+	}
+	baseDir := filepath.Dir(archiveRoot)
+	outputDir := filepath.Join(baseDir, name)
+	if !isAllowedArchiveBase(baseDir, outputDir, allowedDirs) {
+		return nil, fmt.Errorf("%w: %s", ErrPathNotAllowed, outputDir)
+	}
+	if _, err := os.Stat(outputDir); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRestoreTargetExists, outputDir)
+	}
 
-// ExtractScreenshotAt 在指定时间点提取截图
-func (vp *VideoProcessor) ExtractScreenshotAt(seconds float64) (string, error) {
-	filename := fmt.Sprintf("ai_capture_%.2f.jpg", seconds)
-	screenshotPath := filepath.Join(vp.OutputDir, filename)
+	if err := os.Rename(absPath, outputDir); err != nil {
+		return nil, fmt.Errorf("移动归档失败: %w", err)
+	}
 
-	// 如果文件已存在，直接返回
-	if _, err := os.Stat(screenshotPath); err == nil {
-		return screenshotPath, nil
+	info := &RestoreInfo{
+		OutputDir:  outputDir,
+		VideoPath:  filepath.Join(baseDir, strings.TrimPrefix(name, "output_")),
+		RestoredAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if _, err := os.Stat(info.VideoPath); err != nil {
+		info.VideoMissing = true
 	}
 
-	cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.2f", seconds),
-		"-i", vp.VideoPath, "-vframes", "1", "-q:v", "2", "-y", screenshotPath)
+	data, _ := json.MarshalIndent(info, "", "  ")
+	if err := os.WriteFile(filepath.Join(outputDir, restoredMarkerName), data, 0644); err != nil {
+		Warn("写入恢复标记失败: %v", err)
+	}
 
-	if err := cmd.Run(); err != nil {
-		return "", err
+	if info.VideoMissing {
+		Info("已恢复归档到: %s (原视频不存在，仅恢复总结和截图)", outputDir)
+	} else {
+		Info("已恢复归档到: %s", outputDir)
 	}
-	return screenshotPath, nil
+	return info, nil
 }
 
-// GetVideoDuration 获取视频时长
-func (vp *VideoProcessor) GetVideoDuration() (float64, error) {
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-show_entries",
-		"format=duration", "-of", "csv=p=0", vp.VideoPath)
-
-	output, err := cmd.CombinedOutput()
+// isAllowedArchiveBase 检查 archive 目录的父目录是否正是某个允许的目录，且恢复目标位于其中
+func isAllowedArchiveBase(baseDir, outputDir string, allowedDirs []string) bool {
+	base, err := realPath(baseDir)
 	if err != nil {
-		return 0, fmt.Errorf("获取视频时长失败: %v", err)
+		return false
+	}
+	for _, dir := range allowedDirs {
+		allowed, err := realPath(dir)
+		if err != nil {
+			continue
+		}
+		if base == allowed && isWithinDir(dir, outputDir) {
+			return true
+		}
 	}
+	return false
+}
 
-	durationStr := strings.TrimSpace(string(output))
-	duration, err := strconv.ParseFloat(durationStr, 64)
+// restoredFileItem 恢复后原视频仍不存在的输出目录，在文件列表中单独显示，以便继续查看总结
+func restoredFileItem(outputDir string) (FileItem, bool) {
+	data, err := os.ReadFile(filepath.Join(outputDir, restoredMarkerName))
 	if err != nil {
-		return 0, fmt.Errorf("解析时长失败: %v", err)
+		return FileItem{}, false
+	}
+	var info RestoreInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return FileItem{}, false
+	}
+	// 视频已放回原位时按普通视频显示
+	if _, err := os.Stat(filepath.Join(filepath.Dir(outputDir), strings.TrimPrefix(filepath.Base(outputDir), "output_"))); err == nil {
+		return FileItem{}, false
 	}
 
-	return duration, nil
+	return FileItem{
+		Name:    "♻️ [已恢复·无视频] " + strings.TrimPrefix(filepath.Base(outputDir), "output_"),
+		Path:    outputDir,
+		Type:    "restored",
+		ModTime: info.RestoredAt,
+	}, true
 }
 
-// ==================== ASR相关 ====================
+// 处理流程阶段，只记录重新生成代价高、中断后需要据此续跑的阶段
+// (字幕每次都会重新生成，总结以 summary.json 是否存在为准)
+const (
+	StageAudio = "audio"
+	StageASR   = "asr"
+)
 
-// BaseASR ASR基类
-type BaseASR struct {
-	AudioPath  string
-	FileBinary []byte
-	UseCache   bool
+// stateMu 保护 state.json 的读-改-写，同一视频的并发请求不会丢失彼此的阶段标记
+var stateMu sync.Mutex
+
+// ProcessState 处理流程状态，保存在输出目录的 state.json，用于中断后从上次的阶段继续
+type ProcessState struct {
+	Stages    map[string]string `json:"stages"` // 阶段 -> 完成时间
+	UpdatedAt string            `json:"updated_at"`
 }
 
-func NewBaseASR(audioPath string, useCache bool) (*BaseASR, error) {
-	fileBytes, err := os.ReadFile(audioPath)
+// LoadState 读取处理流程状态，不存在时返回空状态
+func (vp *VideoProcessor) LoadState() ProcessState {
+	state := ProcessState{Stages: map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(vp.OutputDir, "state.json"))
 	if err != nil {
-		return nil, fmt.Errorf("读取音频文件失败: %w", err)
+		return state
 	}
-
-	return &BaseASR{
-		AudioPath:  audioPath,
-		FileBinary: fileBytes,
-		UseCache:   useCache,
-	}, nil
+	if err := json.Unmarshal(data, &state); err != nil {
+		Warn("解析流程状态失败: %v", err)
+	}
+	if state.Stages == nil {
+		state.Stages = map[string]string{}
+	}
+	return state
 }
 
-func (b *BaseASR) GetCacheKey(serviceName string) string {
-	hash := md5.New()
-	hash.Write([]byte(b.AudioPath))
-	hash.Write(b.FileBinary)
-	return fmt.Sprintf("%s_%s", serviceName, hex.EncodeToString(hash.Sum(nil)))
+// StageDone 判断阶段是否已完成
+func (vp *VideoProcessor) StageDone(stage string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	_, ok := vp.LoadState().Stages[stage]
+	return ok
 }
 
-func (b *BaseASR) LoadFromCache(cacheDir string, cacheKey string) ([]DataSegment, bool) {
-	cachePath := filepath.Join(cacheDir, cacheKey+".json")
-	if _, err := os.Stat(cachePath); os.IsNotExist(err) {
-		return nil, false
-	}
-
-	data, err := os.ReadFile(cachePath)
-	if err != nil {
-		Warn("读取缓存失败: %v", err)
-		return nil, false
-	}
+// MarkStage 标记阶段完成
+func (vp *VideoProcessor) MarkStage(stage string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state := vp.LoadState()
+	now := time.Now().Format("2006-01-02 15:04:05")
+	state.Stages[stage] = now
+	state.UpdatedAt = now
 
-	var segments []DataSegment
-	if err := json.Unmarshal(data, &segments); err != nil {
-		Warn("解析缓存失败: %v", err)
-		return nil, false
+	data, _ := json.MarshalIndent(state, "", "  ")
+	if err := os.WriteFile(filepath.Join(vp.OutputDir, "state.json"), data, 0644); err != nil {
+		Warn("保存流程状态失败: %v", err)
 	}
-
-	return segments, true
 }
 
-func (b *BaseASR) SaveToCache(cacheDir string, cacheKey string, segments []DataSegment) error {
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("创建缓存目录失败: %w", err)
+// ClearStage 清除阶段标记，阶段产物被删除后调用，下次处理时重新执行该阶段
+func (vp *VideoProcessor) ClearStage(stage string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state := vp.LoadState()
+	if _, ok := state.Stages[stage]; !ok {
+		return
 	}
+	delete(state.Stages, stage)
+	state.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
 
-	cachePath := filepath.Join(cacheDir, cacheKey+".json")
-	data, err := json.MarshalIndent(segments, "", "  ")
-	if err != nil {
-		return fmt.Errorf("序列化缓存失败: %w", err)
+	data, _ := json.MarshalIndent(state, "", "  ")
+	if err := os.WriteFile(filepath.Join(vp.OutputDir, "state.json"), data, 0644); err != nil {
+		Warn("保存流程状态失败: %v", err)
 	}
+}
 
-	if err := os.WriteFile(cachePath, data, 0644); err != nil {
-		return fmt.Errorf("写入缓存失败: %w", err)
-	}
+// ErrNoAudioStream 视频没有音频轨道 (如无声的录屏)
+var ErrNoAudioStream = errors.New("视频没有音频轨道")
 
+// checkAudioStream 提取音频前确认视频有音频流，探测失败时不拦截，交给 ffmpeg 报错
+func (vp *VideoProcessor) checkAudioStream() error {
+	info, err := vp.GetVideoInfo()
+	if err == nil && !info.HasAudio {
+		return ErrNoAudioStream
+	}
 	return nil
 }
 
-// BcutASR 必剪语音识别
-type BcutASR struct {
-	*BaseASR
-	taskID      string
-	etags       []string
-	inBossKey   string
-	resourceID  string
-	uploadID    string
-	uploadURLs  []string
-	perSize     int
-	clips       int
-	downloadURL string
-}
-
-func NewBcutASR(audioPath string, useCache bool) (*BcutASR, error) {
-	baseASR, err := NewBaseASR(audioPath, useCache)
+// runFFmpegWithProgress 运行 ffmpeg 并通过 -progress pipe:1 解析已处理的时长，按 duration 折算百分比回调
+// stderr 单独保留，失败时把最后一行错误信息带到返回的 error 中
+func runFFmpegWithProgress(args []string, duration float64, progress ProgressCallback) error {
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &BcutASR{
-		BaseASR: baseASR,
-		etags:   make([]string, 0),
-	}, nil
-}
-
-func (b *BcutASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
-	instanceID := fmt.Sprintf("BcutASR-%s", GenerateRandomString(8))
-	Info("[%s] GetResult 开始处理音频: %s", instanceID, b.AudioPath)
+	done := trackFFmpeg()
+	defer done()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-	// 检查缓存
-	cacheKey := b.GetCacheKey("BcutASR")
-	if b.UseCache {
-		if segments, ok := b.LoadFromCache("./cache", cacheKey); ok {
-			Info("[%s] 从缓存加载必剪ASR结果", instanceID)
-			if callback != nil {
-				callback(100, "识别完成 (缓存)")
+	scanner := bufio.NewScanner(stdout)
+	lastPercent := -1
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || progress == nil || duration <= 0 {
+			continue
+		}
+		switch key {
+		case "out_time_ms", "out_time_us":
+			// 两者的单位都是微秒
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			percent := int(float64(us) / 1e6 / duration * 100)
+			if percent > 99 {
+				percent = 99
+			}
+			if percent > lastPercent {
+				lastPercent = percent
+				progress(percent, "正在提取音频...")
+			}
+		case "progress":
+			if value == "end" {
+				progress(100, "音频提取完成")
 			}
-			return segments, nil
 		}
-		Info("[%s] 缓存未命中", instanceID)
 	}
 
-	// 上传阶段
-	if callback != nil {
-		callback(20, "正在上传...")
-	}
-	if err := b.upload(); err != nil {
-		Error("[%s] 上传失败: %v", instanceID, err)
-		return nil, fmt.Errorf("必剪ASR上传失败: %w", err)
+	if err := cmd.Wait(); err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return fmt.Errorf("%v: %s", err, lines[len(lines)-1])
 	}
+	return nil
+}
 
-	// 创建任务阶段
-	if callback != nil {
-		callback(50, "提交任务...")
-	}
-	if err := b.createTask(); err != nil {
-		Error("[%s] 创建任务失败: %v", instanceID, err)
-		return nil, fmt.Errorf("必剪ASR创建任务失败: %w", err)
-	}
+// ExtractAudio 从视频提取音频，progress 不为 nil 时回调提取进度
+func (vp *VideoProcessor) ExtractAudio(progress ProgressCallback) (string, error) {
+	audioPath := filepath.Join(vp.OutputDir, "audio.mp3")
 
-	// 查询结果阶段
-	if callback != nil {
-		callback(60, "等待结果...")
+	// 音频阶段已完成且文件存在则直接复用
+	if _, err := os.Stat(audioPath); err == nil && vp.StageDone(StageAudio) {
+		Info("检测到已存在的音频文件，跳过提取: %s", audioPath)
+		return audioPath, nil
 	}
-	result, err := b.queryResult(ctx, callback)
-	if err != nil {
-		Error("[%s] 查询结果失败: %v", instanceID, err)
-		return nil, fmt.Errorf("必剪ASR查询结果失败: %w", err)
+	if err := vp.checkAudioStream(); err != nil {
+		return "", err
 	}
 
-	// 处理结果
-	segments := b.makeSegments(result)
-
-	if callback != nil {
-		callback(100, "识别完成")
+	var duration float64
+	if info, err := vp.GetVideoInfo(); err == nil {
+		duration = info.Duration
+	}
+	// 先写临时文件，成功后再改名，中途中断不会留下残缺的 audio.mp3
+	vp.ClearStage(StageAudio)
+	tempPath := audioPath + ".part"
+	args := []string{"-i", vp.VideoPath, "-vn", "-acodec", "libmp3lame",
+		"-ac", "2", "-ar", "16000", "-f", "mp3", "-y", tempPath}
+	if err := runFFmpegWithProgress(args, duration, progress); err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("提取音频失败: %v", err)
 	}
-
-	// 保存缓存
-	if b.UseCache && len(segments) > 0 {
-		if err := b.SaveToCache("./cache", cacheKey, segments); err != nil {
-			Warn("[%s] 保存必剪ASR结果到缓存失败: %v", instanceID, err)
-		}
+	if err := os.Rename(tempPath, audioPath); err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("保存音频失败: %w", err)
 	}
 
-	return segments, nil
+	Info("音频提取成功: %s", audioPath)
+	vp.MarkStage(StageAudio)
+	return audioPath, nil
 }
 
-func (b *BcutASR) upload() error {
-	if err := b.requestUpload(); err != nil {
-		return err
+// audioRangeName 时间段文件名后缀，如 120_300
+func audioRangeName(start, end float64) string {
+	return strconv.FormatFloat(start, 'f', -1, 64) + "_" + strconv.FormatFloat(end, 'f', -1, 64)
+}
+
+// ValidateRange 检查时间段是否有效：end > start 且都在视频时长内
+func (vp *VideoProcessor) ValidateRange(start, end float64) error {
+	if start < 0 || end <= start {
+		return fmt.Errorf("无效的时间段: %.2f - %.2f", start, end)
 	}
-	if err := b.uploadParts(); err != nil {
+	duration, err := vp.GetVideoDuration()
+	if err != nil {
 		return err
 	}
-	if err := b.commitUpload(); err != nil {
-		return err
+	if end > duration {
+		return fmt.Errorf("时间段超出视频时长 (%.2f秒): %.2f - %.2f", duration, start, end)
 	}
 	return nil
 }
 
-func (b *BcutASR) requestUpload() error {
-	payload := map[string]interface{}{
-		"type":             2,
-		"name":             "audio.mp3",
-		"size":             len(b.FileBinary),
-		"ResourceFileType": "mp3",
-		"model_id":         ModelIDUpload,
+// ExtractAudioRange 只提取 [start, end] 秒之间的音频，文件名带上时间段 (如 audio_120_300.mp3)
+func (vp *VideoProcessor) ExtractAudioRange(start, end float64) (string, error) {
+	if err := vp.ValidateRange(start, end); err != nil {
+		return "", err
 	}
-
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("JSON编码失败: %w", err)
+	if err := vp.checkAudioStream(); err != nil {
+		return "", err
 	}
+	audioPath := filepath.Join(vp.OutputDir, "audio_"+audioRangeName(start, end)+".mp3")
 
-	req, err := http.NewRequest("POST", API_REQ_UPLOAD, bytes.NewBuffer(jsonPayload))
+	cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.3f", start), "-to", fmt.Sprintf("%.3f", end),
+		"-i", vp.VideoPath, "-vn", "-acodec", "libmp3lame", "-ac", "2", "-ar", "16000", "-y", audioPath)
+
+	done := trackFFmpeg()
+	_, err := cmd.CombinedOutput()
+	done()
 	if err != nil {
-		return fmt.Errorf("创建HTTP请求失败: %w", err)
+		return "", fmt.Errorf("提取音频失败: %v", err)
 	}
 
-	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
-	req.Header.Set("Content-Type", "application/json")
-
-	// 使用带代理的客户端
-	client := getHTTPClient()
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("发送HTTP请求失败: %w", err)
-	}
-	defer resp.Body.Close()
+	Info("音频片段提取成功: %s", audioPath)
+	return audioPath, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("读取响应失败: %w", err)
+// ExtractAudioChannels 用 channelsplit 把立体声的左右声道分别提取为单声道音频
+// 返回 [左声道, 右声道]，用于左右声道是不同说话人的录音 (如电话录音)
+// end > 0 时只提取 start-end 时间段
+func (vp *VideoProcessor) ExtractAudioChannels(start, end float64) ([]string, error) {
+	leftPath := filepath.Join(vp.OutputDir, "audio_left.mp3")
+	rightPath := filepath.Join(vp.OutputDir, "audio_right.mp3")
+	var args []string
+	if end > 0 {
+		if err := vp.ValidateRange(start, end); err != nil {
+			return nil, err
+		}
+		name := audioRangeName(start, end)
+		leftPath = filepath.Join(vp.OutputDir, "audio_left_"+name+".mp3")
+		rightPath = filepath.Join(vp.OutputDir, "audio_right_"+name+".mp3")
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start), "-to", fmt.Sprintf("%.3f", end))
 	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return fmt.Errorf("解析JSON响应失败: %w", err)
+	if err := vp.checkAudioStream(); err != nil {
+		return nil, err
 	}
 
-	data, ok := result["data"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("响应格式错误: 缺少data字段")
-	}
+	args = append(args, "-i", vp.VideoPath,
+		"-filter_complex", "[0:a]channelsplit=channel_layout=stereo[left][right]",
+		"-map", "[left]", "-acodec", "libmp3lame", "-ar", "16000", "-y", leftPath,
+		"-map", "[right]", "-acodec", "libmp3lame", "-ar", "16000", "-y", rightPath)
+	cmd := exec.Command("ffmpeg", args...)
 
-	if inBossKey, ok := data["in_boss_key"].(string); ok {
-		b.inBossKey = inBossKey
+	done := trackFFmpeg()
+	_, err := cmd.CombinedOutput()
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("分离声道失败: %v", err)
 	}
 
-	if resourceID, ok := data["resource_id"].(string); ok {
-		b.resourceID = resourceID
-	}
+	Info("声道分离成功: %s, %s", leftPath, rightPath)
+	return []string{leftPath, rightPath}, nil
+}
 
-	if uploadID, ok := data["upload_id"].(string); ok {
-		b.uploadID = uploadID
-	}
+// ExtractScreenshots 提取视频截图 (保留此方法工具，但在流程中改为按需提取)
+func (vp *VideoProcessor) ExtractScreenshots(duration float64) ([]string, error) {
+	screenshotCount := 5 // 提取5张截图
+	screenshotInterval := duration / float64(screenshotCount+1)
 
-	if perSize, ok := data["per_size"].(float64); ok {
-		b.perSize = int(perSize)
-	}
+	screenshots := []string{}
 
-	uploadURLsIface, ok := data["upload_urls"].([]interface{})
-	if !ok {
-		return fmt.Errorf("upload_urls字段缺失或类型错误")
-	}
+	for i := 1; i <= screenshotCount; i++ {
+		timeOffset := float64(i) * screenshotInterval
+		screenshotPath := filepath.Join(vp.OutputDir, fmt.Sprintf("screenshot_%d.jpg", i))
 
-	b.uploadURLs = make([]string, len(uploadURLsIface))
-	for i, url := range uploadURLsIface {
-		if urlStr, ok := url.(string); ok {
-			b.uploadURLs[i] = urlStr
+		cmd := exec.Command("ffmpeg", vp.screenshotArgs(timeOffset, screenshotPath)...)
+
+		done := trackFFmpeg()
+		_, err := cmd.CombinedOutput()
+		done()
+		if err != nil {
+			Warn("截图 %d 失败: %v", i, err)
+			continue
 		}
+
+		screenshots = append(screenshots, screenshotPath)
+		Info("创建截图: %s", screenshotPath)
 	}
 
-	b.clips = len(b.uploadURLs)
-	Info("申请上传成功, 总计大小%dKB, %d分片, 分片大小%dKB", len(b.FileBinary)/1024, b.clips, b.perSize/1024)
-	return nil
+	return screenshots, nil
 }
 
-func (b *BcutASR) uploadParts() error {
-	b.etags = make([]string, b.clips)
-	// 使用带代理的客户端
-	client := getHTTPClient()
+// 场景截图的数量限制，少于 minSceneScreenshots 张时回退到等间隔截图
+const (
+	minSceneScreenshots = 3
+	maxSceneScreenshots = 50
+)
 
-	for i := 0; i < b.clips; i++ {
-		startRange := i * b.perSize
-		endRange := (i + 1) * b.perSize
-		if endRange > len(b.FileBinary) {
-			endRange = len(b.FileBinary)
-		}
+// sceneTimePattern showinfo 滤镜输出中每帧的时间戳
+var sceneTimePattern = regexp.MustCompile(`pts_time:\s*([0-9.]+)`)
 
-		req, err := http.NewRequest("PUT", b.uploadURLs[i], bytes.NewBuffer(b.FileBinary[startRange:endRange]))
-		if err != nil {
-			return fmt.Errorf("创建HTTP请求失败: %w", err)
-		}
+// SceneShot 场景切换截图及其时间点
+type SceneShot struct {
+	Path string  `json:"path"`
+	Time float64 `json:"time"` // 场景切换的时间 (秒)
+}
 
-		req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
-		req.Header.Set("Content-Type", "application/octet-stream")
+// ExtractSceneScreenshots 在检测到的场景切换处截图 (select='gt(scene,threshold)')
+// 截图按时间命名为 scene_<秒数>.jpg，最多 maxSceneScreenshots 张，按时间顺序返回
+func (vp *VideoProcessor) ExtractSceneScreenshots(threshold float64) ([]SceneShot, error) {
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.4
+	}
 
-		resp, err := client.Do(req)
+	tempDir, err := os.MkdirTemp("", "scene_")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	filter := fmt.Sprintf("select='gt(scene,%.2f)',showinfo", threshold)
+	if vp.IsHDR() {
+		filter += "," + hdrTonemapFilter
+	}
+	cmd := exec.Command("ffmpeg", "-i", vp.VideoPath, "-vf", filter, "-vsync", "vfr",
+		"-frames:v", strconv.Itoa(maxSceneScreenshots), "-q:v", "2", "-y", filepath.Join(tempDir, "scene_%04d.jpg"))
+	done := trackFFmpeg()
+	output, err := cmd.CombinedOutput()
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("场景截图失败: %v", err)
+	}
+
+	// 清理上次的场景截图，避免不同阈值的结果混在一起
+	vp.RemoveSceneScreenshots()
+
+	screenshots := []SceneShot{}
+	for i, match := range sceneTimePattern.FindAllStringSubmatch(string(output), -1) {
+		seconds, err := strconv.ParseFloat(match[1], 64)
 		if err != nil {
-			return fmt.Errorf("发送HTTP请求失败: %w", err)
+			continue
 		}
-
-		etag := resp.Header.Get("Etag")
-		if etag == "" {
-			body, _ := io.ReadAll(resp.Body)
-			var result map[string]interface{}
-			if json.Unmarshal(body, &result) == nil {
-				if etagVal, ok := result["etag"].(string); ok {
-					etag = etagVal
-				}
+		tempPath := filepath.Join(tempDir, fmt.Sprintf("scene_%04d.jpg", i+1))
+		screenshotPath := filepath.Join(vp.OutputDir, fmt.Sprintf("scene_%.2f.jpg", seconds))
+		if err := os.Rename(tempPath, screenshotPath); err != nil {
+			// 临时目录可能与输出目录不在同一分区
+			data, err := os.ReadFile(tempPath)
+			if err != nil || os.WriteFile(screenshotPath, data, 0644) != nil {
+				continue
 			}
 		}
-		resp.Body.Close()
+		screenshots = append(screenshots, SceneShot{Path: screenshotPath, Time: seconds})
+	}
 
-		if etag == "" {
-			return fmt.Errorf("分片%d上传失败: 未获取到Etag", i)
-		}
+	Info("检测到 %d 处场景切换并截图", len(screenshots))
+	return screenshots, nil
+}
 
-		b.etags[i] = etag
-		Info("分片%d上传成功: %s", i, etag)
+// RemoveSceneScreenshots 删除输出目录中的场景截图 (scene_*.jpg)
+func (vp *VideoProcessor) RemoveSceneScreenshots() {
+	if old, err := filepath.Glob(filepath.Join(vp.OutputDir, "scene_*.jpg")); err == nil {
+		for _, path := range old {
+			os.Remove(path)
+		}
 	}
-
-	return nil
 }
 
-func (b *BcutASR) commitUpload() error {
-	payload := map[string]interface{}{
-		"InBossKey":  b.inBossKey,
-		"ResourceId": b.resourceID,
-		"Etags":      b.buildEtags(),
-		"UploadId":   b.uploadID,
-		"model_id":   ModelIDUpload,
+// 截图质量检测阈值，不合格时在 ±screenshotRetryRange 秒内按 screenshotRetryStep 重新取帧
+const (
+	screenshotMinBrightness = 20.0 // 平均亮度 (0-255)，低于此值视为黑屏
+	screenshotMinSharpness  = 50.0 // 拉普拉斯方差，低于此值视为模糊
+	screenshotRetryRange    = 3.0
+	screenshotRetryStep     = 1.0
+	screenshotSampleWidth   = 320 // 检测时采样的宽度，避免逐像素处理大图
+)
+
+// ExtractScreenshotAt 在指定时间点提取截图
+// 取到黑屏或模糊帧时在附近重试，保留质量最好的一帧
+func (vp *VideoProcessor) ExtractScreenshotAt(seconds float64) (string, error) {
+	filename := fmt.Sprintf("ai_capture_%.2f.jpg", seconds)
+	screenshotPath := filepath.Join(vp.OutputDir, filename)
+
+	// 如果文件已存在，直接返回
+	if _, err := os.Stat(screenshotPath); err == nil {
+		return screenshotPath, nil
 	}
 
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("JSON编码失败: %w", err)
+	if err := vp.captureFrame(seconds, screenshotPath); err != nil {
+		return "", err
 	}
 
-	req, err := http.NewRequest("POST", API_COMMIT_UPLOAD, bytes.NewBuffer(jsonPayload))
+	best, err := screenshotQuality(screenshotPath)
 	if err != nil {
-		return fmt.Errorf("创建HTTP请求失败: %w", err)
+		Warn("截图质量检测失败: %v", err)
+		return screenshotPath, nil
+	}
+	if best >= screenshotMinSharpness {
+		return screenshotPath, nil
 	}
 
-	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
-	req.Header.Set("Content-Type", "application/json")
+	duration, _ := vp.GetVideoDuration()
+	candidatePath := filepath.Join(vp.OutputDir, fmt.Sprintf("ai_capture_%.2f_retry.jpg", seconds))
+	defer os.Remove(candidatePath)
+	bestTime := seconds
 
-	// 使用带代理的客户端
-	client := getHTTPClient()
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("发送HTTP请求失败: %w", err)
+	for delta := screenshotRetryStep; delta <= screenshotRetryRange && best < screenshotMinSharpness; delta += screenshotRetryStep {
+		for _, t := range []float64{seconds + delta, seconds - delta} {
+			if t < 0 || (duration > 0 && t >= duration) {
+				continue
+			}
+			if err := vp.captureFrame(t, candidatePath); err != nil {
+				continue
+			}
+			score, err := screenshotQuality(candidatePath)
+			if err != nil || score <= best {
+				continue
+			}
+			if err := os.Rename(candidatePath, screenshotPath); err != nil {
+				continue
+			}
+			best, bestTime = score, t
+			if best >= screenshotMinSharpness {
+				break
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if bestTime != seconds {
+		Info("截图 %.2fs 为黑屏或模糊，改用 %.2fs 的画面", seconds, bestTime)
+	}
+	return screenshotPath, nil
+}
+
+// captureFrame 提取单帧到指定路径
+func (vp *VideoProcessor) captureFrame(seconds float64, outputPath string) error {
+	cmd := exec.Command("ffmpeg", vp.screenshotArgs(seconds, outputPath)...)
+
+	defer trackFFmpeg()()
+	return cmd.Run()
+}
+
+// screenshotQuality 返回截图的清晰度评分 (灰度拉普拉斯方差)，平均亮度过低的黑屏帧记为 0
+func screenshotQuality(path string) (float64, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("读取响应失败: %w", err)
+		return 0, err
 	}
+	defer file.Close()
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return fmt.Errorf("解析JSON响应失败: %w", err)
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, fmt.Errorf("解码截图失败: %w", err)
 	}
 
-	data, ok := result["data"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("响应格式错误")
+	bounds := img.Bounds()
+	step := bounds.Dx() / screenshotSampleWidth
+	if step < 1 {
+		step = 1
+	}
+	w := bounds.Dx() / step
+	h := bounds.Dy() / step
+	if w < 3 || h < 3 {
+		return 0, nil
 	}
 
-	if downloadURL, ok := data["download_url"].(string); ok {
-		b.downloadURL = downloadURL
+	gray := make([]float64, w*h)
+	var brightness float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x*step, bounds.Min.Y+y*step).RGBA()
+			v := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			gray[y*w+x] = v
+			brightness += v
+		}
+	}
+	if brightness/float64(w*h) < screenshotMinBrightness {
+		return 0, nil
 	}
 
-	Info("提交成功，获取下载URL: %s", b.downloadURL)
-	return nil
+	var sum, sumSq float64
+	n := float64((w - 2) * (h - 2))
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			lap := gray[i-w] + gray[i+w] + gray[i-1] + gray[i+1] - 4*gray[i]
+			sum += lap
+			sumSq += lap * lap
+		}
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean, nil
 }
 
-func (b *BcutASR) buildEtags() string {
-	etagsStr := ""
-	for i, etag := range b.etags {
-		if i > 0 {
-			etagsStr += ","
-		}
-		etagsStr += etag
+// HDR 色调映射滤镜 (需 ffmpeg 带 zimg 支持)
+const hdrTonemapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+	"tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// screenshotArgs 构建截图的 ffmpeg 参数，HDR 视频自动转换为 SDR
+func (vp *VideoProcessor) screenshotArgs(seconds float64, outputPath string) []string {
+	args := []string{"-ss", fmt.Sprintf("%.2f", seconds), "-i", vp.VideoPath, "-vframes", "1"}
+	if vp.IsHDR() {
+		args = append(args, "-vf", hdrTonemapFilter)
 	}
-	return etagsStr
+	return append(args, "-q:v", "2", "-y", outputPath)
 }
 
-func (b *BcutASR) createTask() error {
-	payload := map[string]interface{}{
-		"resource": b.downloadURL,
-		"model_id": ModelIDUpload,
+// IsHDR 通过 ffprobe 的 color_transfer 判断视频是否为 HDR (PQ / HLG)
+func (vp *VideoProcessor) IsHDR() bool {
+	if vp.hdr != nil {
+		return *vp.hdr
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-select_streams", "v:0",
+		"-show_entries", "stream=color_transfer", "-of", "csv=p=0", vp.VideoPath)
+	done := trackFFmpeg()
+	output, err := cmd.Output()
+	done()
 	if err != nil {
-		return fmt.Errorf("JSON编码失败: %w", err)
+		Warn("检测HDR失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", API_CREATE_TASK, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return fmt.Errorf("创建HTTP请求失败: %w", err)
+	transfer := strings.TrimSpace(string(output))
+	hdr := transfer == "smpte2084" || transfer == "arib-std-b67"
+	if hdr {
+		Info("检测到HDR视频(%s)，截图将转换为SDR", transfer)
 	}
+	vp.hdr = &hdr
+	return hdr
+}
 
-	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
-	req.Header.Set("Content-Type", "application/json")
+// VideoInfo ffprobe 探测到的视频元数据
+type VideoInfo struct {
+	Duration   float64 `json:"duration"` // 秒
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Codec      string  `json:"codec"`
+	FPS        float64 `json:"fps"`
+	Bitrate    int64   `json:"bitrate"` // 总码率 (bit/s)
+	AudioCodec string  `json:"audio_codec,omitempty"`
+	HasAudio   bool    `json:"has_audio"`
+}
 
-	// 使用带代理的客户端
-	client := getHTTPClient()
-	resp, err := client.Do(req)
+// ffprobeOutput ffprobe -show_format -show_streams -of json 的输出中用到的字段
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		RFrameRate   string `json:"r_frame_rate"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// GetVideoInfo 一次 ffprobe 调用获取时长、分辨率、编码、帧率和码率
+func (vp *VideoProcessor) GetVideoInfo() (*VideoInfo, error) {
+	if vp.info != nil {
+		return vp.info, nil
+	}
+
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-show_format", "-show_streams", "-of", "json", vp.VideoPath)
+	done := trackFFmpeg()
+	output, err := cmd.Output()
+	done()
 	if err != nil {
-		return fmt.Errorf("发送HTTP请求失败: %w", err)
+		return nil, fmt.Errorf("获取视频信息失败: %v", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	info, err := parseVideoInfo(output)
 	if err != nil {
-		return fmt.Errorf("读取响应失败: %w", err)
+		return nil, err
 	}
+	vp.info = info
+	return info, nil
+}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return fmt.Errorf("解析JSON响应失败: %w", err)
+// parseVideoInfo 解析 ffprobe 的 JSON 输出，取第一条视频流和音频流
+func parseVideoInfo(data []byte) (*VideoInfo, error) {
+	var probe ffprobeOutput
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("解析视频信息失败: %w", err)
 	}
 
-	data, ok := result["data"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("响应格式错误")
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return nil, fmt.Errorf("解析时长失败: %v", err)
+	}
+	info := &VideoInfo{Duration: duration}
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+
+	videoFound := false
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && !videoFound:
+			videoFound = true
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.Codec = stream.CodecName
+			info.FPS = parseFrameRate(stream.AvgFrameRate)
+			if info.FPS == 0 {
+				info.FPS = parseFrameRate(stream.RFrameRate)
+			}
+		case stream.CodecType == "audio" && !info.HasAudio:
+			info.HasAudio = true
+			info.AudioCodec = stream.CodecName
+		}
 	}
+	return info, nil
+}
 
-	if taskID, ok := data["task_id"].(string); ok {
-		b.taskID = taskID
+// parseFrameRate 解析 ffprobe 的分数帧率 (如 30000/1001)
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
 	}
+	return n / d
+}
 
-	Info("任务已创建: %s", b.taskID)
-	return nil
+// GetVideoDuration 获取视频时长
+func (vp *VideoProcessor) GetVideoDuration() (float64, error) {
+	info, err := vp.GetVideoInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
 }
 
-func (b *BcutASR) queryResult(ctx context.Context, callback ProgressCallback) (map[string]interface{}, error) {
-	// 使用带代理的客户端
-	client := getHTTPClient()
-	instanceID := GenerateRandomString(6)
+// parseClockTime 解析 HH:MM:SS(.ms)、MM:SS 或纯秒数格式的时间点
+func parseClockTime(value string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("无效的时间格式: %s", value)
+	}
+	seconds := 0.0
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("无效的时间格式: %s", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
 
-	Info("[BcutASR-%s] 开始轮询查询任务: %s", instanceID, b.taskID)
+// SplitVideo 按 HH:MM:SS 分割点把视频流复制切成多段，依次命名为 <文件名>_part1<扩展名> ...
+// 分割点必须严格递增且在视频时长内，outputDir 为空时输出到视频的输出目录
+func SplitVideo(input string, points []string, outputDir string) ([]string, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("缺少分割点")
+	}
 
-	for i := 0; i < MaxRetries; i++ {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-		}
+	vp, err := NewVideoProcessor(input)
+	if err != nil {
+		return nil, err
+	}
+	if outputDir == "" {
+		outputDir = vp.OutputDir
+	} else if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("创建输出目录失败: %w", err)
+	}
+	duration, err := vp.GetVideoDuration()
+	if err != nil {
+		return nil, err
+	}
 
-		url := fmt.Sprintf("%s?model_id=%s&task_id=%s", API_QUERY_RESULT, ModelIDQuery, b.taskID)
-		req, err := http.NewRequest("GET", url, nil)
+	bounds := []float64{0}
+	for _, point := range points {
+		seconds, err := parseClockTime(point)
 		if err != nil {
-			return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
+			return nil, err
+		}
+		if seconds <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("分割点必须严格递增: %s", point)
 		}
+		if seconds >= duration {
+			return nil, fmt.Errorf("分割点超出视频时长 (%.2f秒): %s", duration, point)
+		}
+		bounds = append(bounds, seconds)
+	}
+	bounds = append(bounds, duration)
 
-		req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
-		req.Header.Set("Content-Type", "application/json")
+	ext := filepath.Ext(vp.VideoPath)
+	base := strings.TrimSuffix(filepath.Base(vp.VideoPath), ext)
+	outputs := make([]string, 0, len(bounds)-1)
+	for i := 0; i < len(bounds)-1; i++ {
+		outputPath := filepath.Join(outputDir, fmt.Sprintf("%s_part%d%s", base, i+1, ext))
+		cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.3f", bounds[i]), "-i", vp.VideoPath,
+			"-t", fmt.Sprintf("%.3f", bounds[i+1]-bounds[i]), "-map", "0", "-c", "copy",
+			"-avoid_negative_ts", "make_zero", "-y", outputPath)
 
-		resp, err := client.Do(req)
+		done := trackFFmpeg()
+		_, err := cmd.CombinedOutput()
+		done()
 		if err != nil {
-			Warn("[BcutASR-%s] 第 %d 次查询请求失败: %v，将重试", instanceID, i, err)
-			time.Sleep(RetryBaseDelay)
-			continue
+			return outputs, fmt.Errorf("分割第 %d 段失败: %v", i+1, err)
 		}
+		Info("完成第 %d 段: %s", i+1, outputPath)
+		outputs = append(outputs, outputPath)
+	}
+	return outputs, nil
+}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
+// Chapter 视频章节
+type Chapter struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time,omitempty"` // 为0时取下一章节开始或视频结尾
+	Title     string  `json:"title"`
+}
 
-		if err != nil {
-			Warn("[BcutASR-%s] 第 %d 次查询读取响应失败: %v，将重试", instanceID, i, err)
-			time.Sleep(RetryBaseDelay)
-			continue
-		}
+// escapeFFMetadata 转义 ffmetadata 中的特殊字符
+func escapeFFMetadata(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+	return replacer.Replace(value)
+}
 
-		var result map[string]interface{}
-		if err := json.Unmarshal(body, &result); err != nil {
-			Warn("[BcutASR-%s] 第 %d 次查询JSON解析失败: %v，将重试", instanceID, i, err)
-			time.Sleep(RetryBaseDelay)
-			continue
-		}
+// WriteChaptersToMP4 把章节写入视频的 chapter 元数据，返回输出目录中的新视频路径 (流复制，不重新编码)
+// 全局元数据 (标题、创建时间等) 保留原视频的，只从元数据文件读取章节
+func WriteChaptersToMP4(videoPath string, chapters []Chapter) (string, error) {
+	if len(chapters) == 0 {
+		return "", fmt.Errorf("没有章节信息")
+	}
 
-		data, ok := result["data"].(map[string]interface{})
-		if !ok {
-			Warn("[BcutASR-%s] 第 %d 次查询响应格式错误，将重试", instanceID, i)
-			time.Sleep(RetryBaseDelay)
-			continue
-		}
+	vp, err := NewVideoProcessor(videoPath)
+	if err != nil {
+		return "", err
+	}
+	duration, err := vp.GetVideoDuration()
+	if err != nil {
+		return "", err
+	}
 
-		state, ok := data["state"].(float64)
-		if !ok {
-			Warn("[BcutASR-%s] 第 %d 次查询状态字段缺失，将重试", instanceID, i)
-			time.Sleep(RetryBaseDelay)
-			continue
-		}
+	metaPath, err := vp.writeChapterMetadata(chapters, duration)
+	if err != nil {
+		return "", err
+	}
 
-		if state == 4 {
-			resultStr, ok := data["result"].(string)
-			if !ok || resultStr == "" {
-				return nil, fmt.Errorf("任务完成但结果为空")
-			}
+	ext := filepath.Ext(vp.VideoPath)
+	outputPath := filepath.Join(vp.OutputDir, strings.TrimSuffix(filepath.Base(vp.VideoPath), ext)+"_chapters"+ext)
+	cmd := exec.Command("ffmpeg", "-i", vp.VideoPath, "-i", metaPath,
+		"-map", "0", "-map_metadata", "0", "-map_chapters", "1", "-codec", "copy", "-y", outputPath)
+	defer trackFFmpeg()()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("写入章节失败: %v, %s", err, strings.TrimSpace(string(output)))
+	}
 
-			var resultData map[string]interface{}
-			if err := json.Unmarshal([]byte(resultStr), &resultData); err != nil {
-				return nil, fmt.Errorf("解析结果失败: %w", err)
-			}
-			return resultData, nil
-		} else if state == 3 {
-			return nil, fmt.Errorf("任务处理失败，状态: %v", state)
-		}
+	Info("已写入 %d 个章节: %s", len(chapters), outputPath)
+	return outputPath, nil
+}
 
-		if callback != nil && i%5 == 0 {
-			progress := 60 + int(float64(i)/float64(MaxRetries)*39)
-			if progress > 99 {
-				progress = 99
+// writeChapterMetadata 按开始时间排序章节并生成 ffmetadata 文件，返回文件路径
+func (vp *VideoProcessor) writeChapterMetadata(chapters []Chapter, duration float64) (string, error) {
+	sorted := make([]Chapter, len(chapters))
+	copy(sorted, chapters)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].StartTime < sorted[j].StartTime })
+
+	var meta strings.Builder
+	meta.WriteString(";FFMETADATA1\n")
+	for i, chapter := range sorted {
+		end := chapter.EndTime
+		if end <= chapter.StartTime {
+			end = duration
+			if i+1 < len(sorted) {
+				end = sorted[i+1].StartTime
 			}
-			callback(progress, fmt.Sprintf("处理中 %d%%...", progress))
 		}
+		meta.WriteString("\n[CHAPTER]\nTIMEBASE=1/1000\n")
+		meta.WriteString(fmt.Sprintf("START=%d\nEND=%d\n", int64(chapter.StartTime*1000), int64(end*1000)))
+		meta.WriteString("title=" + escapeFFMetadata(chapter.Title) + "\n")
+	}
 
-		sleepDuration := RetryBaseDelay
-		if i > 20 {
-			sleepDuration = RetryBaseDelay * 2
-		}
-		if i > 50 {
-			sleepDuration = RetryLongDelay
-		}
-		time.Sleep(sleepDuration)
+	metaPath := filepath.Join(vp.OutputDir, "chapters.ffmetadata")
+	if err := os.WriteFile(metaPath, []byte(meta.String()), 0644); err != nil {
+		return "", fmt.Errorf("写入章节元数据失败: %w", err)
 	}
+	return metaPath, nil
+}
 
-	return nil, fmt.Errorf("任务超时未完成")
+// subtitleStreamCodecs 返回视频中已有字幕轨的编码 (如 mov_text、subrip)，按轨道顺序
+func (vp *VideoProcessor) subtitleStreamCodecs() []string {
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-select_streams", "s",
+		"-show_entries", "stream=codec_name", "-of", "csv=p=0", vp.VideoPath)
+	done := trackFFmpeg()
+	output, err := cmd.Output()
+	done()
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(output))
 }
 
-func (b *BcutASR) makeSegments(result map[string]interface{}) []DataSegment {
-	segments := []DataSegment{}
+// PackageMKV 把视频、多语言字幕轨 (语言代码 -> 字幕文件)、章节和封面封装进一个 MKV (流复制，不重新编码)
+// 视频原有的音视频轨和字幕轨保留，新字幕轨追加在后面
+func PackageMKV(videoPath string, subtitles map[string]string, chapters []Chapter, cover string) (string, error) {
+	vp, err := NewVideoProcessor(videoPath)
+	if err != nil {
+		return "", err
+	}
 
-	utterances, ok := result["utterances"].([]interface{})
-	if !ok {
-		Warn("解析B站ASR结果失败: 未找到utterances数组")
-		return segments
+	languages := make([]string, 0, len(subtitles))
+	for lang := range subtitles {
+		languages = append(languages, lang)
 	}
+	sort.Strings(languages)
 
-	for _, u := range utterances {
-		utterance, ok := u.(map[string]interface{})
-		if !ok {
-			continue
+	args := []string{"-i", vp.VideoPath}
+	for _, lang := range languages {
+		args = append(args, "-i", subtitles[lang])
+	}
+	chapterInput := -1
+	if len(chapters) > 0 {
+		duration, err := vp.GetVideoDuration()
+		if err != nil {
+			return "", err
 		}
-
-		text, _ := utterance["transcript"].(string)
-		startTimeRaw, _ := utterance["start_time"].(float64)
-		endTimeRaw, _ := utterance["end_time"].(float64)
-
-		startTime := startTimeRaw/1000.0 + TimeOffset
-		endTime := endTimeRaw/1000.0 + TimeOffset
-
-		segments = append(segments, DataSegment{
-			Text:      text,
-			StartTime: startTime,
-			EndTime:   endTime,
-		})
+		metaPath, err := vp.writeChapterMetadata(chapters, duration)
+		if err != nil {
+			return "", err
+		}
+		chapterInput = len(languages) + 1
+		args = append(args, "-i", metaPath)
 	}
 
-	return segments
-}
-
-// ==================== SRT生成 ====================
-
-func formatSRTTime(seconds float64) string {
-	h := int(seconds / 3600)
-	m := int((seconds - float64(h*3600)) / 60)
-	s := int(seconds - float64(h*3600) - float64(m*60))
-	ms := int((seconds - float64(int(seconds))) * 1000)
-
-	return fmt.Sprintf("%02d:%02d:%02d,%03d", h, m, s, ms)
-}
-
-func generateSRT(segments []DataSegment) string {
-	var srtBuffer bytes.Buffer
+	// 只取原视频的音视频和字幕轨，MP4 中的 tmcd 等数据轨无法放入 MKV
+	args = append(args, "-map", "0:v?", "-map", "0:a?", "-map", "0:s?")
+	for i := range languages {
+		args = append(args, "-map", strconv.Itoa(i+1))
+	}
+	if chapterInput > 0 {
+		args = append(args, "-map_chapters", strconv.Itoa(chapterInput))
+	}
 
-	for i, segment := range segments {
-		srtBuffer.WriteString(fmt.Sprintf("%d\n", i+1))
-		srtBuffer.WriteString(fmt.Sprintf("%s --> %s\n",
-			formatSRTTime(segment.StartTime),
-			formatSRTTime(segment.EndTime)))
-		srtBuffer.WriteString(fmt.Sprintf("%s\n\n", segment.Text))
+	existingCodecs := vp.subtitleStreamCodecs()
+	existing := len(existingCodecs)
+	for i, lang := range languages {
+		stream := fmt.Sprintf("-metadata:s:s:%d", existing+i)
+		args = append(args, stream, "language="+lang, stream, "title="+lang)
 	}
 
-	return srtBuffer.String()
-}
+	if cover != "" {
+		if _, err := os.Stat(cover); err != nil {
+			return "", fmt.Errorf("封面文件不存在: %w", err)
+		}
+		mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(cover)))
+		if mimeType == "" {
+			mimeType = "image/jpeg"
+		}
+		// MKV 播放器按附件名 cover.* 识别封面
+		args = append(args, "-attach", cover,
+			"-metadata:s:t", "mimetype="+mimeType,
+			"-metadata:s:t", "filename=cover"+strings.ToLower(filepath.Ext(cover)))
+	}
+
+	outputPath := filepath.Join(vp.OutputDir, strings.TrimSuffix(filepath.Base(vp.VideoPath), filepath.Ext(vp.VideoPath))+"_package.mkv")
+	args = append(args, "-codec", "copy")
+	// MP4 的 mov_text 字幕不能直接流复制进 MKV，转为 SRT；其余字幕轨照常复制
+	for i, codec := range existingCodecs {
+		if codec == "mov_text" {
+			args = append(args, fmt.Sprintf("-c:s:%d", i), "srt")
+		}
+	}
+	args = append(args, "-y", outputPath)
 
-func saveSRTFile(srtContent string, outputPath string) error {
-	err := os.WriteFile(outputPath, []byte(srtContent), 0644)
+	done := trackFFmpeg()
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	done()
 	if err != nil {
-		return fmt.Errorf("保存SRT文件失败: %w", err)
+		return "", fmt.Errorf("封装MKV失败: %v, %s", err, strings.TrimSpace(string(output)))
 	}
-	return nil
-}
-
-// ==================== AI总结服务 ====================
 
-// AISummarizer AI总结器
-type AISummarizer struct {
-	config AIConfig
+	Info("已封装MKV (%d 条字幕轨, %d 个章节): %s", len(languages), len(chapters), outputPath)
+	return outputPath, nil
 }
 
-func NewAISummarizer(config AIConfig) *AISummarizer {
-	return &AISummarizer{config: config}
+// HighlightReel 精华合集的输出
+type HighlightReel struct {
+	VideoPath    string  `json:"video_path"`
+	SubtitlePath string  `json:"subtitle_path,omitempty"`
+	Duration     float64 `json:"duration"`
 }
 
-// Summarize 调用AI进行总结
-func (ai *AISummarizer) Summarize(req AIRequest) (AIResponse, error) {
-	// 构建完整的文本内容（带时间戳，方便AI定位）
-	var fullTextBuilder bytes.Buffer
-	if len(req.Segments) > 0 {
-		for _, seg := range req.Segments {
-			// 格式：[12.5s] 这是一段话。
-			fullTextBuilder.WriteString(fmt.Sprintf("[%.2fs] %s\n", seg.StartTime, seg.Text))
+// highlightSegments 把落在各时间段内的字幕裁剪到段内，并平移到合集的时间轴上
+func highlightSegments(segments []DataSegment, ranges []TimeRange) []DataSegment {
+	result := []DataSegment{}
+	cursor := 0.0
+	for _, r := range ranges {
+		for _, seg := range selectSegments(segments, nil, []TimeRange{r}) {
+			seg.StartTime = math.Max(seg.StartTime, r.Start) - r.Start + cursor
+			seg.EndTime = math.Min(seg.EndTime, r.End) - r.Start + cursor
+			result = append(result, seg)
 		}
-	} else {
-		fullTextBuilder.WriteString(req.Text)
+		cursor += r.End - r.Start
 	}
-	fullText := fullTextBuilder.String()
-
-	// 构建高质量 Prompt
-	prompt := ai.config.CustomPrompt
-	if prompt == "" {
-		prompt = `你是一位专业的课程助教和内容分析专家。请根据提供的视频字幕内容（包含时间戳），生成一份详尽的课程学习笔记。
-
-要求：
-1. **核心摘要**：用简练的语言概括课程/视频的核心主题和目标。
-2. **关键概念解析**：提取视频中出现的专业术语或核心概念，并进行解释。
-3. **逻辑脉络梳理**：不要记流水账，请按逻辑层级（如：背景引入 -> 核心理论 -> 案例分析 -> 总结）重组内容。
-4. **智能配图与定位**：
-   - 在关键知识点讲解处，插入截图标记：[[CAPTURE: 秒数]]
-   - **必须**：在每个重要段落或列表项开头，插入时间戳标记：[[TIME: 秒数]]，方便回溯。
-   - 注意前端是这样解析这些标记的，请严格按照格式输出，否则无法识别。md.replace(/\[\[TIME:\s*(\d+(\.\d+)?)\]\]/g, (match, p1) => {
+	return result
+}
 
-请使用 Markdown 格式输出，保持排版清晰专业。`
+// CreateHighlightReel 按时间段切出精华片段并拼接成合集视频 (highlight_reel.mp4)
+// transition > 0 时每段首尾加该秒数的淡入淡出；segments 不为空时同时生成合集字幕 (highlight_reel.srt)
+// 各片段统一重新编码，避免流复制在非关键帧处切割导致拼接后花屏
+func CreateHighlightReel(videoPath string, ranges []TimeRange, segments []DataSegment, transition float64) (*HighlightReel, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("缺少精华时间段")
 	}
 
-	// 如果有截图，提及截图
-	if len(req.Screenshots) > 0 {
-		 fmt.Sprintf("\n注意：视频截图已保存在：%s，这些截图可以作为要点的视觉参考",
-			strings.Join(req.Screenshots, ", "))
+	vp, err := NewVideoProcessor(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		if err := vp.ValidateRange(r.Start, r.End); err != nil {
+			return nil, err
+		}
 	}
+	hasAudio := vp.checkAudioStream() == nil
 
-	// 完整的prompt
-	fullPrompt := fmt.Sprintf("%s\n\n内容：\n%s", prompt, fullText)
+	tempDir, err := os.MkdirTemp("", "highlight_")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var concatList strings.Builder
+	total := 0.0
+	for i, r := range ranges {
+		length := r.End - r.Start
+		clipPath := filepath.Join(tempDir, fmt.Sprintf("clip_%03d.mp4", i+1))
+		args := []string{"-ss", fmt.Sprintf("%.3f", r.Start), "-i", vp.VideoPath, "-t", fmt.Sprintf("%.3f", length),
+			"-map", "0:v:0", "-map", "0:a:0?", "-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac"}
+		if fade := math.Min(transition, length/2); fade > 0 {
+			args = append(args, "-vf", fmt.Sprintf("fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f", fade, length-fade, fade))
+			if hasAudio {
+				args = append(args, "-af", fmt.Sprintf("afade=t=in:st=0:d=%.2f,afade=t=out:st=%.2f:d=%.2f", fade, length-fade, fade))
+			}
+		}
+		args = append(args, "-y", clipPath)
 
-	// 如果没有配置API Key，使用本地模拟
-	if ai.config.APIKey == "" {
-		return ai.localSummarize(req.Text, req.Screenshots)
+		cmd := exec.Command("ffmpeg", args...)
+		done := trackFFmpeg()
+		_, err := cmd.CombinedOutput()
+		done()
+		if err != nil {
+			return nil, fmt.Errorf("切割第 %d 段失败: %v", i+1, err)
+		}
+		concatList.WriteString(fmt.Sprintf("file '%s'\n", filepath.ToSlash(clipPath)))
+		total += length
 	}
 
-	// 设置默认值
-	if ai.config.APIURL == "" {
-		ai.config.APIURL = "https://api.xiaomimimo.com/v1/chat/completions"
-	}
-	if ai.config.Model == "" {
-		ai.config.Model = "mimo-v2-flash"
+	listPath := filepath.Join(tempDir, "list.txt")
+	if err := os.WriteFile(listPath, []byte(concatList.String()), 0644); err != nil {
+		return nil, fmt.Errorf("写入拼接列表失败: %w", err)
 	}
-
-	// 1. 调用 AI 获取包含标记的 Markdown
-	rawResponse, err := ai.callExternalAI(fullPrompt, nil)
+	reelPath := filepath.Join(vp.OutputDir, "highlight_reel.mp4")
+	cmd := exec.Command("ffmpeg", "-f", "concat", "-safe", "0", "-i", listPath, "-c", "copy", "-y", reelPath)
+	done := trackFFmpeg()
+	_, err = cmd.CombinedOutput()
+	done()
 	if err != nil {
-		Error("AI总结请求失败: %v", err) // 新增日志
-		return rawResponse, err
+		return nil, fmt.Errorf("拼接合集失败: %v", err)
 	}
 
-	// 2. 处理截图标记 [[CAPTURE: 123.45]]
-	if req.VideoPath != "" {
-		processedMarkdown, err := ai.processScreenshots(rawResponse.Markdown, req.VideoPath)
-		if err == nil {
-			rawResponse.Markdown = processedMarkdown
+	reel := &HighlightReel{VideoPath: reelPath, Duration: total}
+	if len(segments) > 0 {
+		srtPath := filepath.Join(vp.OutputDir, "highlight_reel.srt")
+		if err := saveSRTFile(generateSRT(highlightSegments(segments, ranges)), srtPath); err != nil {
+			Warn("保存合集字幕失败: %v", err)
 		} else {
-			Warn("处理AI截图失败: %v", err)
-		}
-	}
-
-	// 3. 保存总结结果到本地缓存
-	if req.VideoPath != "" {
-		vp, err := NewVideoProcessor(req.VideoPath)
-		if err == nil {
-			summaryPath := filepath.Join(vp.OutputDir, "summary.json")
-			if data, err := json.MarshalIndent(rawResponse, "", "  "); err == nil {
-				os.WriteFile(summaryPath, data, 0644)
-				Info("AI总结已保存到: %s", summaryPath)
-			}
+			reel.SubtitlePath = srtPath
 		}
 	}
 
-	return rawResponse, nil
+	Info("精华合集生成成功: %s (%d 段, %.1f 秒)", reelPath, len(ranges), total)
+	return reel, nil
 }
 
-// processScreenshots 解析Markdown中的截图标记并生成图片
-func (ai *AISummarizer) processScreenshots(markdown string, videoPath string) (string, error) {
-	vp, err := NewVideoProcessor(videoPath)
-	if err != nil {
-		return markdown, err
-	}
+// ==================== 音频工具 ====================
 
-	// 正则匹配 [[CAPTURE: 123.45]]
-	// 简单起见，我们逐行处理或使用 ReplaceAllStringFunc
-	lines := strings.Split(markdown, "\n")
-	var newLines []string
+// TimedClip 按时间定位的音频片段
+type TimedClip struct {
+	Path  string  `json:"path"`
+	Start float64 `json:"start"` // 在输出音轨中的起始时间(秒)
+}
 
-	for _, line := range lines {
-		if strings.Contains(line, "[[CAPTURE:") {
-			// 提取时间戳
-			start := strings.Index(line, "[[CAPTURE:")
-			end := strings.Index(line[start:], "]]")
-			if end != -1 {
-				tagContent := line[start+10 : start+end]
-				seconds, err := strconv.ParseFloat(strings.TrimSpace(tagContent), 64)
-				if err == nil {
-					// 提取截图
-					imgPath, err := vp.ExtractScreenshotAt(seconds)
-					if err == nil {
-						// 转换路径为 Web 可访问路径
-						// 假设 DOWNLOAD_DIR 是 D:/download
-						// imgPath 是 D:/download/output_xxx/ai_capture_xxx.jpg
-						// Web路径应为 /files/output_xxx/ai_capture_xxx.jpg
-						relPath, _ := filepath.Rel(DOWNLOAD_DIR, imgPath)
-						webPath := "/files/" + filepath.ToSlash(relPath)
-
-						// 替换标记为 Markdown 图片
-						imageMd := fmt.Sprintf("\n![视频截图 %.2fs](%s)\n", seconds, webPath)
-						line = strings.Replace(line, fmt.Sprintf("[[CAPTURE:%s]]", tagContent), imageMd, -1)
-						// 同时也处理带空格的情况
-						line = strings.Replace(line, fmt.Sprintf("[[CAPTURE: %s]]", tagContent), imageMd, -1)
-					}
-				}
-			}
-		}
-		newLines = append(newLines, line)
+// BuildTimedAudio 把多个音频片段按起始时间放到正确位置，间隙填充静音，输出对齐后的完整音轨
+// 输出文件为第一个片段所在目录下的 timed_audio.mp3
+func BuildTimedAudio(clips []TimedClip) (string, error) {
+	if len(clips) == 0 {
+		return "", fmt.Errorf("没有可拼接的音频片段")
 	}
 
-	return strings.Join(newLines, "\n"), nil
-}
-
-// localSummarize 本地模拟总结
-func (ai *AISummarizer) localSummarize(text string, screenshots []string) (AIResponse, error) {
-	// 分割文本，提取关键句子
-	sentences := strings.Split(text, "。")
-	var points []string
+	outputPath := filepath.Join(filepath.Dir(clips[0].Path), "timed_audio.mp3")
 
-	for _, sentence := range sentences {
-		sentence = strings.TrimSpace(sentence)
-		if len(sentence) > 10 {
-			points = append(points, sentence)
-			if len(points) >= 5 {
-				break
-			}
+	var args []string
+	var filter strings.Builder
+	for i, clip := range clips {
+		if _, err := os.Stat(clip.Path); err != nil {
+			return "", fmt.Errorf("音频片段不存在: %s", clip.Path)
 		}
-	}
+		args = append(args, "-i", clip.Path)
 
-	if len(points) == 0 && len(text) > 0 {
-		points = append(points, text)
+		delay := int(math.Max(clip.Start, 0) * 1000)
+		filter.WriteString(fmt.Sprintf("[%d:a]adelay=%d:all=1[a%d];", i, delay, i))
 	}
+	for i := range clips {
+		filter.WriteString(fmt.Sprintf("[a%d]", i))
+	}
+	// normalize=0 保持各片段原音量
+	filter.WriteString(fmt.Sprintf("amix=inputs=%d:duration=longest:normalize=0[out]", len(clips)))
 
-	// 构建Markdown输出
-	var markdown bytes.Buffer
-	markdown.WriteString("# 视频总结\n\n")
+	args = append(args, "-filter_complex", filter.String(), "-map", "[out]",
+		"-acodec", "libmp3lame", "-y", outputPath)
 
-	screenshotInfo := ""
-	if len(screenshots) > 0 {
-		// 只显示截图文件名，不显示完整路径
-		var screenshotNames []string
-		for _, s := range screenshots {
-			screenshotNames = append(screenshotNames, filepath.Base(s))
-		}
-		screenshotInfo = fmt.Sprintf("\n> 视频截图：%s", strings.Join(screenshotNames, ", "))
+	done := trackFFmpeg()
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	done()
+	if err != nil {
+		return "", fmt.Errorf("拼接音频失败: %v, %s", err, strings.TrimSpace(string(output)))
 	}
 
-	markdown.WriteString(fmt.Sprintf("## 核心要点%s\n\n", screenshotInfo))
-	for i, point := range points {
-		markdown.WriteString(fmt.Sprintf("- **要点%d**：%s\n", i+1, point))
-	}
+	Info("对齐音轨已生成: %s", outputPath)
+	return outputPath, nil
+}
 
-	markdown.WriteString("\n## 详细总结\n\n")
-	markdown.WriteString(text)
+// ==================== ASR相关 ====================
 
-	return AIResponse{
-		Summary:  strings.Join(points, "；"),
-		Markdown: markdown.String(),
-		Points:   points,
-		Success:  true,
-	}, nil
+// ASRProvider 语音识别服务
+type ASRProvider interface {
+	GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error)
 }
 
-// Chat 进行AI对话
-func (ai *AISummarizer) Chat(req ChatRequest) (string, error) {
-	// 设置默认值
-	if ai.config.APIURL == "" {
-		ai.config.APIURL = "https://api.xiaomimimo.com/v1/chat/completions"
-	}
-	if ai.config.Model == "" {
-		ai.config.Model = "mimo-v2-flash"
-	}
+// timeOffsetSetter 支持时间戳校正的识别服务
+type timeOffsetSetter interface {
+	SetTimeOffset(offset float64)
+}
 
-	// 构建消息列表
-	var messages []map[string]string
+// languageSetter 支持指定识别语言的识别服务
+type languageSetter interface {
+	SetLanguage(language string)
+}
 
-	// 系统提示词 (更新)
-	systemPrompt := `你是一位专业的AI导师。用户会根据一段视频的内容向你提问。
-请基于提供的[上下文内容]回答用户的问题。
-回答要求：
-1. 像老师一样循循善诱，解答疑惑，语言通俗易懂。
-2. **非常重要**：在回答的最后，请根据上下文内容出3道相关的课后选择题或思考题，帮助用户巩固知识。
-3. **题目格式要求**：
-   - 如果是选择题，请在题目上方标注 [TYPE: MULTIPLE_CHOICE]。
-   - 题目和选项之间要换行。
-   - 选项使用 A. B. C. D. 开头。
-   - 例如：
-     [TYPE: MULTIPLE_CHOICE]
-     1. 这是一个问题？
-     A. 选项一
-     B. 选项二
-4. 如果上下文中没有答案，请利用你的通用知识回答，并说明这一点。`
+// uploadOptionsSetter 需要上传音频、支持限速和并发上传的识别服务
+type uploadOptionsSetter interface {
+	SetUploadOptions(rateLimit int64, concurrency int)
+}
 
-	if req.Context != "" {
-		systemPrompt += fmt.Sprintf("\n\n[上下文内容]：\n%s", req.Context)
+// DefaultASRProvider 未指定时使用的识别服务
+const DefaultASRProvider = "bcut"
+
+// asrProviders 已注册的识别服务，按名称选择
+var asrProviders = map[string]func(audioPath string, useCache bool) (ASRProvider, error){
+	"bcut": func(audioPath string, useCache bool) (ASRProvider, error) {
+		return NewBcutASR(audioPath, useCache)
+	},
+	"whisper": func(audioPath string, useCache bool) (ASRProvider, error) {
+		return NewWhisperASR(audioPath, useCache)
+	},
+	"funasr": func(audioPath string, useCache bool) (ASRProvider, error) {
+		return NewFunASR(audioPath, useCache)
+	},
+	"azure": func(audioPath string, useCache bool) (ASRProvider, error) {
+		return NewAzureASR(audioPath, useCache)
+	},
+	"google": func(audioPath string, useCache bool) (ASRProvider, error) {
+		return NewGoogleASR(audioPath, useCache)
+	},
+}
+
+// NewASRProvider 按名称创建识别服务，name 为空时使用必剪
+func NewASRProvider(name, audioPath string, useCache bool) (ASRProvider, error) {
+	if name == "" {
+		name = DefaultASRProvider
 	}
+	factory, ok := asrProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("不支持的ASR服务: %s", name)
+	}
+	return factory(audioPath, useCache)
+}
 
-	messages = append(messages, map[string]string{"role": "system", "content": systemPrompt})
+// NewASRService 按名称和识别语言创建识别服务，返回实际使用的服务名和语言
+// language 为 auto 时先检测音频语言 (resolveASRLanguage)：未指定 name 时据此选择服务，并把检测结果设为识别语言
+func NewASRService(ctx context.Context, name, language, audioPath string, useCache bool) (ASRProvider, string, string, error) {
+	name, language = resolveASRLanguage(ctx, name, language, audioPath)
+	asrClient, err := NewASRProvider(name, audioPath, useCache)
+	if err != nil {
+		return nil, name, language, err
+	}
+	if setter, ok := asrClient.(languageSetter); ok && language != "" && language != "auto" {
+		setter.SetLanguage(language)
+	}
+	return asrClient, name, language, nil
+}
 
-	// 添加历史记录
-	if len(req.History) > 0 {
-		messages = append(messages, req.History...)
+// BaseASR ASR基类
+type BaseASR struct {
+	AudioPath  string
+	FileBinary []byte
+	UseCache   bool
+	CacheDir   string        // 缓存目录，默认 CacheDir
+	CacheTTL   time.Duration // 缓存有效期，默认 CacheTTL
+}
+
+func NewBaseASR(audioPath string, useCache bool) (*BaseASR, error) {
+	fileBytes, err := os.ReadFile(audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取音频文件失败: %w", err)
 	}
 
-	// 添加当前问题
-	messages = append(messages, map[string]string{"role": "user", "content": req.Message})
+	return &BaseASR{
+		AudioPath:  audioPath,
+		FileBinary: fileBytes,
+		UseCache:   useCache,
+		CacheDir:   CacheDir,
+		CacheTTL:   CacheTTL,
+	}, nil
+}
 
-	// 发送请求
-	return ai.sendChatRequest(messages)
+func (b *BaseASR) GetCacheKey(serviceName string) string {
+	hash := md5.New()
+	hash.Write([]byte(b.AudioPath))
+	hash.Write(b.FileBinary)
+	return fmt.Sprintf("%s_%s", serviceName, hex.EncodeToString(hash.Sum(nil)))
 }
 
-// sendChatRequest 发送通用聊天请求
-func (ai *AISummarizer) sendChatRequest(messages []map[string]string) (string, error) {
-	reqBody := map[string]interface{}{
-		"model":    ai.config.Model,
-		"messages": messages,
-		"stream":   false,
+func (b *BaseASR) LoadFromCache(cacheDir string, cacheKey string) ([]DataSegment, bool) {
+	cachePath := filepath.Join(cacheDir, cacheKey+".json")
+	info, err := os.Stat(cachePath)
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err == nil && b.CacheTTL > 0 && time.Since(info.ModTime()) > b.CacheTTL {
+		Info("缓存已过期: %s", cachePath)
+		return nil, false
 	}
 
-	jsonData, err := json.Marshal(reqBody)
+	data, err := os.ReadFile(cachePath)
 	if err != nil {
-		return "", fmt.Errorf("JSON编码失败: %w", err)
+		Warn("读取缓存失败: %v", err)
+		return nil, false
 	}
 
-	req, err := http.NewRequest("POST", ai.config.APIURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %w", err)
+	var segments []DataSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		Warn("解析缓存失败: %v", err)
+		return nil, false
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+ai.config.APIKey)
+	return segments, true
+}
 
-	// 使用带代理的客户端 (如果需要AI也走代理，可以使用 getHTTPClient，这里暂时保持直连或根据需求修改)
-	// 考虑到国内访问OpenAI等可能需要代理，这里也统一使用代理
-	client := getHTTPClient()
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("API请求失败: %w", err)
+func (b *BaseASR) SaveToCache(cacheDir string, cacheKey string, segments []DataSegment) error {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("创建缓存目录失败: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	cachePath := filepath.Join(cacheDir, cacheKey+".json")
+	data, err := json.MarshalIndent(segments, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("读取响应失败: %w", err)
+		return fmt.Errorf("序列化缓存失败: %w", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API错误 (状态码 %d): %s", resp.StatusCode, string(body))
+	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+		return fmt.Errorf("写入缓存失败: %w", err)
 	}
 
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-		Error struct {
-			Message string `json:"message"`
-		} `json:"error"`
-	}
+	return nil
+}
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("解析响应失败: %w", err)
+// purgeExpiredCache 删除缓存目录中修改时间早于 ttl 的缓存文件，返回删除数量
+func purgeExpiredCache(dir string, ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
 	}
 
-	if len(result.Choices) == 0 {
-		if result.Error.Message != "" {
-			return "", fmt.Errorf("API返回错误: %s", result.Error.Message)
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
 		}
-		return "", fmt.Errorf("API返回结果为空")
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			Warn("删除过期缓存失败 %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
 	}
-
-	return result.Choices[0].Message.Content, nil
+	return removed
 }
 
-// callExternalAI 调用外部AI (重构为使用 sendChatRequest)
-func (ai *AISummarizer) callExternalAI(prompt string, screenshots []string) (AIResponse, error) {
-	messages := []map[string]string{
-		{"role": "user", "content": prompt},
-	}
+// CacheEntry 缓存文件信息
+type CacheEntry struct {
+	Key     string `json:"key"`  // 文件路径，删除单个缓存时传入
+	Type    string `json:"type"` // asr / ai / segments / summary
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+}
 
-	content, err := ai.sendChatRequest(messages)
-	if err != nil {
-		return AIResponse{}, err
+// listCacheEntries 列出 ASR/AI 缓存目录和各视频输出目录中的识别结果、总结缓存
+func listCacheEntries() []CacheEntry {
+	var entries []CacheEntry
+	addFile := func(path, cacheType string) {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			return
+		}
+		entries = append(entries, CacheEntry{
+			Key:     path,
+			Type:    cacheType,
+			Size:    info.Size(),
+			ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
+		})
 	}
-
-	// 简单提取要点 (保持原有逻辑)
-	var points []string
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") || strings.HasPrefix(line, "1. ") {
-			cleanLine := strings.TrimLeft(line, "-*1234567890. ")
-			if len(cleanLine) > 0 {
-				points = append(points, cleanLine)
+	addDir := func(dir, cacheType string) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, file := range files {
+			if filepath.Ext(file.Name()) == ".json" {
+				addFile(filepath.Join(dir, file.Name()), cacheType)
 			}
 		}
 	}
 
-	if len(points) == 0 {
-		sentences := strings.Split(content, "。")
-		for i, s := range sentences {
-			if i >= 5 {
-				break
-			}
-			if len(s) > 5 {
-				points = append(points, s)
-			}
-		}
+	addDir(CacheDir, "asr")
+	addDir(AICacheDir, "ai")
+	for _, dir := range listOutputDirs(false) {
+		addFile(filepath.Join(dir, "segments.json"), "segments")
+		addFile(filepath.Join(dir, outputFileName("summary", "", "")), "summary")
 	}
+	return entries
+}
 
-	return AIResponse{
-		Summary:  "AI智能总结",
-		Markdown: content,
-		Points:   points,
-		Success:  true,
-	}, nil
+// BcutASR 必剪语音识别
+type BcutASR struct {
+	*BaseASR
+	taskID      string
+	etags       []string
+	inBossKey   string
+	resourceID  string
+	uploadID    string
+	uploadURLs  []string
+	perSize     int
+	clips       int
+	downloadURL string
+	TimeOffset  float64 // 时间戳校正 (秒)，默认 TimeOffset
+
+	UploadRateLimit   int64 // 上传速率上限 (字节/秒)，所有并发分片共享，0 表示不限速
+	UploadConcurrency int   // 同时上传的分片数，默认 DefaultUploadConcurrency
 }
 
-// ==================== 文件操作服务 ====================
+func NewBcutASR(audioPath string, useCache bool) (*BcutASR, error) {
+	baseASR, err := NewBaseASR(audioPath, useCache)
+	if err != nil {
+		return nil, err
+	}
 
-// listDownloadFiles 列出D:/download目录下的文件
-func listDownloadFiles() ([]FileItem, error) {
-	startTime := time.Now()
-	var files []FileItem
-	
-	// 监听列表：主目录 和 dest子目录
-	scanDirs := []string{DOWNLOAD_DIR, filepath.Join(DOWNLOAD_DIR, "dest")}
+	return &BcutASR{
+		BaseASR:           baseASR,
+		etags:             make([]string, 0),
+		TimeOffset:        TimeOffset,
+		UploadConcurrency: DefaultUploadConcurrency,
+	}, nil
+}
 
-	for _, dir := range scanDirs {
-		dirStartTime := time.Now()
-		// 检查目录是否存在
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			continue
-		}
+// SetTimeOffset 设置时间戳校正 (秒)
+func (b *BcutASR) SetTimeOffset(offset float64) {
+	b.TimeOffset = offset
+}
 
-		// 读取目录内容
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			Warn("读取目录失败 %s: %v", dir, err)
-			continue
-		}
-		Info("扫描目录 [%s] 完成，条目数: %d, 耗时: %v", dir, len(entries), time.Since(dirStartTime))
+// SetUploadOptions 设置上传速率上限 (字节/秒) 和并发分片数，<=0 的值保持默认
+func (b *BcutASR) SetUploadOptions(rateLimit int64, concurrency int) {
+	if rateLimit > 0 {
+		b.UploadRateLimit = rateLimit
+	}
+	if concurrency > 0 {
+		b.UploadConcurrency = concurrency
+	}
+}
 
-		for _, entry := range entries {
-			if entry.IsDir() {
-				continue
-			}
+func (b *BcutASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
+	instanceID := fmt.Sprintf("BcutASR-%s", GenerateRandomString(8))
+	Info("[%s] GetResult 开始处理音频: %s", instanceID, b.AudioPath)
 
-			info, err := entry.Info()
-			if err != nil {
-				continue
+	// 检查缓存
+	cacheKey := b.GetCacheKey("BcutASR")
+	if b.UseCache {
+		if segments, ok := b.LoadFromCache(b.CacheDir, cacheKey); ok {
+			Info("[%s] 从缓存加载必剪ASR结果", instanceID)
+			if callback != nil {
+				callback(100, "识别完成 (缓存)")
 			}
+			return segments, nil
+		}
+		Info("[%s] 缓存未命中", instanceID)
+	}
 
-			fileName := entry.Name()
-			ext := strings.ToLower(filepath.Ext(fileName))
+	// 上传阶段
+	if callback != nil {
+		callback(20, "正在上传...")
+	}
+	if err := b.upload(ctx, callback); err != nil {
+		Error("[%s] 上传失败: %v", instanceID, err)
+		return nil, fmt.Errorf("必剪ASR上传失败: %w", err)
+	}
 
-			// 处理 wma 转换
-			if ext == ".wma" {
-				wmaPath := filepath.Join(dir, fileName)
-				mp3Path := strings.TrimSuffix(wmaPath, ext) + ".mp3"
-				if err := exec.Command("ffmpeg", "-i", wmaPath, "-q:a", "2", "-y", mp3Path).Run(); err == nil {
-					os.Remove(wmaPath)
-					if newInfo, err := os.Stat(mp3Path); err == nil {
-						info = newInfo
-						fileName = filepath.Base(mp3Path)
-						ext = ".mp3"
-					}
-				}
-			}
+	// 创建任务阶段
+	if callback != nil {
+		callback(50, "提交任务...")
+	}
+	if err := b.createTask(); err != nil {
+		Error("[%s] 创建任务失败: %v", instanceID, err)
+		return nil, fmt.Errorf("必剪ASR创建任务失败: %w", err)
+	}
 
-			fileType := "other"
-			if ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".mov" || ext == ".flv" {
-				fileType = "video"
-			} else if ext == ".mp3" || ext == ".wav" || ext == ".flac" || ext == ".aac" {
-				fileType = "audio"
-			}
+	// 查询结果阶段
+	if callback != nil {
+		callback(60, "等待结果...")
+	}
+	result, err := b.queryResult(ctx, callback)
+	if err != nil {
+		Error("[%s] 查询结果失败: %v", instanceID, err)
+		return nil, fmt.Errorf("必剪ASR查询结果失败: %w", err)
+	}
 
-			// 过滤掉非视频音频文件
-			if fileType == "other" {
-				continue
-			}
+	// 处理结果
+	segments := b.makeSegments(result)
 
-			files = append(files, FileItem{
-				Name:    fileName,
-				Path:    filepath.Join(dir, fileName),
-				Size:    info.Size(),
-				ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
-				Type:    fileType,
-			})
+	if callback != nil {
+		callback(100, "识别完成")
+	}
+
+	// 保存缓存
+	if b.UseCache && len(segments) > 0 {
+		if err := b.SaveToCache(b.CacheDir, cacheKey, segments); err != nil {
+			Warn("[%s] 保存必剪ASR结果到缓存失败: %v", instanceID, err)
 		}
 	}
 
-	// 扫描归档目录
-	archiveStartTime := time.Now()
-	archiveDir := filepath.Join(DOWNLOAD_DIR, "archive")
-	if entries, err := os.ReadDir(archiveDir); err == nil {
-		for _, entry := range entries {
-			if entry.IsDir() {
-				// 检查是否存在 summary.json
-				summaryPath := filepath.Join(archiveDir, entry.Name(), "summary.json")
-				if _, err := os.Stat(summaryPath); err == nil {
-					// 这是一个有效的归档
-					name := entry.Name()
-					// 去除 output_ 前缀，让名字更好看
-					if strings.HasPrefix(name, "output_") {
-						name = name[7:]
-					}
-					
-					files = append(files, FileItem{
-						Name:    "📦 [归档] " + name,
-						Path:    filepath.Join(archiveDir, entry.Name()),
-						Type:    "archive",
-						ModTime: "已归档",
+	return segments, nil
+}
+
+func (b *BcutASR) upload(ctx context.Context, callback ProgressCallback) error {
+	if err := b.requestUpload(); err != nil {
+		return err
+	}
+	if err := b.uploadParts(ctx, callback); err != nil {
+		return err
+	}
+	if err := b.commitUpload(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *BcutASR) requestUpload() error {
+	payload := map[string]interface{}{
+		"type":             2,
+		"name":             "audio.mp3",
+		"size":             len(b.FileBinary),
+		"ResourceFileType": "mp3",
+		"model_id":         ModelIDUpload,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("JSON编码失败: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", API_REQ_UPLOAD, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
+	req.Header.Set("Content-Type", "application/json")
+
+	// 使用带代理的客户端
+	client := getHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取响应失败: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("解析JSON响应失败: %w", err)
+	}
+
+	data, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("响应格式错误: 缺少data字段")
+	}
+
+	if inBossKey, ok := data["in_boss_key"].(string); ok {
+		b.inBossKey = inBossKey
+	}
+
+	if resourceID, ok := data["resource_id"].(string); ok {
+		b.resourceID = resourceID
+	}
+
+	if uploadID, ok := data["upload_id"].(string); ok {
+		b.uploadID = uploadID
+	}
+
+	if perSize, ok := data["per_size"].(float64); ok {
+		b.perSize = int(perSize)
+	}
+
+	uploadURLsIface, ok := data["upload_urls"].([]interface{})
+	if !ok {
+		return fmt.Errorf("upload_urls字段缺失或类型错误")
+	}
+
+	b.uploadURLs = make([]string, len(uploadURLsIface))
+	for i, url := range uploadURLsIface {
+		if urlStr, ok := url.(string); ok {
+			b.uploadURLs[i] = urlStr
+		}
+	}
+
+	b.clips = len(b.uploadURLs)
+	Info("申请上传成功, 总计大小%dKB, %d分片, 分片大小%dKB", len(b.FileBinary)/1024, b.clips, b.perSize/1024)
+	return nil
+}
+
+// uploadParts 并发上传所有分片，任一分片最终失败时取消其余上传
+// Etag 按分片序号写入 b.etags，保证 buildEtags 顺序正确
+// 每完成一个分片按已上传字节数在 20%-50% 之间汇报进度
+func (b *BcutASR) uploadParts(ctx context.Context, callback ProgressCallback) error {
+	b.etags = make([]string, b.clips)
+	// 使用带代理的客户端；限速时单个分片可能传输很久，不设总超时，由 ctx 控制
+	client := getStreamHTTPClient()
+
+	workers := b.UploadConcurrency
+	if workers <= 0 {
+		workers = DefaultUploadConcurrency
+	}
+	if workers > b.clips {
+		workers = b.clips
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 所有并发分片共享同一个限速器
+	var limiter *uploadLimiter
+	if b.UploadRateLimit > 0 {
+		limiter = newUploadLimiter(b.UploadRateLimit)
+	}
+
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+
+	var progressMu sync.Mutex
+	uploadedBytes, doneParts := 0, 0
+	reportPart := func(i int) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		uploadedBytes += b.partSize(i)
+		doneParts++
+		if callback != nil {
+			percent := 20 + 30*uploadedBytes/len(b.FileBinary)
+			callback(percent, fmt.Sprintf("正在上传... (%d/%d)", doneParts, b.clips))
+		}
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range parts {
+				etag, err := b.uploadPartWithRetry(ctx, client, i, limiter)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
 					})
+					continue
 				}
+				b.etags[i] = etag
+				Info("分片%d上传成功: %s", i, etag)
+				reportPart(i)
 			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < b.clips; i++ {
+		select {
+		case parts <- i:
+		case <-ctx.Done():
+			break dispatch
 		}
-		Info("扫描归档目录 [%s] 完成，耗时: %v", archiveDir, time.Since(archiveStartTime))
 	}
+	close(parts)
+	wg.Wait()
 
-	Info("list-files 总计返回 %d 个文件，总耗时: %v", len(files), time.Since(startTime))
-	return files, nil
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
 }
 
-// ==================== HTTP服务 ====================
+// partRange 第 i 个分片在音频数据中的起止位置
+func (b *BcutASR) partRange(i int) (int, int) {
+	startRange := i * b.perSize
+	endRange := (i + 1) * b.perSize
+	if endRange > len(b.FileBinary) {
+		endRange = len(b.FileBinary)
+	}
+	return startRange, endRange
+}
 
-type HTTPServer struct {
-	port      string
-	aiConfig  AIConfig
+// partSize 第 i 个分片的字节数
+func (b *BcutASR) partSize(i int) int {
+	startRange, endRange := b.partRange(i)
+	return endRange - startRange
 }
 
-func NewHTTPServer(port string) *HTTPServer {
-	// 检查环境变量中的 API Key
-	config := AIConfig{}
-	if envKey := os.Getenv("ANTHROPIC_API_KEY"); envKey != "" {
-		config.APIKey = envKey
-		Info("已从环境变量加载 ANTHROPIC_API_KEY")
+// uploadPartWithRetry 上传单个分片，失败时按指数退避重试
+func (b *BcutASR) uploadPartWithRetry(ctx context.Context, client *http.Client, i int, limiter *uploadLimiter) (string, error) {
+	var etag string
+	var err error
+	for attempt := 1; attempt <= UploadPartRetries; attempt++ {
+		etag, err = b.uploadPart(ctx, client, i, limiter)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if attempt < UploadPartRetries {
+			delay := RetryBaseDelay * time.Duration(1<<(attempt-1))
+			Warn("分片%d上传失败 (第%d次)，%v后重试: %v", i, attempt, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
 	}
+	return etag, err
+}
 
-	return &HTTPServer{
-		port:     port,
-		aiConfig: config,
+// uploadPart 上传单个分片，返回 Etag
+// limiter 不为 nil 时按共享的总速率限速
+func (b *BcutASR) uploadPart(ctx context.Context, client *http.Client, i int, limiter *uploadLimiter) (string, error) {
+	startRange, endRange := b.partRange(i)
+
+	var body io.Reader = bytes.NewReader(b.FileBinary[startRange:endRange])
+	if limiter != nil {
+		body = &rateLimitedReader{ctx: ctx, reader: body, limiter: limiter}
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", b.uploadURLs[i], body)
+	if err != nil {
+		return "", fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+	req.ContentLength = int64(endRange - startRange)
+
+	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("分片%d上传失败: HTTP %d", i, resp.StatusCode)
 	}
+
+	etag := resp.Header.Get("Etag")
+	if etag == "" {
+		body, _ := io.ReadAll(resp.Body)
+		var result map[string]interface{}
+		if json.Unmarshal(body, &result) == nil {
+			if etagVal, ok := result["etag"].(string); ok {
+				etag = etagVal
+			}
+		}
+	}
+
+	if etag == "" {
+		return "", fmt.Errorf("分片%d上传失败: 未获取到Etag", i)
+	}
+	return etag, nil
 }
 
-func (s *HTTPServer) Start() {
-	// API路由
-	http.HandleFunc("/api/list-files", s.handleListFiles)
-	http.HandleFunc("/api/process-video", s.handleProcessVideo)
-	http.HandleFunc("/api/delete-output", s.handleDeleteOutput)
-	http.HandleFunc("/api/get-archive", s.handleGetArchive) // 新增：获取归档内容
-	http.HandleFunc("/api/ai-summarize", s.handleAISummarize)
-	http.HandleFunc("/api/ai-chat", s.handleAIChat)
-	http.HandleFunc("/api/config", s.handleConfig)
-	http.HandleFunc("/api/health", s.handleHealth)
+// uploadLimiter 多个并发分片共享的上传限速，按累计发送的字节数控制总速率
+type uploadLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	start          time.Time
+	total          int64
+}
 
-	// 静态文件服务 (前端页面)
-	http.Handle("/", http.FileServer(http.Dir("./static")))
+func newUploadLimiter(bytesPerSecond int64) *uploadLimiter {
+	return &uploadLimiter{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
 
-	// 文件下载服务 (用于展示图片和下载结果)
-	// 映射 /files/ -> D:/download/
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(DOWNLOAD_DIR))))
+// wait 登记发送了 n 字节，超出速率时等待到应有的时间点
+func (l *uploadLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.total += int64(n)
+	expected := time.Duration(float64(l.total) / float64(l.bytesPerSecond) * float64(time.Second))
+	wait := expected - time.Since(l.start)
+	l.mu.Unlock()
 
-	Info("HTTP服务启动在端口: %s", s.port)
-	// localhost访问
-	Info("访问地址: http://localhost:%s/", s.port)
-	Info("静态文件目录: ./static")
-	Info("下载目录: %s (映射到 /files/)", DOWNLOAD_DIR)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	err := http.ListenAndServe(":"+s.port, nil)
-	if err != nil {
-		Error("HTTP服务启动失败: %v", err)
+// rateLimitedReader 通过共享的 uploadLimiter 限速读取，用于上传限速
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *uploadLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// 每次最多读取约 100ms 的数据量，让发送更平滑
+	if limit := r.limiter.bytesPerSecond / 10; limit > 0 && int64(len(p)) > limit {
+		p = p[:limit]
+	}
+	n, err := r.reader.Read(p)
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+		return n, waitErr
 	}
+	return n, err
 }
 
-// handleListFiles 列出下载目录文件
-func (s *HTTPServer) handleListFiles(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+func (b *BcutASR) commitUpload() error {
+	payload := map[string]interface{}{
+		"InBossKey":  b.inBossKey,
+		"ResourceId": b.resourceID,
+		"Etags":      b.buildEtags(),
+		"UploadId":   b.uploadID,
+		"model_id":   ModelIDUpload,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("JSON编码失败: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", API_COMMIT_UPLOAD, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
+	req.Header.Set("Content-Type", "application/json")
+
+	// 使用带代理的客户端
+	client := getHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取响应失败: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("解析JSON响应失败: %w", err)
+	}
+
+	data, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("响应格式错误")
+	}
+
+	if downloadURL, ok := data["download_url"].(string); ok {
+		b.downloadURL = downloadURL
+	}
+
+	Info("提交成功，获取下载URL: %s", b.downloadURL)
+	return nil
+}
+
+func (b *BcutASR) buildEtags() string {
+	etagsStr := ""
+	for i, etag := range b.etags {
+		if i > 0 {
+			etagsStr += ","
+		}
+		etagsStr += etag
+	}
+	return etagsStr
+}
+
+func (b *BcutASR) createTask() error {
+	payload := map[string]interface{}{
+		"resource": b.downloadURL,
+		"model_id": ModelIDUpload,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("JSON编码失败: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", API_CREATE_TASK, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
+	req.Header.Set("Content-Type", "application/json")
+
+	// 使用带代理的客户端
+	client := getHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取响应失败: %w", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("解析JSON响应失败: %w", err)
+	}
+
+	data, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("响应格式错误")
+	}
+
+	if taskID, ok := data["task_id"].(string); ok {
+		b.taskID = taskID
+	}
+
+	Info("任务已创建: %s", b.taskID)
+	return nil
+}
+
+func (b *BcutASR) queryResult(ctx context.Context, callback ProgressCallback) (map[string]interface{}, error) {
+	// 使用带代理的客户端
+	client := getHTTPClient()
+	instanceID := GenerateRandomString(6)
+
+	Info("[BcutASR-%s] 开始轮询查询任务: %s", instanceID, b.taskID)
+
+	for i := 0; i < MaxRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		url := fmt.Sprintf("%s?model_id=%s&task_id=%s", API_QUERY_RESULT, ModelIDQuery, b.taskID)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
+		}
+
+		req.Header.Set("User-Agent", "Bilibili/1.0.0 (https://www.bilibili.com)")
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			Warn("[BcutASR-%s] 第 %d 次查询请求失败: %v，将重试", instanceID, i, err)
+			time.Sleep(RetryBaseDelay)
+			continue
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			Warn("[BcutASR-%s] 第 %d 次查询读取响应失败: %v，将重试", instanceID, i, err)
+			time.Sleep(RetryBaseDelay)
+			continue
+		}
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(body, &result); err != nil {
+			Warn("[BcutASR-%s] 第 %d 次查询JSON解析失败: %v，将重试", instanceID, i, err)
+			time.Sleep(RetryBaseDelay)
+			continue
+		}
+
+		data, ok := result["data"].(map[string]interface{})
+		if !ok {
+			Warn("[BcutASR-%s] 第 %d 次查询响应格式错误，将重试", instanceID, i)
+			time.Sleep(RetryBaseDelay)
+			continue
+		}
+
+		state, ok := data["state"].(float64)
+		if !ok {
+			Warn("[BcutASR-%s] 第 %d 次查询状态字段缺失，将重试", instanceID, i)
+			time.Sleep(RetryBaseDelay)
+			continue
+		}
+
+		if state == 4 {
+			resultStr, ok := data["result"].(string)
+			if !ok || resultStr == "" {
+				return nil, fmt.Errorf("任务完成但结果为空")
+			}
+
+			var resultData map[string]interface{}
+			if err := json.Unmarshal([]byte(resultStr), &resultData); err != nil {
+				return nil, fmt.Errorf("解析结果失败: %w", err)
+			}
+			return resultData, nil
+		} else if state == 3 {
+			return nil, fmt.Errorf("任务处理失败，状态: %v", state)
+		}
+
+		if callback != nil && i%5 == 0 {
+			progress := 60 + int(float64(i)/float64(MaxRetries)*39)
+			if progress > 99 {
+				progress = 99
+			}
+			callback(progress, fmt.Sprintf("处理中 %d%%...", progress))
+		}
+
+		sleepDuration := RetryBaseDelay
+		if i > 20 {
+			sleepDuration = RetryBaseDelay * 2
+		}
+		if i > 50 {
+			sleepDuration = RetryLongDelay
+		}
+		time.Sleep(sleepDuration)
+	}
+
+	return nil, fmt.Errorf("任务超时未完成")
+}
+
+func (b *BcutASR) makeSegments(result map[string]interface{}) []DataSegment {
+	segments := []DataSegment{}
+
+	utterances, ok := result["utterances"].([]interface{})
+	if !ok {
+		Warn("解析B站ASR结果失败: 未找到utterances数组")
+		return segments
+	}
+
+	for _, u := range utterances {
+		utterance, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		text, _ := utterance["transcript"].(string)
+		startTimeRaw, _ := utterance["start_time"].(float64)
+		endTimeRaw, _ := utterance["end_time"].(float64)
+
+		startTime := math.Max(0, startTimeRaw/1000.0+b.TimeOffset)
+		endTime := math.Max(0, endTimeRaw/1000.0+b.TimeOffset)
+
+		segments = append(segments, DataSegment{
+			Text:       text,
+			StartTime:  startTime,
+			EndTime:    endTime,
+			Confidence: utteranceConfidence(utterance),
+		})
+	}
+
+	return segments
+}
+
+// utteranceConfidence 取整句的 confidence，没有时用逐字 confidence 的平均值，都没有时返回 0
+func utteranceConfidence(utterance map[string]interface{}) float64 {
+	if confidence, ok := utterance["confidence"].(float64); ok {
+		return confidence
+	}
+
+	words, _ := utterance["words"].([]interface{})
+	total, count := 0.0, 0
+	for _, w := range words {
+		word, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if confidence, ok := word["confidence"].(float64); ok {
+			total += confidence
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// WhisperConfig 本地 whisper.cpp 配置 (来自环境变量 WHISPER_BIN / WHISPER_MODEL / WHISPER_LANGUAGE)
+type WhisperConfig struct {
+	BinPath  string // 可执行文件，默认 whisper-cli
+	Model    string // 模型文件路径，如 ./models/ggml-base.bin
+	Language string // 识别语言，默认 auto
+}
+
+func loadWhisperConfigFromEnv() WhisperConfig {
+	config := WhisperConfig{
+		BinPath:  os.Getenv("WHISPER_BIN"),
+		Model:    os.Getenv("WHISPER_MODEL"),
+		Language: os.Getenv("WHISPER_LANGUAGE"),
+	}
+	if config.BinPath == "" {
+		config.BinPath = "whisper-cli"
+	}
+	if config.Model == "" {
+		config.Model = "./models/ggml-base.bin"
+	}
+	if config.Language == "" {
+		config.Language = "auto"
+	}
+	return config
+}
+
+// WhisperASR 本地 whisper.cpp 识别，离线可用
+type WhisperASR struct {
+	*BaseASR
+	config WhisperConfig
+}
+
+func NewWhisperASR(audioPath string, useCache bool) (*WhisperASR, error) {
+	config := loadWhisperConfigFromEnv()
+
+	// 检查whisper是否存在
+	binPath, err := exec.LookPath(config.BinPath)
+	if err != nil {
+		return nil, fmt.Errorf("未找到whisper，请确保已安装并添加到PATH或设置WHISPER_BIN: %v", err)
+	}
+	config.BinPath = binPath
+	if _, err := os.Stat(config.Model); err != nil {
+		return nil, fmt.Errorf("未找到whisper模型，请设置WHISPER_MODEL: %v", err)
+	}
+
+	baseASR, err := NewBaseASR(audioPath, useCache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WhisperASR{
+		BaseASR: baseASR,
+		config:  config,
+	}, nil
+}
+
+// SetLanguage 设置识别语言 (如 zh、en、ja)
+func (w *WhisperASR) SetLanguage(language string) {
+	w.config.Language = language
+}
+
+// whisperProgressPattern whisper.cpp 开启 -pp 后输出的进度行
+var whisperProgressPattern = regexp.MustCompile(`progress\s*=\s*(\d+)%`)
+
+func (w *WhisperASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
+	Info("WhisperASR 开始处理音频: %s", w.AudioPath)
+
+	// 检查缓存 (不同模型的结果分开缓存)
+	cacheKey := w.GetCacheKey("WhisperASR_" + strings.TrimSuffix(filepath.Base(w.config.Model), filepath.Ext(w.config.Model)))
+	if w.UseCache {
+		if segments, ok := w.LoadFromCache(w.CacheDir, cacheKey); ok {
+			Info("从缓存加载Whisper识别结果")
+			if callback != nil {
+				callback(100, "识别完成 (缓存)")
+			}
+			return segments, nil
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "whisper_")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// whisper.cpp 只接受 16kHz wav
+	if callback != nil {
+		callback(5, "转换音频...")
+	}
+	wavPath := filepath.Join(tempDir, "audio.wav")
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", w.AudioPath, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", "-y", wavPath)
+	done := trackFFmpeg()
+	err = cmd.Run()
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("转换音频失败: %v", err)
+	}
+
+	if callback != nil {
+		callback(10, "正在识别...")
+	}
+	outputPrefix := filepath.Join(tempDir, "result")
+	cmd = exec.CommandContext(ctx, w.config.BinPath,
+		"-m", w.config.Model,
+		"-f", wavPath,
+		"-l", w.config.Language,
+		"-oj", "-of", outputPrefix,
+		"-pp",
+	)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("启动whisper失败: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动whisper失败: %w", err)
+	}
+
+	// 识别进度映射到 10%-95%
+	var lastLines []string
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := whisperProgressPattern.FindStringSubmatch(line); match != nil {
+			if percent, err := strconv.Atoi(match[1]); err == nil && callback != nil {
+				callback(10+percent*85/100, "正在识别...")
+			}
+			continue
+		}
+		// 保留最后几行输出用于报错
+		lastLines = append(lastLines, line)
+		if len(lastLines) > 5 {
+			lastLines = lastLines[1:]
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("whisper识别失败: %v %s", err, strings.Join(lastLines, "; "))
+	}
+
+	data, err := os.ReadFile(outputPrefix + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("读取whisper结果失败: %w", err)
+	}
+	segments, err := parseWhisperJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if callback != nil {
+		callback(100, "识别完成")
+	}
+
+	if w.UseCache && len(segments) > 0 {
+		if err := w.SaveToCache(w.CacheDir, cacheKey, segments); err != nil {
+			Warn("保存Whisper识别结果到缓存失败: %v", err)
+		}
+	}
+
+	return segments, nil
+}
+
+// whisperLanguagePattern whisper.cpp 语言检测输出，如 "auto-detected language: en (p = 0.97)"
+var whisperLanguagePattern = regexp.MustCompile(`auto-detected language:\s*(\w+)`)
+
+// detectAudioLanguage 取音频开头 30 秒用 whisper.cpp 做一次快速语言检测
+func detectAudioLanguage(ctx context.Context, audioPath string) (string, error) {
+	config := loadWhisperConfigFromEnv()
+	binPath, err := exec.LookPath(config.BinPath)
+	if err != nil {
+		return "", fmt.Errorf("未找到whisper，无法检测语言: %v", err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "whisper_lang_")
+	if err != nil {
+		return "", fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wavPath := filepath.Join(tempDir, "sample.wav")
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", audioPath, "-t", "30", "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", "-y", wavPath)
+	done := trackFFmpeg()
+	err = cmd.Run()
+	done()
+	if err != nil {
+		return "", fmt.Errorf("截取音频失败: %v", err)
+	}
+
+	output, err := exec.CommandContext(ctx, binPath, "-m", config.Model, "-f", wavPath, "-l", "auto", "-dl").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("whisper语言检测失败: %v", err)
+	}
+	match := whisperLanguagePattern.FindSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("whisper语言检测无结果")
+	}
+	return string(match[1]), nil
+}
+
+// resolveASRLanguage language 为 auto 时先检测音频语言
+// 未指定服务时据此选择：中文/英文用必剪，其他语言用本地 whisper；检测失败时保持原设置
+func resolveASRLanguage(ctx context.Context, provider, language, audioPath string) (string, string) {
+	if language == "auto" {
+		detected, err := detectAudioLanguage(ctx, audioPath)
+		if err != nil {
+			Warn("自动检测语言失败，使用默认ASR服务: %v", err)
+		} else {
+			Info("检测到音频语言: %s", detected)
+			language = detected
+			if provider == "" && detected != "zh" && detected != "en" {
+				provider = "whisper"
+			}
+		}
+	}
+	if provider == "" {
+		provider = DefaultASRProvider
+	}
+	return provider, language
+}
+
+// parseWhisperJSON 解析 whisper.cpp -oj 输出，offsets 单位为毫秒
+func parseWhisperJSON(data []byte) ([]DataSegment, error) {
+	var result struct {
+		Transcription []struct {
+			Offsets struct {
+				From float64 `json:"from"`
+				To   float64 `json:"to"`
+			} `json:"offsets"`
+			Text string `json:"text"`
+		} `json:"transcription"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("解析whisper结果失败: %w", err)
+	}
+
+	segments := []DataSegment{}
+	for _, item := range result.Transcription {
+		text := strings.TrimSpace(item.Text)
+		if text == "" {
+			continue
+		}
+		segments = append(segments, DataSegment{
+			Text:      text,
+			StartTime: item.Offsets.From / 1000.0,
+			EndTime:   item.Offsets.To / 1000.0,
+		})
+	}
+	return segments, nil
+}
+
+// FunASRConfig 本地部署的 FunASR HTTP 服务配置 (来自环境变量 FUNASR_URL / FUNASR_TIMEOUT)
+type FunASRConfig struct {
+	URL     string        // 识别接口地址，默认 http://127.0.0.1:8000/recognition
+	Timeout time.Duration // 单次识别超时，默认 30 分钟
+}
+
+func loadFunASRConfigFromEnv() FunASRConfig {
+	config := FunASRConfig{
+		URL:     envOrDefault("FUNASR_URL", "http://127.0.0.1:8000/recognition"),
+		Timeout: 30 * time.Minute,
+	}
+	if value := os.Getenv("FUNASR_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			config.Timeout = timeout
+		} else {
+			Warn("FUNASR_TIMEOUT 格式无效 (%s)，使用默认值", value)
+		}
+	}
+	return config
+}
+
+// FunASR 本地部署的 FunASR (Paraformer) 中文识别服务，通过其 HTTP 接口上传音频
+type FunASR struct {
+	*BaseASR
+	config FunASRConfig
+}
+
+func NewFunASR(audioPath string, useCache bool) (*FunASR, error) {
+	baseASR, err := NewBaseASR(audioPath, useCache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FunASR{
+		BaseASR: baseASR,
+		config:  loadFunASRConfigFromEnv(),
+	}, nil
+}
+
+func (f *FunASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
+	Info("FunASR 开始处理音频: %s", f.AudioPath)
+
+	cacheKey := f.GetCacheKey("FunASR")
+	if f.UseCache {
+		if segments, ok := f.LoadFromCache(f.CacheDir, cacheKey); ok {
+			Info("从缓存加载FunASR识别结果")
+			if callback != nil {
+				callback(100, "识别完成 (缓存)")
+			}
+			return segments, nil
+		}
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("audio", filepath.Base(f.AudioPath))
+	if err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+	if _, err := part.Write(f.FileBinary); err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.config.URL, &body)
+	if err != nil {
+		return nil, fmt.Errorf("创建FunASR请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	if callback != nil {
+		callback(10, "正在识别...")
+	}
+	resp, err := getLongHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求FunASR服务失败 (%s): %w", f.config.URL, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取FunASR响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FunASR服务返回错误: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	segments, err := parseFunASRResult(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if callback != nil {
+		callback(100, "识别完成")
+	}
+
+	if f.UseCache && len(segments) > 0 {
+		if err := f.SaveToCache(f.CacheDir, cacheKey, segments); err != nil {
+			Warn("保存FunASR识别结果到缓存失败: %v", err)
+		}
+	}
+
+	return segments, nil
+}
+
+// parseFunASRResult 解析 FunASR HTTP 服务的返回，sentences 中的 start/end 单位为毫秒
+// 服务端未加载标点/时间戳模型时只有整段文本，无法生成字幕，返回错误
+func parseFunASRResult(data []byte) ([]DataSegment, error) {
+	var result struct {
+		Code      int    `json:"code"`
+		Msg       string `json:"msg"`
+		Text      string `json:"text"`
+		Sentences []struct {
+			Text  string  `json:"text"`
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+		} `json:"sentences"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("解析FunASR结果失败: %w", err)
+	}
+	if result.Code != 0 {
+		return nil, fmt.Errorf("FunASR识别失败: code=%d %s", result.Code, result.Msg)
+	}
+
+	segments := []DataSegment{}
+	for _, sentence := range result.Sentences {
+		text := strings.TrimSpace(sentence.Text)
+		if text == "" {
+			continue
+		}
+		segments = append(segments, DataSegment{
+			Text:      text,
+			StartTime: sentence.Start / 1000.0,
+			EndTime:   sentence.End / 1000.0,
+		})
+	}
+	if len(segments) == 0 && strings.TrimSpace(result.Text) != "" {
+		return nil, fmt.Errorf("FunASR未返回句级时间戳，请在服务端启用时间戳和标点模型")
+	}
+	return segments, nil
+}
+
+// asrLocale 把 zh、en 等语言代码转换为云服务要求的区域代码，已带区域 (如 zh-TW) 时原样返回
+func asrLocale(language string) string {
+	switch strings.ToLower(language) {
+	case "zh":
+		return "zh-CN"
+	case "en":
+		return "en-US"
+	case "ja":
+		return "ja-JP"
+	case "ko":
+		return "ko-KR"
+	}
+	return language
+}
+
+// cloudASRTimeout 云端识别单次请求 (含上传和轮询) 的超时
+const cloudASRTimeout = 30 * time.Minute
+
+// AzureASRConfig Azure 语音服务配置 (来自环境变量 AZURE_SPEECH_KEY / AZURE_SPEECH_REGION / AZURE_SPEECH_LOCALE)
+type AzureASRConfig struct {
+	Key    string
+	Region string // 资源所在区域，如 eastasia
+	Locale string // 识别语言，默认 zh-CN
+}
+
+func loadAzureASRConfigFromEnv() AzureASRConfig {
+	config := AzureASRConfig{
+		Key:    os.Getenv("AZURE_SPEECH_KEY"),
+		Region: os.Getenv("AZURE_SPEECH_REGION"),
+		Locale: os.Getenv("AZURE_SPEECH_LOCALE"),
+	}
+	if config.Locale == "" {
+		config.Locale = "zh-CN"
+	}
+	return config
+}
+
+// AzureASR Azure 语音服务的快速转写 (Fast Transcription) REST 接口，直接上传音频并同步返回结果，支持 2 小时以内的长音频
+type AzureASR struct {
+	*BaseASR
+	config AzureASRConfig
+}
+
+func NewAzureASR(audioPath string, useCache bool) (*AzureASR, error) {
+	config := loadAzureASRConfigFromEnv()
+	if config.Key == "" || config.Region == "" {
+		return nil, fmt.Errorf("未配置Azure语音服务，请设置AZURE_SPEECH_KEY和AZURE_SPEECH_REGION")
+	}
+
+	baseASR, err := NewBaseASR(audioPath, useCache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureASR{
+		BaseASR: baseASR,
+		config:  config,
+	}, nil
+}
+
+// SetLanguage 设置识别语言 (如 zh、en 或 zh-CN)
+func (a *AzureASR) SetLanguage(language string) {
+	if language != "" && language != "auto" {
+		a.config.Locale = asrLocale(language)
+	}
+}
+
+func (a *AzureASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
+	Info("AzureASR 开始处理音频: %s", a.AudioPath)
+
+	cacheKey := a.GetCacheKey("AzureASR_" + a.config.Locale)
+	if a.UseCache {
+		if segments, ok := a.LoadFromCache(a.CacheDir, cacheKey); ok {
+			Info("从缓存加载Azure识别结果")
+			if callback != nil {
+				callback(100, "识别完成 (缓存)")
+			}
+			return segments, nil
+		}
+	}
+
+	definition, _ := json.Marshal(map[string]interface{}{"locales": []string{a.config.Locale}})
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("audio", filepath.Base(a.AudioPath))
+	if err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+	if _, err := part.Write(a.FileBinary); err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+	if err := writer.WriteField("definition", string(definition)); err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("构建上传请求失败: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cloudASRTimeout)
+	defer cancel()
+	endpoint := fmt.Sprintf("https://%s.api.cognitive.microsoft.com/speechtotext/transcriptions:transcribe?api-version=2024-11-15", a.config.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return nil, fmt.Errorf("创建Azure请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Ocp-Apim-Subscription-Key", a.config.Key)
+
+	if callback != nil {
+		callback(10, "正在上传并识别...")
+	}
+	resp, err := getLongHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求Azure语音服务失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取Azure响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Azure语音服务返回错误: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	segments, err := parseAzureASRResult(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if callback != nil {
+		callback(100, "识别完成")
+	}
+
+	if a.UseCache && len(segments) > 0 {
+		if err := a.SaveToCache(a.CacheDir, cacheKey, segments); err != nil {
+			Warn("保存Azure识别结果到缓存失败: %v", err)
+		}
+	}
+
+	return segments, nil
+}
+
+// parseAzureASRResult 解析快速转写的返回，phrases 中的 offsetMilliseconds/durationMilliseconds 单位为毫秒
+func parseAzureASRResult(data []byte) ([]DataSegment, error) {
+	var result struct {
+		Phrases []struct {
+			Text       string  `json:"text"`
+			Offset     float64 `json:"offsetMilliseconds"`
+			Duration   float64 `json:"durationMilliseconds"`
+			Confidence float64 `json:"confidence"`
+		} `json:"phrases"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("解析Azure结果失败: %w", err)
+	}
+
+	segments := []DataSegment{}
+	for _, phrase := range result.Phrases {
+		text := strings.TrimSpace(phrase.Text)
+		if text == "" {
+			continue
+		}
+		segments = append(segments, DataSegment{
+			Text:       text,
+			StartTime:  phrase.Offset / 1000.0,
+			EndTime:    (phrase.Offset + phrase.Duration) / 1000.0,
+			Confidence: phrase.Confidence,
+		})
+	}
+	return segments, nil
+}
+
+// Google 语音识别接口，v1p1beta1 支持直接上传 MP3
+const (
+	googleSpeechEndpoint   = "https://speech.googleapis.com/v1p1beta1"
+	googleInlineAudioLimit = 10 * 1024 * 1024 // 直接上传 (content 字段) 的音频大小上限
+)
+
+// GoogleASRConfig Google 语音识别配置 (来自环境变量 GOOGLE_SPEECH_API_KEY / GOOGLE_SPEECH_LANGUAGE)
+type GoogleASRConfig struct {
+	APIKey   string
+	Language string // 识别语言，默认 zh-CN
+}
+
+func loadGoogleASRConfigFromEnv() GoogleASRConfig {
+	config := GoogleASRConfig{
+		APIKey:   os.Getenv("GOOGLE_SPEECH_API_KEY"),
+		Language: os.Getenv("GOOGLE_SPEECH_LANGUAGE"),
+	}
+	if config.Language == "" {
+		config.Language = "zh-CN"
+	}
+	return config
+}
+
+// GoogleASR Google Speech-to-Text 长音频异步识别 (longrunningrecognize)，提交后轮询 operation 直到完成
+type GoogleASR struct {
+	*BaseASR
+	config GoogleASRConfig
+}
+
+func NewGoogleASR(audioPath string, useCache bool) (*GoogleASR, error) {
+	config := loadGoogleASRConfigFromEnv()
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("未配置Google语音识别，请设置GOOGLE_SPEECH_API_KEY")
+	}
+
+	baseASR, err := NewBaseASR(audioPath, useCache)
+	if err != nil {
+		return nil, err
+	}
+	if len(baseASR.FileBinary) > googleInlineAudioLimit {
+		return nil, fmt.Errorf("音频超过 %dMB，Google语音识别无法直接上传", googleInlineAudioLimit/1024/1024)
+	}
+
+	return &GoogleASR{
+		BaseASR: baseASR,
+		config:  config,
+	}, nil
+}
+
+// SetLanguage 设置识别语言 (如 zh、en 或 zh-CN)
+func (g *GoogleASR) SetLanguage(language string) {
+	if language != "" && language != "auto" {
+		g.config.Language = asrLocale(language)
+	}
+}
+
+func (g *GoogleASR) GetResult(ctx context.Context, callback ProgressCallback) ([]DataSegment, error) {
+	Info("GoogleASR 开始处理音频: %s", g.AudioPath)
+
+	cacheKey := g.GetCacheKey("GoogleASR_" + g.config.Language)
+	if g.UseCache {
+		if segments, ok := g.LoadFromCache(g.CacheDir, cacheKey); ok {
+			Info("从缓存加载Google识别结果")
+			if callback != nil {
+				callback(100, "识别完成 (缓存)")
+			}
+			return segments, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cloudASRTimeout)
+	defer cancel()
+
+	// 音频由 ExtractAudio 统一转为 16kHz MP3
+	var operation struct {
+		Name string `json:"name"`
+	}
+	err := g.call(ctx, http.MethodPost, "/speech:longrunningrecognize", map[string]interface{}{
+		"config": map[string]interface{}{
+			"encoding":                   "MP3",
+			"sampleRateHertz":            16000,
+			"languageCode":               g.config.Language,
+			"enableAutomaticPunctuation": true,
+			"enableWordTimeOffsets":      true,
+		},
+		"audio": map[string]interface{}{
+			"content": base64.StdEncoding.EncodeToString(g.FileBinary),
+		},
+	}, &operation)
+	if err != nil {
+		return nil, err
+	}
+	if operation.Name == "" {
+		return nil, fmt.Errorf("Google语音识别未返回任务ID")
+	}
+	if callback != nil {
+		callback(10, "已提交识别任务...")
+	}
+
+	for {
+		var status struct {
+			Done     bool `json:"done"`
+			Metadata struct {
+				ProgressPercent int `json:"progressPercent"`
+			} `json:"metadata"`
+			Error *struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+			Response json.RawMessage `json:"response"`
+		}
+		if err := g.call(ctx, http.MethodGet, "/operations/"+operation.Name, nil, &status); err != nil {
+			return nil, err
+		}
+		if status.Error != nil {
+			return nil, fmt.Errorf("Google语音识别失败: code=%d %s", status.Error.Code, status.Error.Message)
+		}
+		if status.Done {
+			segments, err := parseGoogleASRResult(status.Response)
+			if err != nil {
+				return nil, err
+			}
+			if callback != nil {
+				callback(100, "识别完成")
+			}
+			if g.UseCache && len(segments) > 0 {
+				if err := g.SaveToCache(g.CacheDir, cacheKey, segments); err != nil {
+					Warn("保存Google识别结果到缓存失败: %v", err)
+				}
+			}
+			return segments, nil
+		}
+
+		if callback != nil {
+			callback(10+status.Metadata.ProgressPercent*89/100, fmt.Sprintf("处理中 %d%%...", status.Metadata.ProgressPercent))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(RetryLongDelay):
+		}
+	}
+}
+
+// call 调用 Google 语音识别接口，payload 为 nil 时不发送请求体
+func (g *GoogleASR) call(ctx context.Context, method, path string, payload interface{}, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("构建请求失败: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, googleSpeechEndpoint+path+"?key="+url.QueryEscape(g.config.APIKey), body)
+	if err != nil {
+		return fmt.Errorf("创建Google请求失败: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := getLongHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("请求Google语音识别失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取Google响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Google语音识别返回错误: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("解析Google响应失败: %w", err)
+	}
+	return nil
+}
+
+// parseGoogleASRResult 解析识别结果，时间为 "1.500s" 形式的字符串
+// 每个 result 取第一个候选，开始/结束时间取首尾词的时间，没有词级时间时用上一条的结束和 resultEndTime
+func parseGoogleASRResult(data []byte) ([]DataSegment, error) {
+	var result struct {
+		Results []struct {
+			Alternatives []struct {
+				Transcript string  `json:"transcript"`
+				Confidence float64 `json:"confidence"`
+				Words      []struct {
+					StartTime string `json:"startTime"`
+					EndTime   string `json:"endTime"`
+				} `json:"words"`
+			} `json:"alternatives"`
+			ResultEndTime string `json:"resultEndTime"`
+		} `json:"results"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("解析Google结果失败: %w", err)
+		}
+	}
+
+	segments := []DataSegment{}
+	lastEnd := 0.0
+	for _, r := range result.Results {
+		if len(r.Alternatives) == 0 {
+			continue
+		}
+		alternative := r.Alternatives[0]
+		text := strings.TrimSpace(alternative.Transcript)
+		if text == "" {
+			continue
+		}
+
+		start, end := lastEnd, googleSeconds(r.ResultEndTime)
+		if words := alternative.Words; len(words) > 0 {
+			start = googleSeconds(words[0].StartTime)
+			end = googleSeconds(words[len(words)-1].EndTime)
+		}
+		if end < start {
+			end = start
+		}
+		segments = append(segments, DataSegment{
+			Text:       text,
+			StartTime:  start,
+			EndTime:    end,
+			Confidence: alternative.Confidence,
+		})
+		lastEnd = end
+	}
+	return segments, nil
+}
+
+// googleSeconds 解析 Google 接口的时长字符串 (如 "1.500s")，无法解析时返回 0
+func googleSeconds(value string) float64 {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return duration.Seconds()
+}
+
+// ==================== SRT生成 ====================
+
+// formatCueTime 格式化字幕时间 HH:MM:SS<sep>mmm，SRT 用 ","，WebVTT 用 "."
+func formatCueTime(seconds float64, msSeparator string) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	totalMs := int64(math.Round(seconds * 1000))
+	h := totalMs / 3600000
+	m := totalMs % 3600000 / 60000
+	s := totalMs % 60000 / 1000
+	ms := totalMs % 1000
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, msSeparator, ms)
+}
+
+func formatSRTTime(seconds float64) string {
+	return formatCueTime(seconds, ",")
+}
+
+func formatVTTTime(seconds float64) string {
+	return formatCueTime(seconds, ".")
+}
+
+// cueTimes 返回片段的起止时间，结束时间早于开始时间时钳制为开始时间
+func cueTimes(segment DataSegment) (float64, float64) {
+	start := math.Max(segment.StartTime, 0)
+	end := math.Max(segment.EndTime, start)
+	return start, end
+}
+
+func generateSRT(segments []DataSegment) string {
+	var srtBuffer bytes.Buffer
+
+	for i, segment := range segments {
+		start, end := cueTimes(segment)
+		srtBuffer.WriteString(fmt.Sprintf("%d\n", i+1))
+		srtBuffer.WriteString(fmt.Sprintf("%s --> %s\n",
+			formatSRTTime(start),
+			formatSRTTime(end)))
+		if segment.Speaker != "" {
+			srtBuffer.WriteString(segment.Speaker + "：")
+		}
+		srtBuffer.WriteString(fmt.Sprintf("%s\n\n", segment.Text))
+	}
+
+	return srtBuffer.String()
+}
+
+// generateBilingualSRT 生成双语字幕：每条字幕第一行为原文、第二行为译文，共用原文的时间轴
+// 两组片段必须一一对应 (数量相同)
+func generateBilingualSRT(original, translated []DataSegment) (string, error) {
+	if len(original) != len(translated) {
+		return "", fmt.Errorf("原文和译文的字幕条数不一致 (%d / %d)，无法生成双语字幕", len(original), len(translated))
+	}
+
+	var srtBuffer bytes.Buffer
+	for i, segment := range original {
+		start, end := cueTimes(segment)
+		srtBuffer.WriteString(fmt.Sprintf("%d\n", i+1))
+		srtBuffer.WriteString(fmt.Sprintf("%s --> %s\n",
+			formatSRTTime(start),
+			formatSRTTime(end)))
+		if segment.Speaker != "" {
+			srtBuffer.WriteString(segment.Speaker + "：")
+		}
+		srtBuffer.WriteString(strings.TrimSpace(segment.Text) + "\n")
+		srtBuffer.WriteString(fmt.Sprintf("%s\n\n", strings.TrimSpace(translated[i].Text)))
+	}
+
+	return srtBuffer.String(), nil
+}
+
+// vttTextEscaper 转义 WebVTT 字幕文本中的 &、<、>，避免被当作标签或字符引用
+var vttTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// generateVTT 生成 WebVTT 字幕 (用于 HTML5 <track>)，withCueIDs 时为每条字幕输出序号标识
+func generateVTT(segments []DataSegment, withCueIDs bool) string {
+	var vttBuffer bytes.Buffer
+	vttBuffer.WriteString("WEBVTT\n\n")
+
+	for i, segment := range segments {
+		start, end := cueTimes(segment)
+		if withCueIDs {
+			vttBuffer.WriteString(fmt.Sprintf("%d\n", i+1))
+		}
+		vttBuffer.WriteString(fmt.Sprintf("%s --> %s\n",
+			formatVTTTime(start),
+			formatVTTTime(end)))
+		if segment.Speaker != "" {
+			// WebVTT 的说话人标签
+			vttBuffer.WriteString("<v " + vttTextEscaper.Replace(segment.Speaker) + ">")
+		}
+		vttBuffer.WriteString(fmt.Sprintf("%s\n\n", vttTextEscaper.Replace(segment.Text)))
+	}
+
+	return vttBuffer.String()
+}
+
+// generatePlainText 生成不带时间戳的纯文本稿
+// paragraphGap > 0 时，相邻片段间隔超过该秒数才分段，否则每个片段一行
+func generatePlainText(segments []DataSegment, paragraphGap float64) string {
+	var textBuffer bytes.Buffer
+	var lastEnd float64
+	first := true
+
+	for _, segment := range segments {
+		text := strings.TrimSpace(segment.Text)
+		if text == "" {
+			continue
+		}
+
+		if !first {
+			if paragraphGap <= 0 {
+				textBuffer.WriteString("\n")
+			} else if segment.StartTime-lastEnd > paragraphGap {
+				textBuffer.WriteString("\n\n")
+			} else {
+				textBuffer.WriteString(" ")
+			}
+		}
+		textBuffer.WriteString(text)
+		lastEnd = segment.EndTime
+		first = false
+	}
+
+	if first {
+		return ""
+	}
+	return textBuffer.String() + "\n"
+}
+
+// SegmentIssue 字幕片段检查问题
+type SegmentIssue struct {
+	Index    int     `json:"index"`
+	Type     string  `json:"type"` // too_short / too_long / low_confidence
+	Duration float64 `json:"duration"`
+	Text     string  `json:"text"`
+}
+
+// ValidateOptions 字幕检查阈值 (秒)，未设置时使用 1-7 秒的常见规范
+type ValidateOptions struct {
+	MinDuration float64 `json:"min_duration"`
+	MaxDuration float64 `json:"max_duration"`
+}
+
+// ValidateSegments 检查单条字幕时长是否在建议范围内
+func ValidateSegments(segments []DataSegment, opts ValidateOptions) []SegmentIssue {
+	if opts.MinDuration <= 0 {
+		opts.MinDuration = 1
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = 7
+	}
+
+	var issues []SegmentIssue
+	for i, segment := range segments {
+		start, end := cueTimes(segment)
+		duration := end - start
+
+		issueType := ""
+		if duration < opts.MinDuration {
+			issueType = "too_short"
+		} else if duration > opts.MaxDuration {
+			issueType = "too_long"
+		}
+		if issueType != "" {
+			issues = append(issues, SegmentIssue{
+				Index:    i,
+				Type:     issueType,
+				Duration: duration,
+				Text:     segment.Text,
+			})
+		}
+	}
+	return issues
+}
+
+// isLowConfidence 置信度低于阈值；没有置信度的片段 (如非 Bcut 服务的结果) 不算低置信度
+func isLowConfidence(segment DataSegment, minConfidence float64) bool {
+	return minConfidence > 0 && segment.Confidence > 0 && segment.Confidence < minConfidence
+}
+
+// dropLowConfidence 去掉置信度低于 minConfidence 的片段
+func dropLowConfidence(segments []DataSegment, minConfidence float64) []DataSegment {
+	if minConfidence <= 0 {
+		return segments
+	}
+
+	kept := make([]DataSegment, 0, len(segments))
+	for _, segment := range segments {
+		if !isLowConfidence(segment, minConfidence) {
+			kept = append(kept, segment)
+		}
+	}
+	if dropped := len(segments) - len(kept); dropped > 0 {
+		Info("已去掉 %d 条置信度低于 %.2f 的片段", dropped, minConfidence)
+	}
+	return kept
+}
+
+// LowConfidenceSegments 标记置信度低于 minConfidence 的片段，与时长检查一起放在 warnings 中返回
+func LowConfidenceSegments(segments []DataSegment, minConfidence float64) []SegmentIssue {
+	var issues []SegmentIssue
+	for i, segment := range segments {
+		if isLowConfidence(segment, minConfidence) {
+			start, end := cueTimes(segment)
+			issues = append(issues, SegmentIssue{
+				Index:    i,
+				Type:     "low_confidence",
+				Duration: end - start,
+				Text:     segment.Text,
+			})
+		}
+	}
+	return issues
+}
+
+// SegmentationScore 分段质量评估结果
+type SegmentationScore struct {
+	SegmentCount    int      `json:"segment_count"`
+	AvgLength       float64  `json:"avg_length"`       // 平均段长 (不含标点的字数)
+	LengthStdDev    float64  `json:"length_stddev"`    // 段长标准差
+	PunctuationRate float64  `json:"punctuation_rate"` // 以标点结尾的片段占比
+	Score           int      `json:"score"`            // 0-100
+	Suggestions     []string `json:"suggestions,omitempty"`
+}
+
+// 单条字幕的建议字数范围
+const (
+	idealSegmentMinChars = 8
+	idealSegmentMaxChars = 30
+)
+
+// ScoreSegmentation 根据段长分布和标点覆盖率给分段质量打分
+// 段长占 50 分 (平均段长落在建议范围内得满分)，段长均匀度占 25 分，标点覆盖率占 25 分
+func ScoreSegmentation(segments []DataSegment) SegmentationScore {
+	result := SegmentationScore{SegmentCount: len(segments)}
+	if len(segments) == 0 {
+		return result
+	}
+
+	lengths := make([]float64, len(segments))
+	punctuated := 0
+	total := 0.0
+	for i, seg := range segments {
+		lengths[i] = float64(countContentRunes(seg.Text))
+		total += lengths[i]
+
+		runes := []rune(strings.TrimSpace(seg.Text))
+		if len(runes) > 0 && unicode.IsPunct(runes[len(runes)-1]) {
+			punctuated++
+		}
+	}
+	result.AvgLength = total / float64(len(segments))
+
+	variance := 0.0
+	for _, l := range lengths {
+		variance += (l - result.AvgLength) * (l - result.AvgLength)
+	}
+	result.LengthStdDev = math.Sqrt(variance / float64(len(segments)))
+	result.PunctuationRate = float64(punctuated) / float64(len(segments))
+
+	// 段长得分：偏离建议范围越远扣分越多
+	lengthScore := 1.0
+	needMerge, needSplit := false, false
+	if result.AvgLength < idealSegmentMinChars {
+		lengthScore = result.AvgLength / idealSegmentMinChars
+		needMerge = true
+	} else if result.AvgLength > idealSegmentMaxChars {
+		lengthScore = idealSegmentMaxChars / result.AvgLength
+		needSplit = true
+	}
+
+	// 均匀度得分：变异系数越大越不均匀
+	uniformScore := 0.0
+	if result.AvgLength > 0 {
+		uniformScore = math.Max(0, 1-result.LengthStdDev/result.AvgLength)
+	}
+	if uniformScore < 0.5 && !needMerge {
+		// 平均段长合适但长短悬殊，说明有个别过长的片段
+		needSplit = true
+	}
+
+	if needMerge {
+		result.Suggestions = append(result.Suggestions, "merge")
+	}
+	if needSplit {
+		result.Suggestions = append(result.Suggestions, "split")
+	}
+	if result.PunctuationRate < 0.5 {
+		result.Suggestions = append(result.Suggestions, "repunctuate")
+	}
+
+	result.Score = int(math.Round(50*lengthScore + 25*uniformScore + 25*result.PunctuationRate))
+	return result
+}
+
+// ASSStyle ASS/SSA 字幕样式
+type ASSStyle struct {
+	FontName     string  `json:"font_name"`
+	FontSize     int     `json:"font_size"`
+	PrimaryColor string  `json:"primary_color"` // "#RRGGBB" 或 ASS 格式 "&HAABBGGRR"
+	OutlineColor string  `json:"outline_color"`
+	Outline      float64 `json:"outline"`    // 描边宽度
+	Position     string  `json:"position"`   // 字幕位置：bottom (默认) / top / custom
+	PositionY    int     `json:"position_y"` // position 为 custom 时字幕底边距画面顶部的像素 (按 1080p 换算，1-1080)，未设置或越界时按底部处理
+}
+
+// 字幕位置
+const (
+	SubtitleBottom = "bottom"
+	SubtitleTop    = "top"
+	SubtitleCustom = "custom"
+)
+
+// assPlayResY ASS 脚本的画面高度，字号和边距都按此换算
+const assPlayResY = 1080
+
+// assLayout 根据字幕位置返回 ASS 的 Alignment 和 MarginV (未知位置按底部处理)
+func assLayout(style ASSStyle) (alignment, marginV int) {
+	switch strings.ToLower(strings.TrimSpace(style.Position)) {
+	case SubtitleTop:
+		return 8, 40 // 顶部居中
+	case SubtitleCustom:
+		// 未设置 position_y (为 0) 或超出画面时字幕会落到画面外，按底部处理
+		if style.PositionY <= 0 || style.PositionY > assPlayResY {
+			break
+		}
+		// 底部居中对齐，用底边距把字幕底边放到指定高度
+		return 2, assPlayResY - style.PositionY
+	}
+	return 2, 40 // 底部居中
+}
+
+// DefaultASSStyle 默认样式：白字黑边
+func DefaultASSStyle() ASSStyle {
+	return ASSStyle{
+		FontName:     "Microsoft YaHei",
+		FontSize:     60,
+		PrimaryColor: "&H00FFFFFF",
+		OutlineColor: "&H00000000",
+		Outline:      3,
+	}
+}
+
+// toASSColor 把 "#RRGGBB" 转换为 ASS 的 "&H00BBGGRR"，其他格式原样返回
+func toASSColor(color string) string {
+	color = strings.TrimSpace(color)
+	if len(color) == 7 && color[0] == '#' {
+		return strings.ToUpper("&H00" + color[5:7] + color[3:5] + color[1:3])
+	}
+	return color
+}
+
+// formatASSTime 格式化 ASS 时间 H:MM:SS.cc (厘秒)
+func formatASSTime(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	totalCs := int64(math.Round(seconds * 100))
+	h := totalCs / 360000
+	m := totalCs % 360000 / 6000
+	s := totalCs % 6000 / 100
+	cs := totalCs % 100
+
+	return fmt.Sprintf("%d:%02d:%02d.%02d", h, m, s, cs)
+}
+
+// assTextEscaper 转义 ASS 字幕文本：{} 会被当作样式覆盖块，换行改为 \N
+var assTextEscaper = strings.NewReplacer("{", "\\{", "}", "\\}", "\n", "\\N")
+
+// generateASS 生成带样式的 ASS 字幕 (用于烧录到视频)，未设置的样式字段使用默认值
+func generateASS(segments []DataSegment, style ASSStyle) string {
+	defaults := DefaultASSStyle()
+	if style.FontName == "" {
+		style.FontName = defaults.FontName
+	}
+	if style.FontSize <= 0 {
+		style.FontSize = defaults.FontSize
+	}
+	if style.PrimaryColor == "" {
+		style.PrimaryColor = defaults.PrimaryColor
+	}
+	if style.OutlineColor == "" {
+		style.OutlineColor = defaults.OutlineColor
+	}
+	if style.Outline <= 0 {
+		style.Outline = defaults.Outline
+	}
+
+	var assBuffer bytes.Buffer
+	assBuffer.WriteString("[Script Info]\n")
+	assBuffer.WriteString("ScriptType: v4.00+\n")
+	assBuffer.WriteString("PlayResX: 1920\n")
+	assBuffer.WriteString(fmt.Sprintf("PlayResY: %d\n", assPlayResY))
+	assBuffer.WriteString("WrapStyle: 0\n\n")
+
+	assBuffer.WriteString("[V4+ Styles]\n")
+	assBuffer.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, " +
+		"Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, " +
+		"Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	alignment, marginV := assLayout(style)
+	assBuffer.WriteString(fmt.Sprintf("Style: Default,%s,%d,%s,&H000000FF,%s,&H00000000,0,0,0,0,100,100,0,0,1,%.1f,0,%d,20,20,%d,1\n\n",
+		style.FontName, style.FontSize, toASSColor(style.PrimaryColor), toASSColor(style.OutlineColor), style.Outline, alignment, marginV))
+
+	assBuffer.WriteString("[Events]\n")
+	assBuffer.WriteString("Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+	for _, segment := range segments {
+		start, end := cueTimes(segment)
+		text := assTextEscaper.Replace(strings.TrimSpace(segment.Text))
+		assBuffer.WriteString(fmt.Sprintf("Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n",
+			formatASSTime(start), formatASSTime(end), text))
+	}
+
+	return assBuffer.String()
+}
+
+// LRCMetadata LRC 歌词的可选 ID 标签
+type LRCMetadata struct {
+	Title  string `json:"title"`  // [ti:]
+	Artist string `json:"artist"` // [ar:]
+	Album  string `json:"album"`  // [al:]
+}
+
+// formatLRCTime 格式化 LRC 时间 mm:ss.xx
+func formatLRCTime(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	totalCs := int64(math.Round(seconds * 100))
+	return fmt.Sprintf("%02d:%02d.%02d", totalCs/6000, totalCs%6000/100, totalCs%100)
+}
+
+// generateLRC 生成 LRC 歌词，只使用每个片段的开始时间
+func generateLRC(segments []DataSegment, meta LRCMetadata) string {
+	var lrcBuffer bytes.Buffer
+	if meta.Title != "" {
+		lrcBuffer.WriteString(fmt.Sprintf("[ti:%s]\n", meta.Title))
+	}
+	if meta.Artist != "" {
+		lrcBuffer.WriteString(fmt.Sprintf("[ar:%s]\n", meta.Artist))
+	}
+	if meta.Album != "" {
+		lrcBuffer.WriteString(fmt.Sprintf("[al:%s]\n", meta.Album))
+	}
+
+	for _, segment := range segments {
+		text := strings.Join(strings.Fields(segment.Text), " ")
+		if text == "" {
+			continue
+		}
+		start, _ := cueTimes(segment)
+		lrcBuffer.WriteString(fmt.Sprintf("[%s]%s\n", formatLRCTime(start), text))
+	}
+
+	return lrcBuffer.String()
+}
+
+func saveSRTFile(srtContent string, outputPath string) error {
+	err := os.WriteFile(outputPath, []byte(srtContent), 0644)
+	if err != nil {
+		return fmt.Errorf("保存SRT文件失败: %w", err)
+	}
+	return nil
+}
+
+// saveSubtitleFile 保存其他格式的字幕/文本文件
+func saveSubtitleFile(content string, outputPath string) error {
+	return saveEncodedSubtitleFile(content, outputPath, "")
+}
+
+// saveEncodedSubtitleFile 按指定编码保存字幕文件，encoding 为空时即 utf-8
+func saveEncodedSubtitleFile(content string, outputPath string, encoding string) error {
+	data, err := encodeSubtitle(content, encoding)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		return fmt.Errorf("保存字幕文件失败 %s: %w", filepath.Base(outputPath), err)
+	}
+	return nil
+}
+
+// normalizeSubtitleEncoding 规范化编码名称，不支持的编码返回错误
+// 支持 utf-8 (默认) / utf-8-bom / gbk，老的播放器和 Windows 记事本常需要后两种
+func normalizeSubtitleEncoding(encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "utf-8", "utf8":
+		return "utf-8", nil
+	case "utf-8-bom", "utf8-bom", "utf-8-sig":
+		return "utf-8-bom", nil
+	case "gbk", "gb2312", "cp936":
+		return "gbk", nil
+	}
+	return "", fmt.Errorf("不支持的字幕编码: %s (可选 utf-8/utf-8-bom/gbk)", encoding)
+}
+
+// encodeSubtitle 把字幕内容转成指定编码的字节
+func encodeSubtitle(content string, encoding string) ([]byte, error) {
+	encoding, err := normalizeSubtitleEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case "utf-8-bom":
+		return append([]byte("\xEF\xBB\xBF"), content...), nil
+	case "gbk":
+		data, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("转换为GBK编码失败 (包含GBK无法表示的字符): %w", err)
+		}
+		return data, nil
+	}
+	return []byte(content), nil
+}
+
+// outputFileName 生成输出文件的规范文件名：<基础名>[.<语言>][.<版本>].<扩展名>
+// kind 为字幕格式 (srt/vtt/txt/ass/lrc) 或 summary；summary 的 variant 为模型名
+// lang 和 variant 都为空时即默认文件名 (subtitles.srt、transcript.txt、summary.json)
+func outputFileName(kind, lang, variant string) string {
+	base, ext := "subtitles", "."+kind
+	switch kind {
+	case "txt":
+		base = "transcript"
+	case "summary":
+		base, ext = "summary", ".json"
+	}
+
+	name := base
+	for _, tag := range []string{lang, variant} {
+		if tag = sanitizeFileTag(tag); tag != "" {
+			name += "." + tag
+		}
+	}
+	return name + ext
+}
+
+// sanitizeFileTag 把标签中文件名不安全的字符 (如模型名里的 / 和 :) 替换为 -
+func sanitizeFileTag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		if r == '.' {
+			return '_'
+		}
+		return '-'
+	}, tag)
+}
+
+// subtitleExporter 批量导出时单个格式的文件名和生成函数 (使用各格式的默认选项)
+type subtitleExporter struct {
+	fileName string
+	generate func(segments []DataSegment) string
+}
+
+var subtitleExporters = map[string]subtitleExporter{
+	"srt": {outputFileName("srt", "", ""), generateSRT},
+	"vtt": {outputFileName("vtt", "", ""), func(segments []DataSegment) string { return generateVTT(segments, false) }},
+	"txt": {outputFileName("txt", "", ""), func(segments []DataSegment) string { return generatePlainText(segments, 0) }},
+	"ass": {outputFileName("ass", "", ""), func(segments []DataSegment) string { return generateASS(segments, ASSStyle{}) }},
+	"lrc": {outputFileName("lrc", "", ""), func(segments []DataSegment) string { return generateLRC(segments, LRCMetadata{}) }},
+}
+
+// parseFormatList 解析逗号分隔的格式列表，去重并转为小写
+func parseFormatList(value string) []string {
+	var formats []string
+	seen := make(map[string]bool)
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" || seen[format] {
+			continue
+		}
+		seen[format] = true
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// ExportFormats 在 outputDir 下一次生成多种字幕格式，返回 格式 -> 文件路径
+// encoding 为输出文件编码，为空时即 utf-8
+func ExportFormats(segments []DataSegment, outputDir string, formats []string, encoding string) (map[string]string, error) {
+	paths := make(map[string]string, len(formats))
+	for _, format := range formats {
+		exporter, ok := subtitleExporters[format]
+		if !ok {
+			return paths, fmt.Errorf("不支持的字幕格式: %s", format)
+		}
+		path := filepath.Join(outputDir, exporter.fileName)
+		if err := saveEncodedSubtitleFile(exporter.generate(segments), path, encoding); err != nil {
+			return paths, err
+		}
+		paths[format] = path
+	}
+	return paths, nil
+}
+
+// ExportVariants 按多个分段策略导出字幕，文件名带上版本名 (如 subtitles.raw.srt / subtitles.cps.srt)
+// 返回 "版本.格式" 到文件路径的映射
+func ExportVariants(segments []DataSegment, outputDir string, formats, variants []string, encoding string) (map[string]string, error) {
+	paths := make(map[string]string, len(formats)*len(variants))
+	for _, variant := range variants {
+		transform, ok := subtitleVariants[variant]
+		if !ok {
+			return paths, fmt.Errorf("不支持的分段版本: %s (可选 raw/merged/cps)", variant)
+		}
+		variantSegments := transform(segments)
+
+		for _, format := range formats {
+			exporter, ok := subtitleExporters[format]
+			if !ok {
+				return paths, fmt.Errorf("不支持的字幕格式: %s", format)
+			}
+			path := filepath.Join(outputDir, outputFileName(format, "", variant))
+			if err := saveEncodedSubtitleFile(exporter.generate(variantSegments), path, encoding); err != nil {
+				return paths, err
+			}
+			paths[variant+"."+format] = path
+		}
+	}
+	return paths, nil
+}
+
+// TimeRange 时间范围 (秒)
+type TimeRange struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// selectSegments 按序号或时间范围挑选片段，保持原顺序；两者都为空时返回全部
+// 时间范围与片段有重叠即选中，无效序号忽略
+func selectSegments(segments []DataSegment, indices []int, ranges []TimeRange) []DataSegment {
+	if len(indices) == 0 && len(ranges) == 0 {
+		return segments
+	}
+
+	selected := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		if i >= 0 && i < len(segments) {
+			selected[i] = true
+		}
+	}
+	for i, seg := range segments {
+		for _, r := range ranges {
+			if seg.StartTime < r.End && seg.EndTime > r.Start {
+				selected[i] = true
+				break
+			}
+		}
+	}
+
+	result := []DataSegment{}
+	for i, seg := range segments {
+		if selected[i] {
+			result = append(result, seg)
+		}
+	}
+	return result
+}
+
+// diffSegments 返回新版本中相对旧版本新增或改动 (时间轴或文本不同) 的片段及其序号，保持新版本顺序
+func diffSegments(base, current []DataSegment) ([]DataSegment, []int) {
+	unchanged := make(map[DataSegment]int, len(base))
+	for _, seg := range base {
+		unchanged[seg]++
+	}
+
+	changed := []DataSegment{}
+	indices := []int{}
+	for i, seg := range current {
+		if unchanged[seg] > 0 {
+			unchanged[seg]--
+			continue
+		}
+		changed = append(changed, seg)
+		indices = append(indices, i)
+	}
+	return changed, indices
+}
+
+// writeExportZip 把导出的文件打包写入 w
+func writeExportZip(w io.Writer, paths map[string]string) error {
+	zipWriter := zip.NewWriter(w)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("读取导出文件失败: %w", err)
+		}
+		entry, err := zipWriter.Create(filepath.Base(path))
+		if err != nil {
+			return fmt.Errorf("写入压缩包失败: %w", err)
+		}
+		if _, err := entry.Write(data); err != nil {
+			return fmt.Errorf("写入压缩包失败: %w", err)
+		}
+	}
+	return zipWriter.Close()
+}
+
+// ==================== 字幕后处理 ====================
+
+// MergeToTargetCount 合并相邻片段直到段数为 targetCount
+// 不同说话人之间始终保留分界，其余保留间隔最大的分界，相邻段合并
+// 说话人切换次数超过 targetCount-1 时结果段数会多于 targetCount
+func MergeToTargetCount(segments []DataSegment, targetCount int) []DataSegment {
+	if targetCount <= 0 || len(segments) <= targetCount {
+		return segments
+	}
+
+	// 分界 i 表示 segments[i] 与 segments[i+1] 之间：先保留说话人切换处，再按间隔从大到小补足
+	boundaries := make(map[int]bool, targetCount-1)
+	var gaps []int
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i].Speaker != segments[i+1].Speaker {
+			boundaries[i] = true
+		} else {
+			gaps = append(gaps, i)
+		}
+	}
+	sort.SliceStable(gaps, func(a, b int) bool {
+		gapA := segments[gaps[a]+1].StartTime - segments[gaps[a]].EndTime
+		gapB := segments[gaps[b]+1].StartTime - segments[gaps[b]].EndTime
+		return gapA > gapB
+	})
+	if keep := targetCount - 1 - len(boundaries); keep > 0 {
+		for _, i := range gaps[:min(keep, len(gaps))] {
+			boundaries[i] = true
+		}
+	}
+
+	merged := []DataSegment{segments[0]}
+	for i := 1; i < len(segments); i++ {
+		if boundaries[i-1] {
+			merged = append(merged, segments[i])
+			continue
+		}
+		absorbSegment(&merged[len(merged)-1], segments[i])
+	}
+	return merged
+}
+
+// absorbSegment 把 seg 合并到 last：文本相连，保留最早的开始时间和最晚的结束时间
+// 置信度取较低的一个，低置信度片段不会因合并被掩盖
+func absorbSegment(last *DataSegment, seg DataSegment) {
+	last.Text = joinSegmentText(last.Text, seg.Text)
+	last.StartTime = math.Min(last.StartTime, seg.StartTime)
+	last.EndTime = math.Max(last.EndTime, seg.EndTime)
+	if seg.Confidence > 0 && (last.Confidence == 0 || seg.Confidence < last.Confidence) {
+		last.Confidence = seg.Confidence
+	}
+}
+
+// mergeSegments 合并间隔小于 maxGap 秒的相邻碎片，合并后文本不超过 maxChars 个字符 (<=0 不限制)
+// 不同说话人的片段不合并，合并规则见 absorbSegment
+func mergeSegments(segments []DataSegment, maxGap float64, maxChars int) []DataSegment {
+	if maxGap <= 0 || len(segments) == 0 {
+		return segments
+	}
+
+	merged := []DataSegment{segments[0]}
+	for _, seg := range segments[1:] {
+		last := &merged[len(merged)-1]
+		text := joinSegmentText(last.Text, seg.Text)
+		if seg.StartTime-last.EndTime >= maxGap || (maxChars > 0 && len([]rune(text)) > maxChars) || seg.Speaker != last.Speaker {
+			merged = append(merged, seg)
+			continue
+		}
+
+		absorbSegment(last, seg)
+	}
+	return merged
+}
+
+// splitLongSegments 把文本超过 maxChars 的片段拆成多条字幕，时间按文本长度比例分配
+// 优先在标点或空格处断开，中文等无空格文本按字数断开
+func splitLongSegments(segments []DataSegment, maxChars int) []DataSegment {
+	if maxChars <= 0 {
+		return segments
+	}
+
+	var result []DataSegment
+	for _, seg := range segments {
+		pieces := splitTextAt(seg.Text, maxChars)
+		if len(pieces) <= 1 {
+			result = append(result, seg)
+			continue
+		}
+
+		total := 0
+		for _, piece := range pieces {
+			total += len([]rune(piece))
+		}
+		start, end := cueTimes(seg)
+		duration := end - start
+		offset := 0
+		for _, piece := range pieces {
+			length := len([]rune(piece))
+			result = append(result, DataSegment{
+				Text:       piece,
+				StartTime:  start + duration*float64(offset)/float64(total),
+				EndTime:    start + duration*float64(offset+length)/float64(total),
+				Speaker:    seg.Speaker,
+				Confidence: seg.Confidence,
+			})
+			offset += length
+		}
+	}
+	return result
+}
+
+// splitTextAt 把文本拆成不超过 maxChars 的若干段，不产生空段
+func splitTextAt(text string, maxChars int) []string {
+	runes := []rune(strings.TrimSpace(text))
+	var pieces []string
+
+	for len(runes) > maxChars {
+		// 先在后半段从后向前寻找断点 (空格处、标点前后)，再到前半段找，都找不到则按字数硬断
+		cut := -1
+		for i := maxChars; i > maxChars/2; i-- {
+			if unicode.IsSpace(runes[i]) || unicode.IsPunct(runes[i-1]) || unicode.IsPunct(runes[i]) {
+				cut = i
+				break
+			}
+		}
+		for i := maxChars / 2; cut == -1 && i > 0; i-- {
+			if unicode.IsSpace(runes[i]) || unicode.IsPunct(runes[i-1]) {
+				cut = i
+			}
+		}
+		if cut == -1 {
+			cut = maxChars
+		}
+		// 标点不放到下一行行首
+		for cut < len(runes) && unicode.IsPunct(runes[cut]) {
+			cut++
+		}
+
+		if piece := strings.TrimSpace(string(runes[:cut])); piece != "" {
+			pieces = append(pieces, piece)
+		}
+		runes = []rune(strings.TrimLeftFunc(string(runes[cut:]), unicode.IsSpace))
+	}
+	if piece := strings.TrimSpace(string(runes)); piece != "" {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+// wrapSubtitleText 把单条字幕按每行不超过 maxLineChars 字断行 (行间用 "\n")
+// 断行后末行只剩一两个字时，把最后两行重新均分，避免孤字成行
+func wrapSubtitleText(text string, maxLineChars int) string {
+	text = strings.TrimSpace(text)
+	if maxLineChars <= 0 || len([]rune(text)) <= maxLineChars {
+		return text
+	}
+
+	lines := splitTextAt(text, maxLineChars)
+	minLineChars := maxLineChars / 4
+	if minLineChars < 3 {
+		minLineChars = 3
+	}
+	if n := len(lines); n >= 2 && countContentRunes(lines[n-1]) < minLineChars {
+		merged := joinWrappedLines(lines[n-2], lines[n-1])
+		lines = append(lines[:n-2], balanceLines(merged, maxLineChars)...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// joinWrappedLines 还原被断开的两行，英文之间补回空格
+func joinWrappedLines(a, b string) string {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) > 0 && len(rb) > 0 && ra[len(ra)-1] < utf8.RuneSelf && rb[0] < utf8.RuneSelf {
+		return a + " " + b
+	}
+	return a + b
+}
+
+// balanceLines 把文本从中间附近断成长度接近的两行
+// 优先在空格或标点后断开，不把标点放到行首，不在英文单词中间断开
+func balanceLines(text string, maxLineChars int) []string {
+	runes := []rune(text)
+	target := len(runes) / 2
+
+	bestCut, bestCost := -1, 0
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsPunct(runes[i]) {
+			continue
+		}
+		isBreak := unicode.IsSpace(runes[i]) || unicode.IsSpace(runes[i-1]) || unicode.IsPunct(runes[i-1])
+		if !isBreak && isWordRune(runes[i-1]) && isWordRune(runes[i]) {
+			continue
+		}
+		first := strings.TrimSpace(string(runes[:i]))
+		second := strings.TrimSpace(string(runes[i:]))
+		if first == "" || second == "" || len([]rune(first)) > maxLineChars || len([]rune(second)) > maxLineChars {
+			continue
+		}
+
+		cost := i - target
+		if cost < 0 {
+			cost = -cost
+		}
+		if !isBreak {
+			cost += 3 // 中文无标点处也可断，但优先标点
+		}
+		if bestCut == -1 || cost < bestCost {
+			bestCut, bestCost = i, cost
+		}
+	}
+
+	if bestCut == -1 {
+		return splitTextAt(text, maxLineChars)
+	}
+	return []string{strings.TrimSpace(string(runes[:bestCut])), strings.TrimSpace(string(runes[bestCut:]))}
+}
+
+// isWordRune 英文单词/数字字符，断行时不从中间断开
+func isWordRune(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '-')
+}
+
+// wrapSegments 返回字幕文本按行宽换行后的副本，用于 SRT/VTT/ASS 输出
+func wrapSegments(segments []DataSegment, maxLineChars int) []DataSegment {
+	if maxLineChars <= 0 {
+		return segments
+	}
+	wrapped := make([]DataSegment, len(segments))
+	for i, seg := range segments {
+		seg.Text = wrapSubtitleText(seg.Text, maxLineChars)
+		wrapped[i] = seg
+	}
+	return wrapped
+}
+
+// shiftSegments 整体平移字幕时间，平移后小于 0 的时间截断为 0
+func shiftSegments(segments []DataSegment, offset float64) []DataSegment {
+	shifted := make([]DataSegment, len(segments))
+	for i, seg := range segments {
+		seg.StartTime = math.Max(0, seg.StartTime+offset)
+		seg.EndTime = math.Max(seg.StartTime, seg.EndTime+offset)
+		shifted[i] = seg
+	}
+	return shifted
+}
+
+// ReverseTimeline 反转时间轴 (用于倒放视频的字幕)：每段映射为 [total-end, total-start] 并倒序排列
+// totalDuration <= 0 时取最后一段的结束时间，超出总时长的部分截断到 [0, total]
+func ReverseTimeline(segments []DataSegment, totalDuration float64) []DataSegment {
+	if len(segments) == 0 {
+		return []DataSegment{}
+	}
+	if totalDuration <= 0 {
+		for _, seg := range segments {
+			totalDuration = math.Max(totalDuration, seg.EndTime)
+		}
+	}
+
+	reversed := make([]DataSegment, len(segments))
+	for i, seg := range segments {
+		start := math.Max(0, totalDuration-math.Min(seg.EndTime, totalDuration))
+		end := math.Max(start, totalDuration-math.Max(seg.StartTime, 0))
+		seg.StartTime, seg.EndTime = start, end
+		reversed[len(segments)-1-i] = seg
+	}
+	return reversed
+}
+
+// CleanOptions 片段清洗选项
+type CleanOptions struct {
+	WakeWords       []string `json:"wake_words"`       // 唤醒词/命令词黑名单 (如「嗨 Siri」)，整段匹配的片段直接删除
+	DedupSimilarity float64  `json:"dedup_similarity"` // 相邻片段相似度不低于该值 (0-1) 时视为口头重复并合并，0 不处理
+}
+
+// CleanSegments 按清洗选项过滤片段
+func CleanSegments(segments []DataSegment, opts CleanOptions) []DataSegment {
+	if opts.DedupSimilarity > 0 {
+		segments = DeduplicateAdjacent(segments, opts.DedupSimilarity)
+	}
+	if len(opts.WakeWords) == 0 {
+		return segments
+	}
+
+	blacklist := make(map[string]bool, len(opts.WakeWords))
+	for _, word := range opts.WakeWords {
+		if key := normalizeCommandText(word); key != "" {
+			blacklist[key] = true
+		}
+	}
+
+	cleaned := make([]DataSegment, 0, len(segments))
+	for _, seg := range segments {
+		if blacklist[normalizeCommandText(seg.Text)] {
+			Info("过滤唤醒词片段: [%.2fs] %s", seg.StartTime, seg.Text)
+			continue
+		}
+		cleaned = append(cleaned, seg)
+	}
+	return cleaned
+}
+
+// DeduplicateAdjacent 合并相邻的重复片段 (口头重复、卡顿导致的重复句)
+// 相似度按去除标点后的编辑距离计算：1 - 距离/较长文本字数，不低于 similarity 时合并，
+// 合并后保留较长的文本，时间取两段的并集
+func DeduplicateAdjacent(segments []DataSegment, similarity float64) []DataSegment {
+	if similarity <= 0 || len(segments) < 2 {
+		return segments
+	}
+
+	result := []DataSegment{segments[0]}
+	lastKey := []rune(normalizeCommandText(segments[0].Text))
+	for _, seg := range segments[1:] {
+		key := []rune(normalizeCommandText(seg.Text))
+		last := &result[len(result)-1]
+		if len(key) == 0 || len(lastKey) == 0 || seg.Speaker != last.Speaker || textSimilarity(lastKey, key) < similarity {
+			result = append(result, seg)
+			lastKey = key
+			continue
+		}
+
+		Info("合并重复片段: [%.2fs] %s", seg.StartTime, seg.Text)
+		if len(key) > len(lastKey) {
+			last.Text = seg.Text
+			lastKey = key
+		}
+		last.StartTime = math.Min(last.StartTime, seg.StartTime)
+		last.EndTime = math.Max(last.EndTime, seg.EndTime)
+	}
+	return result
+}
+
+// textSimilarity 基于编辑距离的相似度 (0-1)
+func textSimilarity(a, b []rune) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(a, b))/float64(longest)
+}
+
+// editDistance 两段文本的编辑距离 (Levenshtein)
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// normalizeCommandText 去除空白和标点并转小写，用于命令词整段比较
+func normalizeCommandText(text string) string {
+	var builder strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// joinSegmentText 拼接两段文本，只在英文等单字节字符之间补空格，中文直接相连
+func joinSegmentText(a, b string) string {
+	a = strings.TrimSpace(a)
+	b = strings.TrimSpace(b)
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return joinWrappedLines(a, b)
+}
+
+// loadSegmentsFile 读取输出目录中缓存的 segments.json
+func loadSegmentsFile(outputDir string) ([]DataSegment, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, "segments.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取识别结果失败: %w", err)
+	}
+
+	var segments []DataSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, fmt.Errorf("解析识别结果失败: %w", err)
+	}
+	return segments, nil
+}
+
+// resolveSegments 优先使用请求中传入的片段，否则读取视频输出目录缓存的 segments.json
+func resolveSegments(videoPath string, segments []DataSegment) ([]DataSegment, error) {
+	if len(segments) > 0 {
+		return segments, nil
+	}
+	if videoPath == "" {
+		return nil, fmt.Errorf("缺少video_path或segments参数")
+	}
+	vp, err := NewVideoProcessor(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	return loadSegmentsFile(vp.OutputDir)
+}
+
+// 多版本导出时合并和 CPS 优化使用的参数
+const (
+	variantMergeGap = 1.0 // 合并间隔小于 1 秒的相邻片段
+	defaultMaxCPS   = 15  // 每秒最多显示的字数 (不含标点)
+	minCueGap       = 0.1 // 延长结束时间时与下一条字幕保留的间隔
+)
+
+// optimizeCPS 延长阅读速度超过 maxCPS 的字幕的结束时间，最多延长到下一条字幕开始前 minCueGap 秒
+func optimizeCPS(segments []DataSegment, maxCPS float64) []DataSegment {
+	if maxCPS <= 0 {
+		return segments
+	}
+
+	result := make([]DataSegment, len(segments))
+	copy(result, segments)
+	for i := range result {
+		start, end := cueTimes(result[i])
+		need := float64(countContentRunes(result[i].Text)) / maxCPS
+		if end-start >= need {
+			continue
+		}
+		target := start + need
+		if i+1 < len(result) {
+			target = math.Min(target, result[i+1].StartTime-minCueGap)
+		}
+		if target > end {
+			result[i].EndTime = target
+		}
+	}
+	return result
+}
+
+// subtitleVariants 多版本导出支持的分段策略：原始分段、合并碎片、合并后再做 CPS 优化
+var subtitleVariants = map[string]func(segments []DataSegment) []DataSegment{
+	"raw": func(segments []DataSegment) []DataSegment { return segments },
+	"merged": func(segments []DataSegment) []DataSegment {
+		return mergeSegments(segments, variantMergeGap, idealSegmentMaxChars)
+	},
+	"cps": func(segments []DataSegment) []DataSegment {
+		return optimizeCPS(mergeSegments(segments, variantMergeGap, idealSegmentMaxChars), defaultMaxCPS)
+	},
+}
+
+// ==================== Anki导出 ====================
+
+// ExportAnki 导出 Anki 记忆卡
+// 正面为原文，背面为译文 + 对应音频片段，生成 CSV 和媒体目录
+// (导入前需将 media 目录中的文件复制到 Anki 的 collection.media)
+func ExportAnki(segments, translated []DataSegment, audioPath string) (string, error) {
+	if len(segments) == 0 {
+		return "", fmt.Errorf("没有可导出的识别结果")
+	}
+
+	exportDir := filepath.Join(filepath.Dir(audioPath), "anki")
+	mediaDir := filepath.Join(exportDir, "media")
+	if err := os.MkdirAll(mediaDir, 0755); err != nil {
+		return "", fmt.Errorf("创建导出目录失败: %w", err)
+	}
+
+	// 音频不存在时只导出文本
+	hasAudio := false
+	if _, err := os.Stat(audioPath); err == nil {
+		hasAudio = true
+	}
+
+	var csvBuffer bytes.Buffer
+	csvBuffer.WriteString("#separator:comma\n#html:true\n")
+	writer := csv.NewWriter(&csvBuffer)
+
+	// 媒体文件在 collection.media 中共享命名空间，用音频路径哈希做前缀避免冲突
+	prefix := fmt.Sprintf("%x", md5.Sum([]byte(audioPath)))[:8]
+	for i, seg := range segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+
+		back := ""
+		if i < len(translated) {
+			back = strings.TrimSpace(translated[i].Text)
+		}
+
+		if hasAudio && seg.EndTime > seg.StartTime {
+			clipName := fmt.Sprintf("%s_%04d.mp3", prefix, i+1)
+			clipPath := filepath.Join(mediaDir, clipName)
+			cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.2f", seg.StartTime),
+				"-t", fmt.Sprintf("%.2f", seg.EndTime-seg.StartTime),
+				"-i", audioPath, "-acodec", "libmp3lame", "-y", clipPath)
+			done := trackFFmpeg()
+			err := cmd.Run()
+			done()
+			if err != nil {
+				Warn("切分音频片段 %d 失败: %v", i+1, err)
+			} else {
+				back += fmt.Sprintf("<br>[sound:%s]", clipName)
+			}
+		}
+
+		if err := writer.Write([]string{text, back}); err != nil {
+			return "", fmt.Errorf("写入卡片失败: %w", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", fmt.Errorf("写入卡片失败: %w", err)
+	}
+
+	csvPath := filepath.Join(exportDir, "anki_cards.csv")
+	if err := os.WriteFile(csvPath, csvBuffer.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("保存卡片文件失败: %w", err)
+	}
+
+	Info("Anki卡片已导出: %s", csvPath)
+	return csvPath, nil
+}
+
+// ==================== DOCX导出 ====================
+
+// docxMaxImageWidth 图片在文档中的最大宽度 (EMU，约 15cm)
+const docxMaxImageWidth = 5400000
+
+var (
+	docxBoldPattern  = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	docxImagePattern = regexp.MustCompile(`^!\[([^\]]*)\]\(([^)]+)\)$`)
+	docxListPattern  = regexp.MustCompile(`^[-*+]\s+`)
+	docxOrderPattern = regexp.MustCompile(`^\d+\.\s+`)
+)
+
+// docxImage 嵌入文档的图片
+type docxImage struct {
+	name string
+	data []byte
+}
+
+// ExportDOCX 把 AI 总结的 Markdown 转成 Word 文档 (直接拼 OOXML)，写入 outputDir/summary.docx
+// 支持标题 (#~###)、列表、加粗和 /files/ 下的截图，[[TIME: 秒数]] 标记转换为 [mm:ss]
+func ExportDOCX(resp AIResponse, outputDir string) (string, error) {
+	markdown := resp.Markdown
+	if strings.TrimSpace(markdown) == "" {
+		markdown = resp.Summary
+	}
+	if strings.TrimSpace(markdown) == "" {
+		return "", fmt.Errorf("没有可导出的总结内容")
+	}
+
+	var body strings.Builder
+	var images []docxImage
+	for _, line := range strings.Split(markdown, "\n") {
+		// 可展开的原文引用在文档中改为括注
+		line = quoteBlockPattern.ReplaceAllStringFunc(line, func(block string) string {
+			match := quoteBlockPattern.FindStringSubmatch(block)
+			return fmt.Sprintf("（原文 %s%s）", match[1], html.UnescapeString(match[2]))
+		})
+		line = noteTimePattern.ReplaceAllStringFunc(strings.TrimSpace(line), func(mark string) string {
+			seconds, _ := strconv.ParseFloat(noteTimePattern.FindStringSubmatch(mark)[1], 64)
+			return fmt.Sprintf("[%02d:%02d] ", int(seconds)/60, int(seconds)%60)
+		})
+		if line == "" || line == "---" {
+			continue
+		}
+
+		if match := docxImagePattern.FindStringSubmatch(line); match != nil {
+			if paragraph, img, ok := docxImageParagraph(match[2], len(images)+1); ok {
+				body.WriteString(paragraph)
+				images = append(images, img)
+			}
+			continue
+		}
+
+		style := ""
+		switch {
+		case strings.HasPrefix(line, "### "):
+			style, line = "Heading3", line[4:]
+		case strings.HasPrefix(line, "## "):
+			style, line = "Heading2", line[3:]
+		case strings.HasPrefix(line, "# "):
+			style, line = "Heading1", line[2:]
+		case docxListPattern.MatchString(line):
+			style, line = "ListParagraph", "• "+docxListPattern.ReplaceAllString(line, "")
+		case docxOrderPattern.MatchString(line):
+			style = "ListParagraph"
+		}
+		body.WriteString(docxParagraph(style, line))
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("创建输出目录失败: %w", err)
+	}
+	docxPath := filepath.Join(outputDir, "summary.docx")
+	file, err := os.Create(docxPath)
+	if err != nil {
+		return "", fmt.Errorf("创建文件失败: %w", err)
+	}
+	defer file.Close()
+
+	if err := writeDOCX(file, body.String(), images); err != nil {
+		return "", fmt.Errorf("生成DOCX失败: %w", err)
+	}
+	return docxPath, nil
+}
+
+// docxParagraph 生成一个段落，**加粗** 转为加粗的 run
+func docxParagraph(style, text string) string {
+	var builder strings.Builder
+	builder.WriteString("<w:p>")
+	if style != "" {
+		builder.WriteString(`<w:pPr><w:pStyle w:val="` + style + `"/></w:pPr>`)
+	}
+	writeRun := func(text string, bold bool) {
+		if text == "" {
+			return
+		}
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(text))
+		builder.WriteString("<w:r>")
+		if bold {
+			builder.WriteString("<w:rPr><w:b/></w:rPr>")
+		}
+		builder.WriteString(`<w:t xml:space="preserve">` + escaped.String() + "</w:t></w:r>")
+	}
+	last := 0
+	for _, loc := range docxBoldPattern.FindAllStringSubmatchIndex(text, -1) {
+		writeRun(text[last:loc[0]], false)
+		writeRun(text[loc[2]:loc[3]], true)
+		last = loc[1]
+	}
+	writeRun(text[last:], false)
+	builder.WriteString("</w:p>")
+	return builder.String()
+}
+
+// docxImageParagraph 读取 Web 路径对应的本地截图，生成内嵌图片段落
+// 只嵌入提供访问的目录中的图片，其他路径 (含本地绝对路径) 一律跳过
+func docxImageParagraph(webPath string, index int) (string, docxImage, bool) {
+	localPath, ok := fromWebPath(webPath)
+	if !ok {
+		Warn("DOCX 跳过不在可访问目录中的图片: %s", webPath)
+		return "", docxImage{}, false
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		Warn("DOCX 跳过无法读取的图片: %s", webPath)
+		return "", docxImage{}, false
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width == 0 {
+		Warn("DOCX 跳过无法识别的图片: %s", webPath)
+		return "", docxImage{}, false
+	}
+
+	// 按 96 DPI 换算为 EMU，超过页面宽度时等比缩小
+	width := int64(config.Width) * 9525
+	height := int64(config.Height) * 9525
+	if width > docxMaxImageWidth {
+		height = height * docxMaxImageWidth / width
+		width = docxMaxImageWidth
+	}
+
+	img := docxImage{name: fmt.Sprintf("image%d.%s", index, format), data: data}
+	paragraph := fmt.Sprintf(`<w:p><w:r><w:drawing><wp:inline><wp:extent cx="%d" cy="%d"/><wp:docPr id="%d" name="图片%d"/>`+
+		`<a:graphic xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture">`+
+		`<pic:pic xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"><pic:nvPicPr><pic:cNvPr id="%d" name="%s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="rIdImage%d"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr>`+
+		`</pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r></w:p>`,
+		width, height, index, index, index, img.name, index, width, height)
+	return paragraph, img, true
+}
+
+// writeDOCX 把文档正文和图片打包成 docx (zip)
+func writeDOCX(w io.Writer, body string, images []docxImage) error {
+	var rels strings.Builder
+	for i, img := range images {
+		rels.WriteString(fmt.Sprintf(`<Relationship Id="rIdImage%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/%s"/>`, i+1, img.name))
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Default Extension="jpeg" ContentType="image/jpeg"/><Default Extension="png" ContentType="image/png"/>` +
+			`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+			`<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/></Relationships>`},
+		{"word/_rels/document.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			rels.String() + `</Relationships>`},
+		{"word/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+			`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:pPr><w:spacing w:after="120"/></w:pPr><w:rPr><w:sz w:val="22"/></w:rPr></w:style>` +
+			`<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:before="240"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="36"/></w:rPr></w:style>` +
+			`<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:before="200"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="30"/></w:rPr></w:style>` +
+			`<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:before="160"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="26"/></w:rPr></w:style>` +
+			`<w:style w:type="paragraph" w:styleId="ListParagraph"><w:name w:val="List Paragraph"/><w:basedOn w:val="Normal"/><w:pPr><w:ind w:left="420"/></w:pPr></w:style></w:styles>`},
+		{"word/document.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" ` +
+			`xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"><w:body>` +
+			body + `</w:body></w:document>`},
+	}
+
+	zipWriter := zip.NewWriter(w)
+	for _, f := range files {
+		writer, err := zipWriter.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(writer, f.content); err != nil {
+			return err
+		}
+	}
+	for _, img := range images {
+		writer, err := zipWriter.Create("word/media/" + img.name)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(img.data); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// ==================== AI总结服务 ====================
+
+// AISummarizer AI总结器
+type AISummarizer struct {
+	config AIConfig
+}
+
+func NewAISummarizer(config AIConfig) *AISummarizer {
+	return &AISummarizer{config: config}
+}
+
+// applyDefaults 设置默认的API地址和模型
+func (ai *AISummarizer) applyDefaults() {
+	if ai.config.APIURL == "" {
+		ai.config.APIURL = "https://api.xiaomimimo.com/v1/chat/completions"
+	}
+	if ai.config.Model == "" {
+		ai.config.Model = "mimo-v2-flash"
+	}
+}
+
+// Summarize 调用AI进行总结
+func (ai *AISummarizer) Summarize(req AIRequest) (AIResponse, error) {
+	// 构建完整的文本内容（带时间戳，方便AI定位）
+	fullText := req.Text
+	if len(req.Segments) > 0 {
+		fullText = buildTimedTranscript(req.Segments)
+	}
+
+	// 构建高质量 Prompt
+	prompt := ai.config.CustomPrompt
+	if prompt == "" {
+		prompt = `你是一位专业的课程助教和内容分析专家。请根据提供的视频字幕内容（包含时间戳），生成一份详尽的课程学习笔记。
+
+要求：
+1. **核心摘要**：用简练的语言概括课程/视频的核心主题和目标。
+2. **关键概念解析**：提取视频中出现的专业术语或核心概念，并进行解释。
+3. **逻辑脉络梳理**：不要记流水账，请按逻辑层级（如：背景引入 -> 核心理论 -> 案例分析 -> 总结）重组内容。
+4. **智能配图与定位**：
+   - 在关键知识点讲解处，插入截图标记：[[CAPTURE: 秒数]]
+   - **必须**：在每个重要段落或列表项开头，插入时间戳标记：[[TIME: 秒数]]，方便回溯。
+   - 注意前端是这样解析这些标记的，请严格按照格式输出，否则无法识别。md.replace(/\[\[TIME:\s*(\d+(\.\d+)?)\]\]/g, (match, p1) => {
+
+请使用 Markdown 格式输出，保持排版清晰专业。`
+	}
+
+	// 如果有截图，提及截图；开启 Vision 时截图会作为图片随请求发送
+	var screenshots []string
+	if len(req.Screenshots) > 0 && ai.config.Vision {
+		outputDir := ""
+		if vp, err := NewVideoProcessor(req.VideoPath); err == nil {
+			outputDir = vp.OutputDir
+		}
+		screenshots = resolveScreenshotPaths(req.Screenshots, outputDir)
+		prompt += fmt.Sprintf("\n注意：附带的图片是按时间顺序截取的视频画面 (%s)，请结合画面中的幻灯片文字、图表和演示内容进行总结",
+			strings.Join(req.Screenshots, ", "))
+	} else if len(req.Screenshots) > 0 {
+		prompt += fmt.Sprintf("\n注意：视频截图已保存在：%s，这些截图可以作为要点的视觉参考",
+			strings.Join(req.Screenshots, ", "))
+	}
+
+	// 有字幕时间戳时要求关键结论标注原文出处，由 processQuoteMarkers 替换为可展开的原文
+	if len(req.Segments) > 0 {
+		prompt += "\n对于关键结论，请在句末插入原文引用标记：[[QUOTE: 秒数]]，秒数为支撑该结论的那句字幕开头的时间戳 (直接使用字幕中的原始时间)，不要引用字幕中不存在的内容"
+	}
+
+	// 要求附带主题标签，用于分类管理
+	prompt += "\n最后单独一行输出 3-5 个主题标签，格式：" + summaryTagsPrefix + "标签1, 标签2"
+
+	// 完整的prompt
+	fullPrompt := fmt.Sprintf("%s\n\n内容：\n%s", prompt, fullText)
+
+	// 如果没有配置API Key，使用本地模拟
+	if ai.config.APIKey == "" {
+		return ai.localSummarize(req.Text, req.Screenshots)
+	}
+
+	// 设置默认值
+	ai.applyDefaults()
+
+	// 1. 调用 AI 获取包含标记的 Markdown
+	// 请求完全相同 (接口/模型/采样参数/提示词/文稿/截图) 时直接复用上次的总结，任一项变化时缓存自然失效
+	cacheKey := ai.summaryCacheKey(prompt, fullText, screenshots)
+	rawResponse, cached := AIResponse{}, false
+	if !req.Refresh {
+		rawResponse, cached = ai.loadSummaryCache(cacheKey)
+	}
+	if cached {
+		Info("AI总结命中缓存: %s", cacheKey)
+	} else {
+		var err error
+		rawResponse, err = ai.requestSummary(req.Segments, screenshots, prompt, fullPrompt, fullText)
+		if err != nil {
+			return rawResponse, err
+		}
+		ai.saveSummaryCache(cacheKey, rawResponse)
+	}
+
+	// 2. 把引用标记 [[QUOTE: 123.45]] 替换为对应的原文片段
+	rawResponse.Markdown = processQuoteMarkers(rawResponse.Markdown, req.Segments)
+
+	// 3. 处理截图标记 [[CAPTURE: 123.45]] 和时间标记 [[TIME: 123.45]]
+	if req.VideoPath != "" {
+		processedMarkdown, err := ai.processScreenshots(rawResponse.Markdown, req.VideoPath)
+		if err == nil {
+			rawResponse.Markdown = processedMarkdown
+		} else {
+			Warn("处理AI截图失败: %v", err)
+		}
+	}
+
+	// 4. 保存总结结果到本地缓存
+	if req.VideoPath != "" {
+		vp, err := NewVideoProcessor(req.VideoPath)
+		if err == nil {
+			summaryPath := filepath.Join(vp.OutputDir, outputFileName("summary", "", ""))
+			if data, err := json.MarshalIndent(rawResponse, "", "  "); err == nil {
+				os.WriteFile(summaryPath, data, 0644)
+				// 另存带模型名的版本 (summary.<model>.json)，便于对比不同模型的总结
+				os.WriteFile(filepath.Join(vp.OutputDir, outputFileName("summary", "", ai.config.Model)), data, 0644)
+				Info("AI总结已保存到: %s", summaryPath)
+			}
+			if len(rawResponse.Tags) > 0 {
+				tags := normalizeTags(append(loadTags(vp.OutputDir), rawResponse.Tags...))
+				if err := saveTags(vp.OutputDir, tags); err != nil {
+					Warn("%v", err)
+				}
+			}
+		}
+	}
+
+	return rawResponse, nil
+}
+
+// requestSummary 调用AI生成总结并提取主题标签；字幕过长时先分块总结 (map)，再对各块笔记做最终汇总 (reduce)
+// 最终汇总仍使用原提示词和标记要求，截图 (开启 Vision 时) 只随最终请求发送
+func (ai *AISummarizer) requestSummary(segments []DataSegment, screenshots []string, prompt, fullPrompt, fullText string) (AIResponse, error) {
+	chunkChars := ai.config.ChunkChars
+	if chunkChars <= 0 {
+		chunkChars = defaultSummaryChunkChars
+	}
+	if len(segments) > 0 && len([]rune(fullText)) > chunkChars {
+		notes, err := ai.summarizeChunks(segments, chunkChars)
+		if err != nil {
+			Error("AI分段总结失败: %v", err)
+			return AIResponse{}, err
+		}
+		fullPrompt = fmt.Sprintf("%s\n\n注意：视频较长，以下内容是按时间顺序分段整理的要点笔记，[[TIME: 秒数]] 为原视频中的时间，请据此汇总并保留时间定位。\n\n内容：\n%s", prompt, notes)
+	}
+
+	rawResponse, err := ai.callExternalAI(fullPrompt, screenshots)
+	if err != nil {
+		Error("AI总结请求失败: %v", err) // 新增日志
+		return rawResponse, err
+	}
+
+	rawResponse.Markdown, rawResponse.Tags = extractSummaryTags(rawResponse.Markdown)
+	return rawResponse, nil
+}
+
+// defaultSummaryChunkChars 未配置 ChunkChars 时分段总结每块的字符上限
+const defaultSummaryChunkChars = 12000
+
+// chunkSegments 按带时间戳文稿的字符数把片段切成若干块，每块不超过 maxChars (单个片段超长时独占一块)
+func chunkSegments(segments []DataSegment, maxChars int) [][]DataSegment {
+	var chunks [][]DataSegment
+	var current []DataSegment
+	size := 0
+	for _, seg := range segments {
+		length := len([]rune(buildTimedTranscript([]DataSegment{seg})))
+		if len(current) > 0 && size+length > maxChars {
+			chunks = append(chunks, current)
+			current, size = nil, 0
+		}
+		current = append(current, seg)
+		size += length
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// summarizeChunks 逐块提炼要点，返回按时间顺序拼接的各块笔记 (要点带 [[TIME: 秒数]])
+func (ai *AISummarizer) summarizeChunks(segments []DataSegment, chunkChars int) (string, error) {
+	chunks := chunkSegments(segments, chunkChars)
+	Info("字幕较长，分 %d 块总结后汇总", len(chunks))
+
+	var notes strings.Builder
+	for i, chunk := range chunks {
+		prompt := fmt.Sprintf(`下面是一段长视频字幕的第 %d/%d 部分（包含时间戳，格式为 [秒数s] 文本）。
+请提炼这一部分的要点：
+1. 保留关键概念、论点、步骤和案例，不要遗漏重要信息，也不要编造。
+2. 每个要点开头用 [[TIME: 秒数]] 标注其在视频中的时间，秒数直接使用字幕中的原始时间戳。
+3. 只输出要点列表，不要写开场白和结尾总结。
+
+字幕：
+%s`, i+1, len(chunks), buildTimedTranscript(chunk))
+
+		content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+		if err != nil {
+			return "", fmt.Errorf("第 %d/%d 块总结失败: %w", i+1, len(chunks), err)
+		}
+		start, end := chunk[0].StartTime, chunk[len(chunk)-1].EndTime
+		notes.WriteString(fmt.Sprintf("## 第 %d 部分 (%s - %s)\n\n%s\n\n", i+1, formatSRTTime(start)[:8], formatSRTTime(end)[:8], strings.TrimSpace(content)))
+		Info("分段总结完成 %d/%d", i+1, len(chunks))
+	}
+	return notes.String(), nil
+}
+
+// buildTimedTranscript 构建带时间戳的字幕文本，方便AI定位
+func buildTimedTranscript(segments []DataSegment) string {
+	var builder strings.Builder
+	for _, seg := range segments {
+		// 格式：[12.5s] 这是一段话。
+		builder.WriteString(fmt.Sprintf("[%.2fs] %s\n", seg.StartTime, seg.Text))
+	}
+	return builder.String()
+}
+
+var (
+	captureMarkerPattern = regexp.MustCompile(`\[\[CAPTURE:\s*([\d.]+)\s*\]\]`)
+	// 格式不对的截图标记 (如 [[CAPTURE: abc]])，直接去掉
+	badCaptureMarkerPattern = regexp.MustCompile(`\[\[CAPTURE:[^\]]*\]\]`)
+	timeMarkerPattern       = regexp.MustCompile(`\[\[TIME:\s*(\d+(?:\.\d+)?)s?\s*\]\]`)
+)
+
+// processScreenshots 解析Markdown中的截图标记并生成图片，同时把时间标记渲染为前端可点击跳转的 span
+// 一行中可以有多个标记，截图失败或格式不对的标记会被去掉
+func (ai *AISummarizer) processScreenshots(markdown string, videoPath string) (string, error) {
+	vp, err := NewVideoProcessor(videoPath)
+	if err != nil {
+		return markdown, err
+	}
+
+	markdown = captureMarkerPattern.ReplaceAllStringFunc(markdown, func(mark string) string {
+		seconds, err := strconv.ParseFloat(captureMarkerPattern.FindStringSubmatch(mark)[1], 64)
+		if err != nil {
+			Warn("无效的截图标记: %s", mark)
+			return ""
+		}
+		imgPath, err := vp.ExtractScreenshotAt(seconds)
+		if err != nil {
+			Warn("AI截图失败 (%.2fs): %v", seconds, err)
+			return ""
+		}
+
+		// 转换路径为 Web 可访问路径，无法映射时丢弃该截图，避免输出失效链接
+		webPath, err := toWebPath(imgPath)
+		if err != nil {
+			Warn("AI截图无法通过 Web 访问 (%.2fs): %v", seconds, err)
+			return ""
+		}
+
+		// 替换标记为 Markdown 图片
+		return fmt.Sprintf("\n![视频截图 %.2fs](%s)\n", seconds, webPath)
+	})
+	markdown = badCaptureMarkerPattern.ReplaceAllStringFunc(markdown, func(mark string) string {
+		Warn("无效的截图标记: %s", mark)
+		return ""
+	})
+
+	return renderTimeMarkers(markdown), nil
+}
+
+// renderTimeMarkers 把 [[TIME: 秒数]] 替换为前端可点击跳转的 <span class="time-marker">
+func renderTimeMarkers(markdown string) string {
+	return timeMarkerPattern.ReplaceAllStringFunc(markdown, func(mark string) string {
+		value := timeMarkerPattern.FindStringSubmatch(mark)[1]
+		seconds, _ := strconv.ParseFloat(value, 64)
+		return fmt.Sprintf(`<span class="time-marker" data-time="%s">⏱ %s</span>`, value, formatTimeFriendly(seconds))
+	})
+}
+
+// formatTimeFriendly 简短的时间显示 (如 45s、12m30s)，与前端一致
+func formatTimeFriendly(seconds float64) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%ds", int(seconds))
+	}
+	return fmt.Sprintf("%dm%ds", int(seconds)/60, int(seconds)%60)
+}
+
+// quoteSegmentCount 每个引用标记展开的字幕条数 (从标记时间所在的那条开始)
+const quoteSegmentCount = 2
+
+var (
+	quoteMarkerPattern = regexp.MustCompile(`\[\[QUOTE:\s*(\d+(?:\.\d+)?)s?\]\]`)
+	quoteBlockPattern  = regexp.MustCompile(`<details class="summary-quote"><summary>📖 原文 (.*?)</summary><blockquote>(.*?)</blockquote></details>`)
+)
+
+// processQuoteMarkers 把总结中的 [[QUOTE: 秒数]] 替换为可折叠展开的原文片段
+// 原文按时间从 segments 中查找 (取包含该时间的字幕，没有则取之后最近的一条)，找不到时去掉标记
+func processQuoteMarkers(markdown string, segments []DataSegment) string {
+	return quoteMarkerPattern.ReplaceAllStringFunc(markdown, func(mark string) string {
+		seconds, err := strconv.ParseFloat(quoteMarkerPattern.FindStringSubmatch(mark)[1], 64)
+		if err != nil {
+			return ""
+		}
+
+		index := -1
+		for i, seg := range segments {
+			if seconds < seg.EndTime || seconds <= seg.StartTime {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return ""
+		}
+
+		end := index + quoteSegmentCount
+		if end > len(segments) {
+			end = len(segments)
+		}
+		var texts []string
+		for _, seg := range segments[index:end] {
+			texts = append(texts, html.EscapeString(strings.TrimSpace(seg.Text)))
+		}
+
+		// 保持在同一行，避免打断所在的段落或列表项；summary 中的 [[TIME:]] 由前端渲染为可跳转的时间
+		return fmt.Sprintf(`<details class="summary-quote"><summary>📖 原文 [[TIME: %.2f]]</summary><blockquote>%s</blockquote></details>`,
+			segments[index].StartTime, strings.Join(texts, " "))
+	})
+}
+
+// NoteCard 笔记卡片：总结中的一个小节，关联视频时间点和截图
+type NoteCard struct {
+	Title      string  `json:"title"`
+	Content    string  `json:"content"`
+	Time       float64 `json:"time"`                 // 对应视频时间点(秒)
+	Screenshot string  `json:"screenshot,omitempty"` // 截图的 Web 路径
+}
+
+var (
+	// 时间标记：AI 输出的 [[TIME: 秒数]]，或 renderTimeMarkers 渲染后的 span
+	noteTimePattern  = regexp.MustCompile(`(?:\[\[TIME:\s*|<span class="time-marker" data-time=")(\d+(?:\.\d+)?)(?:s?\s*\]\]|">[^<]*</span>)\s*`)
+	noteImagePattern = regexp.MustCompile(`!\[[^\]]*\]\(([^)]+)\)`)
+)
+
+// BuildNoteCards 按 Markdown 标题把总结拆成笔记卡片
+// 时间取小节内第一个 [[TIME: 秒数]] 标记 (没有则沿用上一张卡片的时间)，截图取小节内第一张图片
+func BuildNoteCards(markdown string) []NoteCard {
+	cards := []NoteCard{}
+	var current *NoteCard
+	var content []string
+	lastTime := 0.0
+	timeFound := false
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		current.Content = strings.TrimSpace(strings.Join(content, "\n"))
+		if !timeFound {
+			current.Time = lastTime
+		}
+		lastTime = current.Time
+		if current.Content != "" {
+			cards = append(cards, *current)
+		}
+	}
+
+	for _, line := range strings.Split(markdown, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			flush()
+			current = &NoteCard{Title: strings.TrimSpace(strings.TrimLeft(trimmed, "#"))}
+			content = nil
+			timeFound = false
+			line = current.Title
+		} else if current == nil {
+			// 第一个标题之前的内容单独成卡
+			current = &NoteCard{Title: "概要"}
+		}
+
+		if match := noteTimePattern.FindStringSubmatch(line); match != nil && !timeFound {
+			current.Time, _ = strconv.ParseFloat(match[1], 64)
+			timeFound = true
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			current.Title = strings.TrimSpace(noteTimePattern.ReplaceAllString(current.Title, ""))
+			continue
+		}
+
+		if match := noteImagePattern.FindStringSubmatch(line); match != nil {
+			if current.Screenshot == "" {
+				current.Screenshot = match[1]
+			}
+			line = noteImagePattern.ReplaceAllString(line, "")
+		}
+		line = noteTimePattern.ReplaceAllString(line, "")
+		if strings.TrimSpace(line) != "" {
+			content = append(content, line)
+		}
+	}
+	flush()
+	return cards
+}
+
+// localSummarize 本地模拟总结
+func (ai *AISummarizer) localSummarize(text string, screenshots []string) (AIResponse, error) {
+	// 分割文本，提取关键句子
+	sentences := strings.Split(text, "。")
+	var points []string
+
+	for _, sentence := range sentences {
+		sentence = strings.TrimSpace(sentence)
+		if len(sentence) > 10 {
+			points = append(points, sentence)
+			if len(points) >= 5 {
+				break
+			}
+		}
+	}
+
+	if len(points) == 0 && len(text) > 0 {
+		points = append(points, text)
+	}
+
+	// 构建Markdown输出
+	var markdown bytes.Buffer
+	markdown.WriteString("# 视频总结\n\n")
+
+	screenshotInfo := ""
+	if len(screenshots) > 0 {
+		// 只显示截图文件名，不显示完整路径
+		var screenshotNames []string
+		for _, s := range screenshots {
+			screenshotNames = append(screenshotNames, filepath.Base(s))
+		}
+		screenshotInfo = fmt.Sprintf("\n> 视频截图：%s", strings.Join(screenshotNames, ", "))
+	}
+
+	markdown.WriteString(fmt.Sprintf("## 核心要点%s\n\n", screenshotInfo))
+	for i, point := range points {
+		markdown.WriteString(fmt.Sprintf("- **要点%d**：%s\n", i+1, point))
+	}
+
+	markdown.WriteString("\n## 详细总结\n\n")
+	markdown.WriteString(text)
+
+	return AIResponse{
+		Summary:  strings.Join(points, "；"),
+		Markdown: markdown.String(),
+		Points:   points,
+		Success:  true,
+	}, nil
+}
+
+// TextRank 参数
+const (
+	textRankDamping    = 0.85
+	textRankIterations = 50
+	textRankTolerance  = 1e-6
+	defaultKeySentence = 5
+)
+
+// ExtractKeySentences 用 TextRank 从识别结果中抽取 n 个最有代表性的句子，不调用 AI
+// 句子间相似度为共同词数 / (log|Si| + log|Sj|)，结果按原时间顺序返回并保留时间戳
+func ExtractKeySentences(segments []DataSegment, n int) []DataSegment {
+	if n <= 0 {
+		n = defaultKeySentence
+	}
+
+	// 过短的片段 (语气词、碎片) 不参与排序
+	type candidate struct {
+		index int
+		terms map[string]bool
+	}
+	var candidates []candidate
+	for i, seg := range segments {
+		terms := make(map[string]bool)
+		for _, term := range keyTerms(seg.Text) {
+			terms[term] = true
+		}
+		if len(terms) >= 2 {
+			candidates = append(candidates, candidate{index: i, terms: terms})
+		}
+	}
+	if len(candidates) <= n {
+		result := make([]DataSegment, 0, len(candidates))
+		for _, c := range candidates {
+			result = append(result, segments[c.index])
+		}
+		return result
+	}
+
+	// 相似度图用邻接表保存，只记录有共同词的句子对；通过 词 -> 句子 的倒排索引找出这些句子对，
+	// 长视频有上千个片段时也不需要 count×count 的矩阵
+	type edge struct {
+		to     int
+		weight float64
+	}
+	count := len(candidates)
+	neighbors := make([][]edge, count)
+	outSums := make([]float64, count)
+	termIndex := make(map[string][]int)
+	for i := 0; i < count; i++ {
+		common := make(map[int]int)
+		for term := range candidates[i].terms {
+			for _, j := range termIndex[term] {
+				common[j]++
+			}
+			termIndex[term] = append(termIndex[term], i)
+		}
+		for j, shared := range common {
+			w := float64(shared) / (math.Log(float64(len(candidates[i].terms))) + math.Log(float64(len(candidates[j].terms))))
+			neighbors[i] = append(neighbors[i], edge{to: j, weight: w})
+			neighbors[j] = append(neighbors[j], edge{to: i, weight: w})
+			outSums[i] += w
+			outSums[j] += w
+		}
+	}
+
+	scores := make([]float64, count)
+	for i := range scores {
+		scores[i] = 1
+	}
+	for iter := 0; iter < textRankIterations; iter++ {
+		next := make([]float64, count)
+		delta := 0.0
+		for i := 0; i < count; i++ {
+			sum := 0.0
+			for _, e := range neighbors[i] {
+				sum += e.weight / outSums[e.to] * scores[e.to]
+			}
+			next[i] = 1 - textRankDamping + textRankDamping*sum
+			delta += math.Abs(next[i] - scores[i])
+		}
+		scores = next
+		if delta < textRankTolerance {
+			break
+		}
+	}
+
+	order := make([]int, count)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	selected := order[:n]
+	sort.Ints(selected)
+
+	result := make([]DataSegment, 0, n)
+	for _, i := range selected {
+		result = append(result, segments[candidates[i].index])
+	}
+	return result
+}
+
+// keyTerms 切分出用于计算句子相似度的词：连续汉字取相邻两字组成的词，英文和数字按单词 (小写)
+func keyTerms(text string) []string {
+	var terms []string
+	var han []rune
+	var word strings.Builder
+	flush := func() {
+		if len(han) == 1 {
+			terms = append(terms, string(han))
+		}
+		for i := 0; i+1 < len(han); i++ {
+			terms = append(terms, string(han[i:i+2]))
+		}
+		han = han[:0]
+		if word.Len() > 1 {
+			terms = append(terms, word.String())
+		}
+		word.Reset()
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if word.Len() > 0 {
+				flush()
+			}
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(han) > 0 {
+				flush()
+			}
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// 关键词数量，未指定时返回 defaultKeywordCount 个
+const (
+	defaultKeywordCount = 10
+	maxKeywordCount     = 50
+	maxKeywordRunes     = 4 // 本地提取时汉字关键词的最大长度
+)
+
+// Keyword 字幕中的关键词/主题
+type Keyword struct {
+	Keyword    string  `json:"keyword"`
+	Score      float64 `json:"score"`       // 排序分数，AI 结果为相关度 (0-1)，本地结果为出现次数
+	FirstIndex int     `json:"first_index"` // 首次出现的字幕序号
+	FirstTime  float64 `json:"first_time"`  // 首次出现的时间点(秒)
+	Mentions   int     `json:"mentions"`    // 出现的字幕条数
+}
+
+var (
+	keywordTokenPattern = regexp.MustCompile(`\p{Han}+|[\p{L}\p{N}]+`)
+	// 关键词首尾不应出现的虚词
+	keywordStopRunes = "的了是在和与就都而及也还又把被这那我你他她它们个吗呢吧啊嗯哦呀么着过给让对从到说要会能有没不一"
+	keywordStopWords = map[string]bool{
+		"the": true, "and": true, "for": true, "that": true, "this": true, "with": true, "you": true,
+		"are": true, "was": true, "have": true, "not": true, "but": true, "what": true, "all": true,
+		"can": true, "our": true, "they": true, "from": true, "will": true, "just": true, "like": true,
+		"about": true, "there": true, "which": true, "their": true, "your": true, "has": true, "its": true,
+	}
+)
+
+// ExtractKeywords 提取 n 个关键词并按重要程度排序，附带首次出现的时间点
+// 未配置 API Key 时使用本地的词频统计
+func (ai *AISummarizer) ExtractKeywords(segments []DataSegment, n int) ([]Keyword, error) {
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	if n <= 0 {
+		n = defaultKeywordCount
+	}
+	if n > maxKeywordCount {
+		n = maxKeywordCount
+	}
+	if ai.config.APIKey == "" {
+		return localKeywords(segments, n), nil
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := fmt.Sprintf(`下面是一段视频的字幕，请提取最能代表视频内容的 %d 个关键词或主题词，用于给视频打标签和检索。
+要求：
+1. 关键词必须是字幕中原样出现过的词语，优先选择专业术语、核心概念和反复讨论的话题，不要选择口语化的泛泛词汇。
+2. 按重要程度从高到低排列，score 为 0-1 之间的相关度。
+3. 只输出 JSON 数组，格式为：[{"keyword": "机器学习", "score": 0.95}]
+
+字幕：
+`, n) + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Keyword
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		return nil, fmt.Errorf("解析关键词结果失败: %w", err)
+	}
+
+	keywords := []Keyword{}
+	seen := make(map[string]bool)
+	for _, keyword := range candidates {
+		keyword.Keyword = strings.TrimSpace(keyword.Keyword)
+		key := strings.ToLower(keyword.Keyword)
+		if keyword.Keyword == "" || seen[key] {
+			continue
+		}
+		// 出现位置在本地字幕中查找，字幕中没有的词丢弃
+		if !locateKeyword(&keyword, segments) {
+			continue
+		}
+		seen[key] = true
+		keywords = append(keywords, keyword)
+		if len(keywords) == n {
+			break
+		}
+	}
+	if len(keywords) == 0 {
+		return nil, fmt.Errorf("AI未生成可用的关键词")
+	}
+	return keywords, nil
+}
+
+// locateKeyword 在字幕中查找关键词 (英文不区分大小写)，填写首次出现位置和出现条数，找不到时返回 false
+func locateKeyword(keyword *Keyword, segments []DataSegment) bool {
+	needle := strings.ToLower(keyword.Keyword)
+	keyword.FirstIndex = -1
+	keyword.Mentions = 0
+	for i, seg := range segments {
+		if !strings.Contains(strings.ToLower(seg.Text), needle) {
+			continue
+		}
+		if keyword.FirstIndex < 0 {
+			keyword.FirstIndex = i
+			keyword.FirstTime = seg.StartTime
+		}
+		keyword.Mentions++
+	}
+	return keyword.FirstIndex >= 0
+}
+
+// localKeywords 不调用 AI，按词频提取关键词：汉字取 2-4 字的片段，英文和数字按单词
+// 较短的片段与包含它的较长片段出现次数相同时只保留较长的 (如 "机器学习" 不再拆出 "机器"、"学习")
+func localKeywords(segments []DataSegment, n int) []Keyword {
+	counts := make(map[string]int)
+	for _, seg := range segments {
+		for _, token := range keywordTokenPattern.FindAllString(strings.ToLower(seg.Text), -1) {
+			runes := []rune(token)
+			var grams []string
+			if unicode.Is(unicode.Han, runes[0]) {
+				for size := 2; size <= maxKeywordRunes; size++ {
+					for j := 0; j+size <= len(runes); j++ {
+						gram := runes[j : j+size]
+						if strings.ContainsRune(keywordStopRunes, gram[0]) || strings.ContainsRune(keywordStopRunes, gram[size-1]) {
+							continue
+						}
+						grams = append(grams, string(gram))
+					}
+				}
+			} else if len(runes) >= 3 && !keywordStopWords[token] {
+				grams = append(grams, token)
+			}
+
+			for _, gram := range grams {
+				counts[gram]++
+			}
+		}
+	}
+
+	// 去掉被较长片段完全覆盖的短片段
+	subsumed := make(map[string]bool)
+	for gram, count := range counts {
+		runes := []rune(gram)
+		for size := 2; size < len(runes); size++ {
+			for j := 0; j+size <= len(runes); j++ {
+				if part := string(runes[j : j+size]); counts[part] == count {
+					subsumed[part] = true
+				}
+			}
+		}
+	}
+
+	var keywords []Keyword
+	for gram, count := range counts {
+		if count < 2 || subsumed[gram] {
+			continue
+		}
+		keyword := Keyword{Keyword: gram, Score: float64(count)}
+		locateKeyword(&keyword, segments)
+		keywords = append(keywords, keyword)
+	}
+
+	sort.Slice(keywords, func(i, j int) bool {
+		if keywords[i].Score != keywords[j].Score {
+			return keywords[i].Score > keywords[j].Score
+		}
+		if len(keywords[i].Keyword) != len(keywords[j].Keyword) {
+			return len(keywords[i].Keyword) > len(keywords[j].Keyword)
+		}
+		return keywords[i].FirstIndex < keywords[j].FirstIndex
+	})
+	if len(keywords) > n {
+		keywords = keywords[:n]
+	}
+	if keywords == nil {
+		keywords = []Keyword{}
+	}
+	return keywords
+}
+
+// Chat 进行AI对话
+func (ai *AISummarizer) Chat(req ChatRequest) (string, error) {
+	// 设置默认值
+	ai.applyDefaults()
+
+	// 发送请求
+	return ai.sendChatRequest(ai.chatMessages(req))
+}
+
+// ChatStream 流式对话，每收到一段增量文本就回调 onDelta，返回完整回复
+func (ai *AISummarizer) ChatStream(ctx context.Context, req ChatRequest, onDelta func(delta string)) (string, error) {
+	ai.applyDefaults()
+	return ai.sendChatStream(ctx, ai.chatMessages(req), onDelta)
+}
+
+// chatMessages 构建对话的消息列表：系统提示词 (含上下文) + 历史记录 + 当前问题
+func (ai *AISummarizer) chatMessages(req ChatRequest) []map[string]string {
+	// 构建消息列表
+	var messages []map[string]string
+
+	// 系统提示词 (更新)
+	systemPrompt := `你是一位专业的AI导师。用户会根据一段视频的内容向你提问。
+请基于提供的[上下文内容]回答用户的问题。
+回答要求：
+1. 像老师一样循循善诱，解答疑惑，语言通俗易懂。
+2. 如果上下文中没有答案，请利用你的通用知识回答，并说明这一点。`
+
+	if req.Context != "" {
+		systemPrompt += fmt.Sprintf("\n\n[上下文内容]：\n%s", req.Context)
+	}
+
+	messages = append(messages, map[string]string{"role": "system", "content": systemPrompt})
+
+	// 添加历史记录
+	if len(req.History) > 0 {
+		messages = append(messages, req.History...)
+	}
+
+	// 添加当前问题
+	messages = append(messages, map[string]string{"role": "user", "content": req.Message})
+	return messages
+}
+
+// sendChatRequest 发送通用聊天请求
+func (ai *AISummarizer) sendChatRequest(messages []map[string]string) (string, error) {
+	messages, _ = ai.fitContext(messages)
+	return ai.postChatBody(ai.chatRequestBody(messages, false))
+}
+
+// sendVisionRequest 发送带图片的请求 (OpenAI 兼容的多模态格式)，images 为 data URL
+func (ai *AISummarizer) sendVisionRequest(prompt string, images []string) (string, error) {
+	parts := []map[string]interface{}{{"type": "text", "text": prompt}}
+	for _, image := range images {
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]string{"url": image},
+		})
+	}
+
+	body := ai.chatRequestBody(nil, false)
+	body["messages"] = []map[string]interface{}{{"role": "user", "content": parts}}
+	return ai.postChatBody(body)
+}
+
+// postChatBody 发送非流式请求并返回回复内容，开启 ResponseCache 时相同请求体直接命中缓存
+func (ai *AISummarizer) postChatBody(requestBody map[string]interface{}) (string, error) {
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("JSON编码失败: %w", err)
+	}
+
+	// 相同的 model + messages + 参数 直接命中本地缓存
+	cacheKey := fmt.Sprintf("AIChat_%x", md5.Sum(jsonData))
+	if ai.config.ResponseCache {
+		if content, ok := ai.loadResponseCache(cacheKey); ok {
+			Info("AI响应命中缓存: %s", cacheKey)
+			return content, nil
+		}
+	}
+
+	req, err := http.NewRequest("POST", ai.config.APIURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ai.config.APIKey)
+
+	// 使用带代理的客户端 (如果需要AI也走代理，可以使用 getHTTPClient，这里暂时保持直连或根据需求修改)
+	// 考虑到国内访问OpenAI等可能需要代理，这里也统一使用代理
+	client := getHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("API请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("读取响应失败: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API错误 (状态码 %d): %s", resp.StatusCode, string(body))
+	}
+
+	content, err := parseChatResponse(body)
+	if err != nil {
+		return "", err
+	}
+	if ai.config.ResponseCache {
+		ai.saveResponseCache(cacheKey, content)
+	}
+	return content, nil
+}
+
+// chatRequestBody 构建 OpenAI 兼容接口的请求体，未设置的采样参数不写入
+func (ai *AISummarizer) chatRequestBody(messages []map[string]string, stream bool) map[string]interface{} {
+	body := map[string]interface{}{
+		"model":    ai.config.Model,
+		"messages": messages,
+		"stream":   stream,
+	}
+	if ai.config.Temperature != 0 {
+		body["temperature"] = ai.config.Temperature
+	}
+	if ai.config.MaxTokens > 0 {
+		body["max_tokens"] = ai.config.MaxTokens
+	}
+	if ai.config.TopP != 0 {
+		body["top_p"] = ai.config.TopP
+	}
+	return body
+}
+
+// parseChatResponse 解析 OpenAI 兼容接口的非流式响应
+func parseChatResponse(body []byte) (string, error) {
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("解析响应失败: %w", err)
+	}
+
+	if len(result.Choices) == 0 {
+		if result.Error.Message != "" {
+			return "", fmt.Errorf("API返回错误: %s", result.Error.Message)
+		}
+		return "", fmt.Errorf("API返回结果为空")
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+// sendChatStream 以 stream: true 发送聊天请求，逐行解析 data: 分块并回调增量文本
+// 遇到 [DONE] 结束，无法解析的分块跳过；接口不支持流式而返回普通 JSON 时整段回调一次
+// 流式结果不写入响应缓存
+func (ai *AISummarizer) sendChatStream(ctx context.Context, messages []map[string]string, onDelta func(delta string)) (string, error) {
+	messages, _ = ai.fitContext(messages)
+	jsonData, err := json.Marshal(ai.chatRequestBody(messages, true))
+	if err != nil {
+		return "", fmt.Errorf("JSON编码失败: %w", err)
+	}
+
+	// 回答可能持续数分钟，不设总超时；超过 streamIdleTimeout 没有收到数据时取消
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ai.config.APIURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+ai.config.APIKey)
+
+	resp, err := getStreamHTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("API请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("API错误 (状态码 %d): %s", resp.StatusCode, string(body))
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("读取响应失败: %w", err)
+		}
+		content, err := parseChatResponse(body)
+		if err != nil {
+			return "", err
+		}
+		if onDelta != nil {
+			onDelta(content)
+		}
+		return content, nil
+	}
+
+	var reply strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(streamIdleTimeout)
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			Warn("跳过无法解析的流式分块: %s", payload)
+			continue
+		}
+		if chunk.Error.Message != "" {
+			return reply.String(), fmt.Errorf("API返回错误: %s", chunk.Error.Message)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			reply.WriteString(choice.Delta.Content)
+			if onDelta != nil {
+				onDelta(choice.Delta.Content)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return reply.String(), fmt.Errorf("读取流式响应失败: %w", err)
+	}
+	return reply.String(), nil
+}
+
+// 上下文长度保护：仅在配置了 MaxContextTokens 时生效，并预留 reservedOutputTokens (配置了 MaxTokens 时按 MaxTokens) 给输出
+const reservedOutputTokens = 4000
+
+// estimateTokens 粗略估算 token 数：汉字等 CJK 字符约 1 token，其他字符约 4 个 1 token
+func estimateTokens(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+3)/4
+}
+
+// fitContext 估算的 token 数超过模型上限时截断最长的一条消息 (通常是字幕原文)：
+// 保留开头和结尾，中间替换为省略说明，返回截断后的消息和是否发生截断
+// 未配置 MaxContextTokens 时不截断，原样发送
+func (ai *AISummarizer) fitContext(messages []map[string]string) ([]map[string]string, bool) {
+	limit := ai.config.MaxContextTokens
+	if limit <= 0 {
+		return messages, false
+	}
+	reserved := reservedOutputTokens
+	if ai.config.MaxTokens > 0 {
+		reserved = ai.config.MaxTokens
+	}
+	budget := limit - reserved
+	if budget <= 0 {
+		budget = limit / 2
+	}
+
+	total, longest := 0, -1
+	for i, message := range messages {
+		tokens := estimateTokens(message["content"])
+		total += tokens
+		if longest < 0 || tokens > estimateTokens(messages[longest]["content"]) {
+			longest = i
+		}
+	}
+	if total <= budget || longest < 0 {
+		return messages, false
+	}
+
+	content := messages[longest]["content"]
+	contentTokens := estimateTokens(content)
+	// 扣除省略说明本身占用的 token，保证截断后不再超限
+	keepTokens := budget - (total - contentTokens) - 50
+	runes := []rune(content)
+	// 按该消息的平均字符/token 比例换算可保留的字符数
+	keepRunes := int(float64(len(runes)) * float64(keepTokens) / float64(contentTokens))
+	if keepRunes <= 0 {
+		Warn("AI请求超出模型上下文上限 (约 %d tokens，上限 %d)，且无法通过截断缩短", total, limit)
+		return messages, false
+	}
+
+	head := keepRunes / 2
+	tail := keepRunes - head
+	omitted := len(runes) - keepRunes
+	truncated := string(runes[:head]) +
+		fmt.Sprintf("\n\n……（中间约 %d 字超出模型上下文上限，已省略）……\n\n", omitted) +
+		string(runes[len(runes)-tail:])
+
+	result := make([]map[string]string, len(messages))
+	for i, message := range messages {
+		copied := make(map[string]string, len(message))
+		for k, v := range message {
+			copied[k] = v
+		}
+		result[i] = copied
+	}
+	result[longest]["content"] = truncated
+
+	Warn("AI请求约 %d tokens，超过模型上下文上限 %d (预留 %d 用于输出)，已省略中间约 %d 字", total, limit, reserved, omitted)
+	return result, true
+}
+
+// loadResponseCache 读取AI响应缓存，超过TTL视为未命中
+func (ai *AISummarizer) loadResponseCache(cacheKey string) (string, bool) {
+	cachePath := filepath.Join(AICacheDir, cacheKey+".json")
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		return "", false
+	}
+
+	if ai.config.ResponseCacheTTL > 0 &&
+		time.Since(info.ModTime()) > time.Duration(ai.config.ResponseCacheTTL)*time.Minute {
+		return "", false
+	}
+
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		Warn("读取AI缓存失败: %v", err)
+		return "", false
+	}
+
+	var cached struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		Warn("解析AI缓存失败: %v", err)
+		return "", false
+	}
+	return cached.Content, true
+}
+
+// saveResponseCache 保存AI响应缓存
+func (ai *AISummarizer) saveResponseCache(cacheKey string, content string) {
+	if err := os.MkdirAll(AICacheDir, 0755); err != nil {
+		Warn("创建AI缓存目录失败: %v", err)
+		return
+	}
+
+	data, _ := json.Marshal(map[string]string{"content": content})
+	if err := os.WriteFile(filepath.Join(AICacheDir, cacheKey+".json"), data, 0644); err != nil {
+		Warn("写入AI缓存失败: %v", err)
+	}
+}
+
+// summaryCacheKey 生成AI总结缓存键：对影响总结结果的完整请求取 md5，
+// 包括接口地址、模型、采样参数、分块/截断设置、最终提示词、文稿，以及随请求发送的截图内容
+func (ai *AISummarizer) summaryCacheKey(prompt, text string, screenshots []string) string {
+	chunkChars := ai.config.ChunkChars
+	if chunkChars <= 0 {
+		chunkChars = defaultSummaryChunkChars
+	}
+
+	hash := md5.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%g\x00%g\x00%d\x00%d\x00%d\x00",
+		ai.config.APIURL, ai.config.Model, ai.config.Temperature, ai.config.TopP,
+		ai.config.MaxTokens, chunkChars, ai.config.MaxContextTokens)
+	hash.Write([]byte(prompt))
+	hash.Write([]byte{0})
+	hash.Write([]byte(text))
+	for _, path := range ai.visionScreenshots(screenshots) {
+		// 截图按内容参与缓存键，重新截图后缓存失效
+		fingerprint, err := contentFingerprint(path)
+		if err != nil {
+			fingerprint = path
+		}
+		hash.Write([]byte{0})
+		hash.Write([]byte(fingerprint))
+	}
+	return fmt.Sprintf("AISummary_%s", hex.EncodeToString(hash.Sum(nil)))
+}
+
+// loadSummaryCache 读取AI总结缓存，超过TTL视为未命中
+func (ai *AISummarizer) loadSummaryCache(cacheKey string) (AIResponse, bool) {
+	cachePath := filepath.Join(AICacheDir, cacheKey+".json")
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		return AIResponse{}, false
+	}
+
+	if ai.config.ResponseCacheTTL > 0 &&
+		time.Since(info.ModTime()) > time.Duration(ai.config.ResponseCacheTTL)*time.Minute {
+		Info("AI总结缓存已过期: %s", cachePath)
+		return AIResponse{}, false
+	}
+
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		Warn("读取AI总结缓存失败: %v", err)
+		return AIResponse{}, false
+	}
+
+	var response AIResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		Warn("解析AI总结缓存失败: %v", err)
+		return AIResponse{}, false
+	}
+	return response, true
+}
+
+// saveSummaryCache 保存AI总结缓存 (截图处理前的原始结果)
+func (ai *AISummarizer) saveSummaryCache(cacheKey string, response AIResponse) {
+	if err := os.MkdirAll(AICacheDir, 0755); err != nil {
+		Warn("创建AI缓存目录失败: %v", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		Warn("序列化AI总结缓存失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(AICacheDir, cacheKey+".json"), data, 0644); err != nil {
+		Warn("写入AI总结缓存失败: %v", err)
+	}
+}
+
+// extractJSON 从AI回复中截取JSON部分 (去除 ```json 代码块和前后说明文字)
+func extractJSON(content string) string {
+	start := strings.IndexAny(content, "[{")
+	if start == -1 {
+		return content
+	}
+	closing := "]"
+	if content[start] == '{' {
+		closing = "}"
+	}
+	end := strings.LastIndex(content, closing)
+	if end < start {
+		return content
+	}
+	return content[start : end+1]
+}
+
+// Repunctuate 用AI为无标点的识别结果恢复标点并重新断句，按字数映射回时间轴
+func (ai *AISummarizer) Repunctuate(segments []DataSegment) ([]DataSegment, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := `你是一位专业的字幕校对员。下面是语音识别得到的文本，缺少标点且断句不合理。
+请为其添加正确的标点符号，并按完整语义重新断句。
+要求：
+1. 不要增删、改写任何文字，只添加标点和调整断句。
+2. 以 JSON 字符串数组输出，每个元素为一句，不要输出其他内容。
+
+文本：
+` + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var sentences []string
+	if err := json.Unmarshal([]byte(extractJSON(content)), &sentences); err != nil {
+		return nil, fmt.Errorf("解析AI断句结果失败: %w", err)
+	}
+
+	return alignSentencesToSegments(sentences, segments), nil
+}
+
+// alignSentencesToSegments 按有效字数 (不含空白和标点) 把重新断句的文本映射回原时间轴
+func alignSentencesToSegments(sentences []string, segments []DataSegment) []DataSegment {
+	// charOffsets[i] 为第 i 个原始片段之前的累计字数
+	charOffsets := make([]int, len(segments)+1)
+	for i, seg := range segments {
+		charOffsets[i+1] = charOffsets[i] + countContentRunes(seg.Text)
+	}
+	total := charOffsets[len(segments)]
+
+	// timeAt 返回第 pos 个字符边界对应的时间，在所在片段内线性插值
+	timeAt := func(pos int) float64 {
+		if pos >= total {
+			return segments[len(segments)-1].EndTime
+		}
+		i := sort.Search(len(segments), func(i int) bool { return charOffsets[i+1] > pos })
+		seg := segments[i]
+		count := charOffsets[i+1] - charOffsets[i]
+		return seg.StartTime + (seg.EndTime-seg.StartTime)*float64(pos-charOffsets[i])/float64(count)
+	}
+
+	result := make([]DataSegment, 0, len(sentences))
+	pos := 0
+	for _, sentence := range sentences {
+		sentence = strings.TrimSpace(sentence)
+		count := countContentRunes(sentence)
+		if sentence == "" || count == 0 {
+			continue
+		}
+		result = append(result, DataSegment{
+			Text:      sentence,
+			StartTime: timeAt(pos),
+			EndTime:   timeAt(pos + count),
+		})
+		pos += count
+	}
+	return result
+}
+
+// countContentRunes 统计不含空白和标点的字符数
+func countContentRunes(text string) int {
+	return len([]rune(normalizeCommandText(text)))
+}
+
+// translateBatchSize 翻译字幕时每次请求包含的片段数
+const translateBatchSize = 40
+
+// TranslateSegments 用AI把字幕翻译成 targetLang，按批请求以减少调用次数
+// 返回的片段与原片段一一对应并保留原时间轴，某条未返回译文时保留原文
+func (ai *AISummarizer) TranslateSegments(segments []DataSegment, targetLang string) ([]DataSegment, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	type item struct {
+		Index int    `json:"i"`
+		Text  string `json:"text"`
+	}
+
+	translated := make([]DataSegment, len(segments))
+	copy(translated, segments)
+	missing := 0
+	for start := 0; start < len(segments); start += translateBatchSize {
+		end := start + translateBatchSize
+		if end > len(segments) {
+			end = len(segments)
+		}
+
+		batch := make([]item, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, item{Index: i, Text: segments[i].Text})
+		}
+		input, _ := json.Marshal(batch)
+
+		prompt := fmt.Sprintf(`你是一位专业的字幕翻译。请把下面 JSON 数组中每条字幕的 text 翻译成目标语言：%s。
+要求：
+1. 逐条翻译，不要合并或拆分条目，保持 i 不变，条目数量必须与输入一致。
+2. 结合上下文保证译文连贯、符合目标语言的表达习惯，专有名词保持一致。
+3. 只输出 JSON 数组，格式与输入相同：[{"i": 0, "text": "译文"}]
+
+字幕：
+%s`, targetLang, string(input))
+
+		content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+		if err != nil {
+			return nil, fmt.Errorf("翻译第 %d-%d 条失败: %w", start+1, end, err)
+		}
+
+		var results []item
+		if err := json.Unmarshal([]byte(extractJSON(content)), &results); err != nil {
+			return nil, fmt.Errorf("解析翻译结果失败 (第 %d-%d 条): %w", start+1, end, err)
+		}
+
+		done := make(map[int]bool, len(results))
+		for _, result := range results {
+			text := strings.TrimSpace(result.Text)
+			if result.Index < start || result.Index >= end || text == "" {
+				continue
+			}
+			translated[result.Index].Text = text
+			done[result.Index] = true
+		}
+		missing += (end - start) - len(done)
+	}
+
+	if missing > 0 {
+		Warn("有 %d 条字幕未返回译文，已保留原文", missing)
+	}
+	return translated, nil
+}
+
+// GenerateScript 让AI把口语化的字幕完整改写成书面文稿 (Markdown)
+// 与要点总结不同，这里保留全部核心信息，只去除口水话并补充逻辑衔接
+func (ai *AISummarizer) GenerateScript(segments []DataSegment) (string, error) {
+	if ai.config.APIKey == "" {
+		return "", fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := `你是一位专业的文字编辑。下面是一段视频的语音识别字幕，内容口语化、有重复和口头禅。
+请把它完整改写成一篇结构清晰的书面文章/脚本。
+要求：
+1. 保留所有核心信息、观点、数据和例子，不要压缩成要点摘要。
+2. 删除口头禅、重复和无意义的语气词（如「嗯」「那个」「就是说」）。
+3. 补充必要的逻辑连接词，使段落之间过渡自然。
+4. 按内容划分小节并加上小标题。
+5. 使用 Markdown 格式输出，不要输出其他说明。
+
+字幕：
+` + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(content), nil
+}
+
+// Acronym 术语表条目
+type Acronym struct {
+	Term        string  `json:"term"`
+	FullName    string  `json:"full_name"`
+	Description string  `json:"description,omitempty"`
+	FirstIndex  int     `json:"first_index"` // 首次出现的字幕序号
+	FirstTime   float64 `json:"first_time"`  // 首次出现的时间点(秒)
+}
+
+// AnnotateAcronyms 让AI识别字幕中的缩写及其全称，在每个缩写首次出现处标注全称
+// 返回标注后的字幕副本和按出现顺序排列的术语表，字幕中找不到的缩写会被丢弃
+func (ai *AISummarizer) AnnotateAcronyms(segments []DataSegment) ([]DataSegment, []Acronym, error) {
+	if ai.config.APIKey == "" {
+		return nil, nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := `下面是一段技术视频的字幕，请找出其中出现的英文缩写（如 API、GPU、RAG）。
+要求：
+1. term 必须与字幕中的写法完全一致，不要列出字幕里没有的缩写。
+2. full_name 为英文全称，description 为一句简短的中文解释。
+3. 只输出 JSON 数组，格式为：[{"term": "API", "full_name": "Application Programming Interface", "description": "应用程序编程接口"}]
+
+字幕：
+` + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []Acronym
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		return nil, nil, fmt.Errorf("解析缩写结果失败: %w", err)
+	}
+
+	annotated := make([]DataSegment, len(segments))
+	copy(annotated, segments)
+	glossary := []Acronym{}
+	seen := make(map[string]bool)
+	for _, acronym := range candidates {
+		acronym.Term = strings.TrimSpace(acronym.Term)
+		acronym.FullName = strings.TrimSpace(acronym.FullName)
+		if acronym.Term == "" || acronym.FullName == "" || seen[acronym.Term] {
+			continue
+		}
+		for i, seg := range annotated {
+			pos := indexWholeWord(seg.Text, acronym.Term)
+			if pos < 0 {
+				continue
+			}
+			end := pos + len(acronym.Term)
+			annotated[i].Text = seg.Text[:end] + "（" + acronym.FullName + "）" + seg.Text[end:]
+			acronym.FirstIndex = i
+			acronym.FirstTime = seg.StartTime
+			glossary = append(glossary, acronym)
+			seen[acronym.Term] = true
+			break
+		}
+	}
+
+	sort.SliceStable(glossary, func(i, j int) bool { return glossary[i].FirstIndex < glossary[j].FirstIndex })
+	return annotated, glossary, nil
+}
+
+// 候选标题数量，未指定时生成 defaultTitleCount 个
+const (
+	defaultTitleCount = 5
+	maxTitleCount     = 20
+)
+
+// GenerateTitles 根据字幕内容生成 n 个候选视频标题
+func (ai *AISummarizer) GenerateTitles(segments []DataSegment, n int) ([]string, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	if n <= 0 {
+		n = defaultTitleCount
+	}
+	if n > maxTitleCount {
+		n = maxTitleCount
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := fmt.Sprintf(`下面是一段视频的字幕，请为这个视频拟 %d 个发布用的标题。
+要求：
+1. 标题要准确概括视频内容，同时足够吸引人点击，但不要夸大或编造字幕中没有的信息。
+2. 每个标题不超过 30 个字，风格可以有所不同（如提问式、数字式、干货总结式）。
+3. 只输出 JSON 字符串数组，格式为：["标题一", "标题二"]
+
+字幕：
+`, n) + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		return nil, fmt.Errorf("解析标题结果失败: %w", err)
+	}
+
+	titles := []string{}
+	seen := make(map[string]bool)
+	for _, title := range candidates {
+		title = strings.TrimSpace(title)
+		if title == "" || seen[title] {
+			continue
+		}
+		seen[title] = true
+		titles = append(titles, title)
+		if len(titles) == n {
+			break
+		}
+	}
+	if len(titles) == 0 {
+		return nil, fmt.Errorf("AI未生成可用的标题")
+	}
+	return titles, nil
+}
+
+// 实体类型
+const (
+	EntityPerson       = "person"
+	EntityPlace        = "place"
+	EntityOrganization = "organization"
+)
+
+// Entity 字幕中提到的人名、地名、机构
+type Entity struct {
+	Type        string  `json:"type"` // person / place / organization
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	FirstIndex  int     `json:"first_index"` // 首次出现的字幕序号
+	FirstTime   float64 `json:"first_time"`  // 首次出现的时间点(秒)
+	Mentions    int     `json:"mentions"`    // 出现的字幕条数
+}
+
+// ExtractEntities 让AI识别字幕中的人名、地名和机构，按首次出现顺序返回
+// 出现位置在本地字幕中查找，字幕中找不到的实体会被丢弃
+func (ai *AISummarizer) ExtractEntities(segments []DataSegment) ([]Entity, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	var textBuilder strings.Builder
+	for _, seg := range segments {
+		textBuilder.WriteString(seg.Text)
+		textBuilder.WriteString("\n")
+	}
+
+	prompt := `下面是一段视频的字幕，请找出其中提到的人名、地名和机构名称。
+要求：
+1. name 必须与字幕中的写法完全一致，不要列出字幕里没有的实体，同一实体只列一次。
+2. type 只能是 person（人名）、place（地名）、organization（机构/公司/组织）之一。
+3. description 为一句简短的中文说明（如身份、所在地区、机构性质），不确定时留空。
+4. 只输出 JSON 数组，格式为：[{"type": "person", "name": "张三", "description": "某大学教授"}]
+
+字幕：
+` + textBuilder.String()
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Entity
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		return nil, fmt.Errorf("解析实体结果失败: %w", err)
+	}
+
+	entities := []Entity{}
+	seen := make(map[string]bool)
+	for _, entity := range candidates {
+		entity.Type = strings.ToLower(strings.TrimSpace(entity.Type))
+		entity.Name = strings.TrimSpace(entity.Name)
+		if entity.Name == "" || seen[entity.Type+"|"+entity.Name] {
+			continue
+		}
+		if entity.Type != EntityPerson && entity.Type != EntityPlace && entity.Type != EntityOrganization {
+			continue
+		}
+
+		entity.FirstIndex = -1
+		entity.Mentions = 0
+		for i, seg := range segments {
+			if !strings.Contains(seg.Text, entity.Name) {
+				continue
+			}
+			if entity.FirstIndex < 0 {
+				entity.FirstIndex = i
+				entity.FirstTime = seg.StartTime
+			}
+			entity.Mentions++
+		}
+		if entity.FirstIndex < 0 {
+			continue
+		}
+		seen[entity.Type+"|"+entity.Name] = true
+		entities = append(entities, entity)
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool { return entities[i].FirstIndex < entities[j].FirstIndex })
+	return entities, nil
+}
+
+// 测验题数量，未指定时生成 defaultQuizCount 道
+const (
+	defaultQuizCount = 3
+	maxQuizCount     = 10
+)
+
+// QuizQuestion 课后选择题
+type QuizQuestion struct {
+	Question    string   `json:"question"`
+	Options     []string `json:"options"`               // 选项内容，按 A/B/C/D 顺序
+	Answer      string   `json:"answer"`                // 正确选项的字母，如 "B"
+	Explanation string   `json:"explanation,omitempty"` // 答案解析
+}
+
+// GenerateQuiz 根据视频内容生成 n 道选择题
+// 模型回复无法解析为题目时返回原始文本 (题目为空)，由前端直接展示
+func (ai *AISummarizer) GenerateQuiz(text string, n int) ([]QuizQuestion, string, error) {
+	if ai.config.APIKey == "" {
+		return nil, "", fmt.Errorf("未配置AI API Key")
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, "", fmt.Errorf("没有可出题的内容")
+	}
+	if n <= 0 {
+		n = defaultQuizCount
+	}
+	if n > maxQuizCount {
+		n = maxQuizCount
+	}
+	ai.applyDefaults()
+
+	prompt := fmt.Sprintf(`下面是一段视频的内容，请根据其中的知识点出 %d 道课后选择题，帮助学习者巩固知识。
+要求：
+1. 题目只考查内容中出现的知识点，每题 4 个选项且只有一个正确答案，干扰项要有一定迷惑性。
+2. options 只写选项内容，不要加 A. B. 等前缀；answer 为正确选项的字母（A/B/C/D）。
+3. explanation 用一两句话说明为什么这个答案正确。
+4. 只输出 JSON 数组，格式为：[{"question": "问题", "options": ["选项一", "选项二", "选项三", "选项四"], "answer": "A", "explanation": "解析"}]
+
+内容：
+`, n) + text
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var candidates []QuizQuestion
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		Warn("解析测验题失败，返回原始文本: %v", err)
+		return nil, content, nil
+	}
+
+	questions := []QuizQuestion{}
+	for _, q := range candidates {
+		q.Question = strings.TrimSpace(q.Question)
+		q.Answer = strings.ToUpper(strings.TrimSpace(q.Answer))
+		if q.Question == "" || len(q.Options) < 2 || len(q.Answer) != 1 {
+			continue
+		}
+		if index := int(q.Answer[0] - 'A'); index < 0 || index >= len(q.Options) {
+			continue
+		}
+		questions = append(questions, q)
+		if len(questions) == n {
+			break
+		}
+	}
+	if len(questions) == 0 {
+		return nil, content, nil
+	}
+	return questions, "", nil
+}
+
+// indexWholeWord 查找完整单词首次出现的位置，避免把 "AI" 匹配到 "EMAIL" 里
+func indexWholeWord(text, word string) int {
+	for start := 0; start < len(text); {
+		pos := strings.Index(text[start:], word)
+		if pos < 0 {
+			return -1
+		}
+		pos += start
+		end := pos + len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:pos])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (pos == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after)) {
+			return pos
+		}
+		start = pos + 1
+	}
+	return -1
+}
+
+// formatGlossaryMarkdown 把术语表导出为 Markdown 附录
+func formatGlossaryMarkdown(glossary []Acronym) string {
+	var builder strings.Builder
+	builder.WriteString("## 术语表\n\n| 缩写 | 全称 | 说明 | 首次出现 |\n| --- | --- | --- | --- |\n")
+	for _, acronym := range glossary {
+		builder.WriteString(fmt.Sprintf("| %s | %s | %s | %s |\n",
+			acronym.Term, acronym.FullName, acronym.Description, formatSRTTime(acronym.FirstTime)[:8]))
+	}
+	return builder.String()
+}
+
+// MindmapNode 思维导图节点
+type MindmapNode struct {
+	Title    string         `json:"title"`
+	Time     float64        `json:"time"` // 对应视频时间点(秒)
+	Children []*MindmapNode `json:"children,omitempty"`
+}
+
+// GenerateMindmap 让AI把视频内容整理成带时间点的层级结构
+func (ai *AISummarizer) GenerateMindmap(segments []DataSegment) (*MindmapNode, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	prompt := `请根据以下带时间戳的视频字幕，把视频内容整理成一棵思维导图。
+要求：
+1. 根节点为视频主题，向下按逻辑分为若干主题、子主题，层级不超过4层。
+2. 每个节点的 time 为该内容在视频中开始讲解的秒数。
+3. 只输出 JSON，格式为：{"title": "...", "time": 0, "children": [{"title": "...", "time": 12.5, "children": []}]}
+
+字幕：
+` + buildTimedTranscript(segments)
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var root MindmapNode
+	if err := json.Unmarshal([]byte(extractJSON(content)), &root); err != nil {
+		return nil, fmt.Errorf("解析思维导图失败: %w", err)
+	}
+	return &root, nil
+}
+
+// formatMindmapMarkmap 导出为 markmap 可渲染的 Markdown 标题层级
+func formatMindmapMarkmap(root *MindmapNode) string {
+	var builder strings.Builder
+	var walk func(node *MindmapNode, depth int)
+	walk = func(node *MindmapNode, depth int) {
+		if depth <= 6 {
+			builder.WriteString(strings.Repeat("#", depth) + " ")
+		} else {
+			builder.WriteString(strings.Repeat("  ", depth-7) + "- ")
+		}
+		builder.WriteString(fmt.Sprintf("%s (%s)\n", node.Title, formatSRTTime(node.Time)[:8]))
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	walk(root, 1)
+	return builder.String()
+}
+
+// formatMindmapFreemind 导出为 FreeMind (.mm) XML
+func formatMindmapFreemind(root *MindmapNode) string {
+	var builder strings.Builder
+	builder.WriteString(`<map version="1.0.1">` + "\n")
+	var walk func(node *MindmapNode, depth int)
+	walk = func(node *MindmapNode, depth int) {
+		var title bytes.Buffer
+		xml.EscapeText(&title, []byte(fmt.Sprintf("%s (%s)", node.Title, formatSRTTime(node.Time)[:8])))
+		indent := strings.Repeat("  ", depth)
+		if len(node.Children) == 0 {
+			builder.WriteString(fmt.Sprintf("%s<node TEXT=\"%s\"/>\n", indent, title.String()))
+			return
+		}
+		builder.WriteString(fmt.Sprintf("%s<node TEXT=\"%s\">\n", indent, title.String()))
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+		builder.WriteString(indent + "</node>\n")
+	}
+	walk(root, 1)
+	builder.WriteString("</map>\n")
+	return builder.String()
+}
+
+// GenerateChapters 让AI按内容逻辑划分章节，开始时间对齐到最近的字幕开头
+func (ai *AISummarizer) GenerateChapters(segments []DataSegment) ([]Chapter, error) {
+	if ai.config.APIKey == "" {
+		return nil, fmt.Errorf("未配置AI API Key")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("没有可处理的识别结果")
+	}
+	ai.applyDefaults()
+
+	prompt := `请根据以下带时间戳的视频字幕，按内容的逻辑转折把视频划分为若干章节。
+要求：
+1. 第一个章节从视频开头开始，章节数量视内容而定，每个章节至少覆盖一个完整的话题，不要过于零碎。
+2. start_time 为该章节开始的秒数，直接使用字幕中的原始时间戳。
+3. title 为简短的章节标题（不超过 20 个字）。
+4. 只输出 JSON 数组，格式为：[{"start_time": 0, "title": "开场介绍"}]
+
+字幕：
+` + buildTimedTranscript(segments)
+
+	content, err := ai.sendChatRequest([]map[string]string{{"role": "user", "content": prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Chapter
+	if err := json.Unmarshal([]byte(extractJSON(content)), &candidates); err != nil {
+		return nil, fmt.Errorf("解析章节结果失败: %w", err)
+	}
+
+	chapters := snapChapters(candidates, segments)
+	if len(chapters) == 0 {
+		return nil, fmt.Errorf("AI未生成可用的章节")
+	}
+	return chapters, nil
+}
+
+// snapChapters 把章节开始时间对齐到最近的字幕开头，按时间排序并去掉标题为空或对齐后重复的章节
+func snapChapters(chapters []Chapter, segments []DataSegment) []Chapter {
+	result := []Chapter{}
+	seen := make(map[float64]bool)
+	for _, chapter := range chapters {
+		chapter.Title = strings.TrimSpace(chapter.Title)
+		if chapter.Title == "" {
+			continue
+		}
+
+		nearest := segments[0].StartTime
+		for _, seg := range segments {
+			if math.Abs(seg.StartTime-chapter.StartTime) < math.Abs(nearest-chapter.StartTime) {
+				nearest = seg.StartTime
+			}
+		}
+		if seen[nearest] {
+			continue
+		}
+		seen[nearest] = true
+		result = append(result, Chapter{StartTime: nearest, Title: chapter.Title})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].StartTime < result[j].StartTime })
+	return result
+}
+
+// formatYouTubeChapters 生成 YouTube 简介可用的章节列表 (每行 "mm:ss 标题"，超过一小时为 "h:mm:ss")
+// YouTube 要求第一个章节从 00:00 开始
+func formatYouTubeChapters(chapters []Chapter) string {
+	var builder strings.Builder
+	for i, chapter := range chapters {
+		seconds := int(chapter.StartTime)
+		if i == 0 {
+			seconds = 0
+		}
+		if seconds >= 3600 {
+			builder.WriteString(fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60))
+		} else {
+			builder.WriteString(fmt.Sprintf("%02d:%02d", seconds/60, seconds%60))
+		}
+		builder.WriteString(" " + chapter.Title + "\n")
+	}
+	return builder.String()
+}
+
+// callExternalAI 调用外部AI (重构为使用 sendChatRequest)
+func (ai *AISummarizer) callExternalAI(prompt string, screenshots []string) (AIResponse, error) {
+	messages := []map[string]string{
+		{"role": "user", "content": prompt},
+	}
+
+	// 先截断再发送，以便在结果中提示 (截断后 sendChatRequest 不会再次截断)
+	messages, truncated := ai.fitContext(messages)
+	notice := ""
+	if truncated {
+		notice = "字幕内容超出模型上下文上限，中间部分已省略，总结可能不完整"
+	}
+
+	// 开启 Vision 时把截图作为图片一并发给模型，否则只发送文本
+	var content string
+	var err error
+	images := ai.visionImages(screenshots)
+	if len(images) > 0 {
+		content, err = ai.sendVisionRequest(messages[0]["content"], images)
+	} else {
+		content, err = ai.sendChatRequest(messages)
+	}
+	if err != nil {
+		return AIResponse{}, err
+	}
+
+	// 简单提取要点 (保持原有逻辑)
+	var points []string
+	lines := strings.Split(content, "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") || strings.HasPrefix(line, "1. ") {
+			cleanLine := strings.TrimLeft(line, "-*1234567890. ")
+			if len(cleanLine) > 0 {
+				points = append(points, cleanLine)
+			}
+		}
+	}
+
+	if len(points) == 0 {
+		sentences := strings.Split(content, "。")
+		for i, s := range sentences {
+			if i >= 5 {
+				break
+			}
+			if len(s) > 5 {
+				points = append(points, s)
+			}
+		}
+	}
+
+	return AIResponse{
+		Summary:  "AI智能总结",
+		Markdown: content,
+		Points:   points,
+		Notice:   notice,
+		Success:  true,
+	}, nil
+}
+
+// maxVisionImages 开启 Vision 时每次请求最多附带的截图数
+const maxVisionImages = 8
+
+// visionImages 把 visionScreenshots 选出的截图编码为 data URL，未开启 Vision 时返回空
+// 读取失败的截图跳过
+func (ai *AISummarizer) visionImages(screenshots []string) []string {
+	var images []string
+	for _, path := range ai.visionScreenshots(screenshots) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			Warn("读取截图失败，跳过: %v", err)
+			continue
+		}
+		mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+		if !strings.HasPrefix(mimeType, "image/") {
+			Warn("截图不是图片，跳过: %s", path)
+			continue
+		}
+		images = append(images, "data:"+mimeType+";base64,"+base64.StdEncoding.EncodeToString(data))
+	}
+	return images
+}
+
+// visionScreenshots 返回开启 Vision 时实际随请求发送的截图，超过 maxVisionImages 张时均匀抽取
+func (ai *AISummarizer) visionScreenshots(screenshots []string) []string {
+	if !ai.config.Vision || len(screenshots) == 0 {
+		return nil
+	}
+	if len(screenshots) <= maxVisionImages {
+		return screenshots
+	}
+
+	selected := make([]string, 0, maxVisionImages)
+	for i := 0; i < maxVisionImages; i++ {
+		selected = append(selected, screenshots[i*len(screenshots)/maxVisionImages])
+	}
+	return selected
+}
+
+// resolveScreenshotPaths 把请求中的截图转换为本地路径：Web 路径 (/files/ 等) 按 fromWebPath 映射，
+// 相对路径 (如 screenshot_1.jpg) 相对于视频的输出目录
+// 截图会被读取并发送给 AI 服务，只接受输出目录内的 jpg/png 文件，其余的丢弃
+func resolveScreenshotPaths(screenshots []string, outputDir string) []string {
+	if outputDir == "" {
+		return nil
+	}
+
+	paths := make([]string, 0, len(screenshots))
+	for _, shot := range screenshots {
+		path, ok := fromWebPath(shot)
+		if !ok {
+			path = shot
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(outputDir, shot)
+			}
+		}
+		if !isScreenshotFile(path) || !isWithinDir(outputDir, path) {
+			Warn("忽略输出目录外或非图片的截图: %s", shot)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// isScreenshotFile 截图只会是 jpg/png
+func isScreenshotFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// webRoot 通过 HTTP 提供访问的本地目录及其 URL 前缀
+type webRoot struct {
+	Prefix string // 如 /files/
+	Dir    string
+}
+
+// extraWebRoots DOWNLOAD_DIR 之外提供访问的目录 (开启 -serve-allowed-dirs 时为 -allowed-dirs)，依次映射到 /files-1/、/files-2/ ...
+var extraWebRoots []webRoot
+
+// setExtraWebRoots 按配置的额外目录生成 Web 映射，服务启动时调用
+func setExtraWebRoots(dirs []string) {
+	extraWebRoots = nil
+	for i, dir := range dirs {
+		extraWebRoots = append(extraWebRoots, webRoot{Prefix: fmt.Sprintf("/files-%d/", i+1), Dir: dir})
+	}
+}
+
+// servedWebRoots 所有提供访问的目录：/files/ 固定对应 DOWNLOAD_DIR
+func servedWebRoots() []webRoot {
+	return append([]webRoot{{Prefix: "/files/", Dir: DOWNLOAD_DIR}}, extraWebRoots...)
+}
+
+// toWebPath 把本地文件路径转换为浏览器可访问的 URL 路径 (已转义)，不在任何提供访问的目录下时返回错误
+func toWebPath(absPath string) (string, error) {
+	path, err := filepath.Abs(absPath)
+	if err != nil {
+		return "", fmt.Errorf("解析路径失败: %w", err)
+	}
+	for _, root := range servedWebRoots() {
+		base, err := filepath.Abs(root.Dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return (&url.URL{Path: root.Prefix + filepath.ToSlash(rel)}).EscapedPath(), nil
+	}
+	return "", fmt.Errorf("文件不在任何可访问的目录下: %s", absPath)
+}
+
+// fromWebPath toWebPath 的逆过程，把 /files/ 等 URL 路径还原为本地路径，不是已知前缀或越出目录时返回 false
+func fromWebPath(webPath string) (string, bool) {
+	if unescaped, err := url.PathUnescape(webPath); err == nil {
+		webPath = unescaped
+	}
+	for _, root := range servedWebRoots() {
+		rel, ok := strings.CutPrefix(webPath, root.Prefix)
+		if !ok {
+			continue
+		}
+		// 解码后的 ../ 不能越出提供访问的目录
+		path := filepath.Join(root.Dir, filepath.FromSlash(rel))
+		if !isWithinDir(root.Dir, path) {
+			Warn("Web 路径越出可访问的目录: %s", webPath)
+			return "", false
+		}
+		return path, true
+	}
+	return "", false
+}
+
+// ==================== 文件操作服务 ====================
+
+// listDownloadFiles 列出D:/download目录下的文件
+func listDownloadFiles() ([]FileItem, error) {
+	startTime := time.Now()
+	var files []FileItem
+	
+	// 监听列表：主目录 和 dest子目录
+	scanDirs := []string{DOWNLOAD_DIR, filepath.Join(DOWNLOAD_DIR, "dest")}
+
+	for _, dir := range scanDirs {
+		dirStartTime := time.Now()
+		// 检查目录是否存在
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		// 读取目录内容
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			Warn("读取目录失败 %s: %v", dir, err)
+			continue
+		}
+		Info("扫描目录 [%s] 完成，条目数: %d, 耗时: %v", dir, len(entries), time.Since(dirStartTime))
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				if strings.HasPrefix(entry.Name(), "output_") {
+					if item, ok := restoredFileItem(filepath.Join(dir, entry.Name())); ok {
+						files = append(files, item)
+					}
+				}
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			fileName := entry.Name()
+			ext := strings.ToLower(filepath.Ext(fileName))
+
+			// 处理 wma 转换
+			if ext == ".wma" {
+				wmaPath := filepath.Join(dir, fileName)
+				mp3Path := strings.TrimSuffix(wmaPath, ext) + ".mp3"
+				done := trackFFmpeg()
+				err := exec.Command("ffmpeg", "-i", wmaPath, "-q:a", "2", "-y", mp3Path).Run()
+				done()
+				if err == nil {
+					os.Remove(wmaPath)
+					if newInfo, err := os.Stat(mp3Path); err == nil {
+						info = newInfo
+						fileName = filepath.Base(mp3Path)
+						ext = ".mp3"
+					}
+				}
+			}
+
+			fileType := "other"
+			if ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".mov" || ext == ".flv" {
+				fileType = "video"
+			} else if ext == ".mp3" || ext == ".wav" || ext == ".flac" || ext == ".aac" {
+				fileType = "audio"
+			}
+
+			// 过滤掉非视频音频文件
+			if fileType == "other" {
+				continue
+			}
+
+			files = append(files, FileItem{
+				Name:    fileName,
+				Path:    filepath.Join(dir, fileName),
+				Size:    info.Size(),
+				ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
+				Type:    fileType,
+			})
+		}
+	}
+
+	markDuplicateFiles(files)
+
+	// 扫描归档目录
+	archiveStartTime := time.Now()
+	archiveDir := filepath.Join(DOWNLOAD_DIR, "archive")
+	for _, dir := range listArchiveDirs(archiveDir) {
+		// 检查是否存在 summary.json
+		summaryPath := filepath.Join(dir, outputFileName("summary", "", ""))
+		if _, err := os.Stat(summaryPath); err != nil {
+			continue
+		}
+		// 这是一个有效的归档
+		name := filepath.Base(dir)
+		// 去除 output_ 前缀，让名字更好看
+		if strings.HasPrefix(name, "output_") {
+			name = name[7:]
+		}
+		// 日期子目录中的归档带上分组，如 2024-06/xxx
+		if group, err := filepath.Rel(archiveDir, filepath.Dir(dir)); err == nil && group != "." {
+			name = filepath.ToSlash(group) + "/" + name
+		}
+
+		files = append(files, FileItem{
+			Name:    "📦 [归档] " + name,
+			Path:    dir,
+			Type:    "archive",
+			ModTime: "已归档",
+		})
+	}
+	Info("扫描归档目录 [%s] 完成，耗时: %v", archiveDir, time.Since(archiveStartTime))
+
+	for i := range files {
+		files[i].Tags = loadTags(fileOutputDir(files[i]))
+	}
+
+	Info("list-files 总计返回 %d 个文件，总耗时: %v", len(files), time.Since(startTime))
+	return files, nil
+}
+
+// SummaryEntry 已生成总结的处理结果
+type SummaryEntry struct {
+	Name        string
+	Dir         string
+	SummaryPath string
+	ModTime     time.Time
+	Result      AIResponse
+}
+
+// listOutputDirs 列出下载目录和 dest 子目录下的 output_* 目录，includeArchive 时包含归档目录
+func listOutputDirs(includeArchive bool) []string {
+	scanDirs := []string{DOWNLOAD_DIR, filepath.Join(DOWNLOAD_DIR, "dest")}
+
+	var dirs []string
+	if includeArchive {
+		dirs = listArchiveDirs(filepath.Join(DOWNLOAD_DIR, "archive"))
+	}
+	for _, dir := range scanDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), "output_") {
+				dirs = append(dirs, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return dirs
+}
+
+// listArchiveDirs 递归查找归档目录下的归档项 (output_* 目录或含 summary.json 的目录)，兼容按日期分层和旧的平铺结构
+func listArchiveDirs(archiveDir string) []string {
+	var dirs []string
+	filepath.WalkDir(archiveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == archiveDir {
+			return nil
+		}
+		isArchive := strings.HasPrefix(d.Name(), "output_")
+		if !isArchive {
+			_, statErr := os.Stat(filepath.Join(path, outputFileName("summary", "", "")))
+			isArchive = statErr == nil
+		}
+		if isArchive {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs
+}
+
+// collectSummaries 收集下载目录、dest 子目录和归档目录中所有的 summary.json
+func collectSummaries() []SummaryEntry {
+	var entries []SummaryEntry
+	for _, dir := range listOutputDirs(true) {
+		summaryPath := filepath.Join(dir, outputFileName("summary", "", ""))
+		info, err := os.Stat(summaryPath)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(summaryPath)
+		if err != nil {
+			continue
+		}
+		var result AIResponse
+		if err := json.Unmarshal(data, &result); err != nil {
+			Warn("解析总结失败 %s: %v", summaryPath, err)
+			continue
+		}
+
+		entries = append(entries, SummaryEntry{
+			Name:        strings.TrimPrefix(filepath.Base(dir), "output_"),
+			Dir:         dir,
+			SummaryPath: summaryPath,
+			ModTime:     info.ModTime(),
+			Result:      result,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.After(entries[j].ModTime)
+	})
+	return entries
+}
+
+// isRemoteVideoURL 判断视频路径是否为 http(s) 直链
+func isRemoteVideoURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteVideoPath 远程视频下载到 DOWNLOAD_DIR 的本地路径，文件名取 URL 的 md5，扩展名沿用 URL 中的 (默认 .mp4)
+func remoteVideoPath(rawURL string) string {
+	ext := ".mp4"
+	if parsed, err := url.Parse(rawURL); err == nil {
+		if e := strings.ToLower(filepath.Ext(parsed.Path)); e != "" && len(e) <= 5 {
+			ext = e
+		}
+	}
+	return filepath.Join(DOWNLOAD_DIR, fmt.Sprintf("remote_%x%s", md5.Sum([]byte(rawURL)), ext))
+}
+
+// DefaultMaxDownloadSize 远程视频默认下载大小上限 (4GB)
+const DefaultMaxDownloadSize = 4 << 30
+
+// checkRemoteHost 拒绝解析到本机、链路本地或内网的下载地址，避免借下载访问内部服务
+func checkRemoteHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("解析下载地址失败: %w", err)
+	}
+	for _, addr := range addrs {
+		ip := addr.IP
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return fmt.Errorf("不允许下载内网地址: %s (%s)", host, ip)
+		}
+	}
+	return nil
+}
+
+// downloadRemoteVideo 把远程视频流式下载到 DOWNLOAD_DIR，目标文件已存在时直接复用
+// 先写入 .part 临时文件，下载完成后再重命名，中途取消不会留下残缺的视频
+// 超过 maxBytes (<=0 时为 DefaultMaxDownloadSize) 的视频中止下载；allowPrivate 为 false 时拒绝内网地址 (含重定向)
+func downloadRemoteVideo(ctx context.Context, rawURL string, maxBytes int64, allowPrivate bool) (string, error) {
+	localPath := remoteVideoPath(rawURL)
+	if _, err := os.Stat(localPath); err == nil {
+		Info("远程视频已下载，跳过: %s", localPath)
+		return localPath, nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxDownloadSize
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("创建下载请求失败: %w", err)
+	}
+	// 大文件下载不设总超时 (由 ctx 控制)，只限制等待响应头的时间
+	client := getStreamHTTPClient()
+	if !allowPrivate {
+		if err := checkRemoteHost(ctx, req.URL.Hostname()); err != nil {
+			return "", err
+		}
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("重定向次数过多")
+			}
+			return checkRemoteHost(req.Context(), req.URL.Hostname())
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("下载视频失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("下载视频失败: HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return "", fmt.Errorf("视频大小 %dMB 超过下载上限 %dMB", resp.ContentLength>>20, maxBytes>>20)
+	}
+
+	// 每次下载写入各自的临时文件，同一直链并发下载时互不干扰，完成后改名覆盖
+	file, err := os.CreateTemp(filepath.Dir(localPath), filepath.Base(localPath)+".*.part")
+	if err != nil {
+		return "", fmt.Errorf("创建文件失败: %w", err)
+	}
+	tempPath := file.Name()
+	// 未返回 Content-Length 或长度不实时，多读 1 字节判断是否超限
+	written, err := io.Copy(file, io.LimitReader(resp.Body, maxBytes+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > maxBytes {
+		err = fmt.Errorf("超过下载上限 %dMB", maxBytes>>20)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("下载视频失败: %w", err)
+	}
+	if err := os.Rename(tempPath, localPath); err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("保存视频失败: %w", err)
+	}
+
+	Info("远程视频下载完成: %s (%dKB)", localPath, written/1024)
+	return localPath, nil
+}
+
+// ==================== 标签管理 ====================
+
+// summaryTagsPrefix AI总结末尾标签行的前缀
+const summaryTagsPrefix = "标签："
+
+// extractSummaryTags 从AI总结末尾取出标签行，返回去掉标签行的 Markdown 和标签列表
+func extractSummaryTags(markdown string) (string, []string) {
+	lines := strings.Split(strings.TrimRight(markdown, "\n "), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.Trim(strings.TrimSpace(lines[i]), "*")
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, summaryTagsPrefix) {
+			break
+		}
+		value := strings.NewReplacer("，", ",", "、", ",", "#", "").Replace(strings.TrimPrefix(line, summaryTagsPrefix))
+		return strings.Join(lines[:i], "\n"), normalizeTags(strings.Split(value, ","))
+	}
+	return markdown, nil
+}
+
+// normalizeTags 去除空白和重复标签，保持原有顺序
+func normalizeTags(tags []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// loadTags 读取输出目录中的 tags.json
+func loadTags(outputDir string) []string {
+	data, err := os.ReadFile(filepath.Join(outputDir, "tags.json"))
+	if err != nil {
+		return nil
+	}
+	var tags []string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		Warn("解析标签失败 %s: %v", outputDir, err)
+		return nil
+	}
+	return tags
+}
+
+// saveTags 保存输出目录的标签
+func saveTags(outputDir string, tags []string) error {
+	data, err := json.MarshalIndent(normalizeTags(tags), "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化标签失败: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "tags.json"), data, 0644); err != nil {
+		return fmt.Errorf("保存标签失败: %w", err)
+	}
+	return nil
+}
+
+// fileOutputDir 文件列表项对应的输出目录 (归档项本身就是输出目录)
+func fileOutputDir(file FileItem) string {
+	if file.Type == "archive" || file.Type == "restored" {
+		return file.Path
+	}
+	return filepath.Join(filepath.Dir(file.Path), "output_"+filepath.Base(file.Path))
+}
+
+// filterFilesByTag 只保留带有指定标签的文件
+func filterFilesByTag(files []FileItem, tag string) []FileItem {
+	filtered := []FileItem{}
+	for _, file := range files {
+		for _, t := range file.Tags {
+			if t == tag {
+				filtered = append(filtered, file)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// TagCount 标签及使用次数
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// collectTagCounts 统计所有处理结果 (含归档) 的标签，按次数从多到少排序
+func collectTagCounts() []TagCount {
+	counts := make(map[string]int)
+	for _, dir := range listOutputDirs(true) {
+		for _, tag := range loadTags(dir) {
+			counts[tag]++
+		}
+	}
+
+	result := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		result = append(result, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Tag < result[j].Tag
+	})
+	return result
+}
+
+// ==================== 全局搜索 ====================
+
+// 常用繁体/异体字 -> 简体映射 (两两一组：繁/异体在前，简体在后)
+const searchFoldPairs = "臺台灣湾體体國国學学習习語语說说課课這这個个們们來来時时會会對对開开關关發发問问題题" +
+	"還还進进過过點点經经與与種种實实現现將将後后長长間间從从見见車车電电腦脑網网絡络頁页視视頻频聽听" +
+	"寫写讀读書书畫画圖图層层處处應应當当麼么為为爲为無无東东樂乐樣样萬万億亿氣气動动機机識识認认記记" +
+	"錄录計计設设邊边變变號号碼码術术專专業业產产務务員员報报導导區区歷历紀纪齊齐價价錢钱買买賣卖貨货" +
+	"幣币銀银質质頭头歡欢觀观驗验檢检測测證证據据裡里裏里週周準准標标雜杂親亲愛爱讓让給给講讲話话詞词" +
+	"調调誤误論论議议談谈請请謝谢該该轉转運运達达選选遠远連连邏逻輯辑線线綫线眾众衆众偽伪僞伪啟启啓启" +
+	"溫温戶户峯峰羣群萬万嗎吗廣广雲云節节蘭兰劃划滿满師师擊击態态勢势優优隊队團团際际環环屬属類类嚴严"
+
+var searchFoldMap = func() map[rune]rune {
+	runes := []rune(searchFoldPairs)
+	m := make(map[rune]rune, len(runes)/2)
+	for i := 0; i+1 < len(runes); i += 2 {
+		m[runes[i]] = runes[i+1]
+	}
+	return m
+}()
+
+// normalizeForSearch 搜索归一化：繁简折叠、异体字映射、全角转半角、大小写统一
+func normalizeForSearch(text string) string {
+	var builder strings.Builder
+	for _, r := range text {
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		} else if r == 0x3000 {
+			r = ' '
+		}
+		if mapped, ok := searchFoldMap[r]; ok {
+			r = mapped
+		}
+		builder.WriteRune(unicode.ToLower(r))
+	}
+	return builder.String()
+}
+
+// SearchHit 全局搜索命中的片段
+type SearchHit struct {
+	Name      string  `json:"name"`
+	OutputDir string  `json:"output_dir"`
+	Text      string  `json:"text"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+}
+
+// GlobalSearch 在所有已处理视频的识别结果中搜索
+func GlobalSearch(query string) []SearchHit {
+	needle := normalizeForSearch(strings.TrimSpace(query))
+	if needle == "" {
+		return nil
+	}
+
+	var hits []SearchHit
+	for _, dir := range listOutputDirs(false) {
+		segments, err := loadSegmentsFile(dir)
+		if err != nil {
+			continue
+		}
+		for _, seg := range segments {
+			if strings.Contains(normalizeForSearch(seg.Text), needle) {
+				hits = append(hits, SearchHit{
+					Name:      strings.TrimPrefix(filepath.Base(dir), "output_"),
+					OutputDir: dir,
+					Text:      seg.Text,
+					StartTime: seg.StartTime,
+					EndTime:   seg.EndTime,
+				})
+			}
+		}
+	}
+	return hits
+}
+
+// ==================== RSS订阅 ====================
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+}
+
+// buildRSSFeed 把视频总结生成 RSS 2.0，baseURL 形如 http://localhost:8080
+func buildRSSFeed(entries []SummaryEntry, baseURL string) ([]byte, error) {
+	channel := rssChannel{
+		Title:         "视频AI总结",
+		Link:          baseURL + "/",
+		Description:   "已处理视频的AI总结",
+		LastBuildDate: time.Now().Format(time.RFC1123Z),
+	}
+
+	for _, entry := range entries {
+		// guid 固定为总结文件地址；链接到视频本身，阅读器可以直接打开播放，视频已不在 (如已归档) 时退回总结文件
+		guid := baseURL + "/"
+		if webPath, err := toWebPath(entry.SummaryPath); err == nil {
+			guid = baseURL + webPath
+		} else {
+			Warn("RSS 条目无法生成链接: %v", err)
+		}
+		link := guid
+		videoPath := filepath.Join(filepath.Dir(entry.Dir), strings.TrimPrefix(filepath.Base(entry.Dir), "output_"))
+		if _, err := os.Stat(videoPath); err == nil {
+			if webPath, err := toWebPath(videoPath); err == nil {
+				link = baseURL + webPath
+			}
+		}
+
+		description := entry.Result.Markdown
+		if len(entry.Result.Points) > 0 {
+			description = strings.Join(entry.Result.Points, "\n")
+		}
+		if runes := []rune(description); len(runes) > 500 {
+			description = string(runes[:500]) + "..."
+		}
+
+		channel.Items = append(channel.Items, rssItem{
+			Title:       entry.Name,
+			Link:        link,
+			GUID:        guid,
+			Description: description,
+			PubDate:     entry.ModTime.Format(time.RFC1123Z),
+		})
+	}
+
+	data, err := xml.MarshalIndent(rssFeed{Version: "2.0", Channel: channel}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("生成RSS失败: %w", err)
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ==================== 邮件告警 ====================
+
+// SMTPConfig 邮件告警配置
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+	Mode     string // failure: 每次失败立即发送 (默认)；daily: 每日汇总
+}
+
+// loadSMTPConfigFromEnv 从环境变量读取邮件告警配置
+// SMTP_HOST / SMTP_PORT / SMTP_USER / SMTP_PASSWORD / SMTP_FROM / ALERT_EMAIL_TO (逗号分隔) / ALERT_MODE
+func loadSMTPConfigFromEnv() SMTPConfig {
+	config := SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		Mode:     os.Getenv("ALERT_MODE"),
+	}
+	for _, addr := range strings.Split(os.Getenv("ALERT_EMAIL_TO"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			config.To = append(config.To, addr)
+		}
+	}
+	if config.Port == "" {
+		config.Port = "25"
+	}
+	if config.From == "" {
+		config.From = config.Username
+	}
+	return config
+}
+
+// alertEntry 一次处理失败记录
+type alertEntry struct {
+	Video string
+	Stage string
+	Error string
+	Time  time.Time
+}
+
+// MailAlerter 处理失败邮件告警，未配置 SMTP 时为 nil，所有方法都可安全调用
+type MailAlerter struct {
+	config  SMTPConfig
+	mu      sync.Mutex
+	pending []alertEntry
+}
+
+// NewMailAlerter 创建邮件告警器，未配置主机或收件人时返回 nil
+func NewMailAlerter(config SMTPConfig) *MailAlerter {
+	if config.Host == "" || len(config.To) == 0 {
+		return nil
+	}
+	Info("已启用邮件告警: %s -> %s (模式: %s)", config.Host, strings.Join(config.To, ","), config.Mode)
+	return &MailAlerter{config: config}
+}
+
+// Start 每日汇总模式下启动定时发送
+func (m *MailAlerter) Start() {
+	if m == nil || m.config.Mode != "daily" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.flush()
+		}
+	}()
+}
+
+// Notify 记录一次处理失败，立即发送或加入每日汇总
+// 客户端断开或主动取消 (context.Canceled) 不是服务故障，不发告警
+func (m *MailAlerter) Notify(video, stage string, err error) {
+	if m == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	entry := alertEntry{Video: video, Stage: stage, Error: err.Error(), Time: time.Now()}
+
+	if m.config.Mode == "daily" {
+		m.mu.Lock()
+		m.pending = append(m.pending, entry)
+		m.mu.Unlock()
+		return
+	}
+
+	go func() {
+		subject := fmt.Sprintf("视频处理失败: %s", filepath.Base(video))
+		if err := m.send(subject, formatAlertEntries([]alertEntry{entry})); err != nil {
+			Warn("发送告警邮件失败: %v", err)
+		}
+	}()
+}
+
+// flush 发送每日汇总
+func (m *MailAlerter) flush() {
+	m.mu.Lock()
+	entries := m.pending
+	m.pending = nil
+	m.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	subject := fmt.Sprintf("视频处理失败每日汇总 (%d 条)", len(entries))
+	if err := m.send(subject, formatAlertEntries(entries)); err != nil {
+		Warn("发送告警汇总邮件失败: %v", err)
+	}
+}
+
+func formatAlertEntries(entries []alertEntry) string {
+	var body strings.Builder
+	for _, entry := range entries {
+		body.WriteString(fmt.Sprintf("视频: %s\n阶段: %s\n时间: %s\n错误: %s\n\n",
+			entry.Video, entry.Stage, entry.Time.Format("2006-01-02 15:04:05"), entry.Error))
+	}
+	return body.String()
+}
+
+func (m *MailAlerter) send(subject, body string) error {
+	var msg bytes.Buffer
+	msg.WriteString("From: " + m.config.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(m.config.To, ", ") + "\r\n")
+	msg.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(body)
+
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	}
+	return smtp.SendMail(m.config.Host+":"+m.config.Port, auth, m.config.From, m.config.To, msg.Bytes())
+}
+
+// ==================== 内容去重 ====================
+
+var (
+	fingerprintMu    sync.Mutex
+	fingerprintCache = map[string]string{} // path|size|modtime -> 指纹
+	videoIndexMu     sync.Mutex
+)
+
+// contentFingerprint 计算文件内容指纹：整个文件内容的 md5
+// 结果按路径/大小/修改时间缓存，同一文件不会重复读取
+func contentFingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	cacheKey := fmt.Sprintf("%s|%d|%d", path, info.Size(), info.ModTime().UnixNano())
+	fingerprintMu.Lock()
+	cached, ok := fingerprintCache[cacheKey]
+	fingerprintMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+	fingerprintMu.Lock()
+	fingerprintCache[cacheKey] = fingerprint
+	fingerprintMu.Unlock()
+	return fingerprint, nil
+}
+
+// videoIndexPath 内容指纹 -> 输出目录 的索引文件
+func videoIndexPath() string {
+	return filepath.Join(DOWNLOAD_DIR, ".video_index.json")
+}
+
+func loadVideoIndex() map[string]string {
+	index := map[string]string{}
+	if data, err := os.ReadFile(videoIndexPath()); err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// registerProcessedVideo 记录视频内容指纹对应的输出目录
+func registerProcessedVideo(vp *VideoProcessor) {
+	fingerprint, err := contentFingerprint(vp.VideoPath)
+	if err != nil {
+		Warn("计算视频指纹失败: %v", err)
+		return
+	}
+
+	videoIndexMu.Lock()
+	defer videoIndexMu.Unlock()
+	index := loadVideoIndex()
+	if _, ok := index[fingerprint]; ok {
+		return
+	}
+	index[fingerprint] = vp.OutputDir
+	data, _ := json.MarshalIndent(index, "", "  ")
+	if err := os.WriteFile(videoIndexPath(), data, 0644); err != nil {
+		Warn("保存视频索引失败: %v", err)
+	}
+}
+
+// reuseDuplicateOutput 查找内容相同且已处理过的视频，把其识别结果和总结复制到当前输出目录
+func reuseDuplicateOutput(vp *VideoProcessor) bool {
+	fingerprint, err := contentFingerprint(vp.VideoPath)
+	if err != nil {
+		return false
+	}
+
+	videoIndexMu.Lock()
+	sourceDir, ok := loadVideoIndex()[fingerprint]
+	videoIndexMu.Unlock()
+	if !ok || sourceDir == vp.OutputDir {
+		return false
+	}
+
+	data, err := os.ReadFile(filepath.Join(sourceDir, "segments.json"))
+	if err != nil {
+		return false
+	}
+	if err := os.WriteFile(filepath.Join(vp.OutputDir, "segments.json"), data, 0644); err != nil {
+		Warn("复用识别结果失败: %v", err)
+		return false
+	}
+	if summary, err := os.ReadFile(filepath.Join(sourceDir, outputFileName("summary", "", ""))); err == nil {
+		os.WriteFile(filepath.Join(vp.OutputDir, outputFileName("summary", "", "")), summary, 0644)
+	}
+
+	Info("检测到内容相同的视频，复用已有结果: %s", sourceDir)
+	return true
+}
+
+// sharedASRResult 按音频内容共享的识别结果
+type sharedASRResult struct {
+	Provider string        `json:"provider"`
+	Segments []DataSegment `json:"segments"`
+	Offset   *float64      `json:"offset,omitempty"` // 识别时已应用的时间戳校正，复用时原样返回
+}
+
+// sharedASRResultPath 音频内容指纹 (contentFingerprint) 对应的全局识别结果缓存文件，与文件名和所在目录无关
+func sharedASRResultPath(fingerprint string) string {
+	return filepath.Join(CacheDir, "SharedASR_"+fingerprint+".json")
+}
+
+// loadSharedASRResult 查找内容相同的音频是否已有识别结果
+func loadSharedASRResult(fingerprint string) (sharedASRResult, bool) {
+	var result sharedASRResult
+	if fingerprint == "" {
+		return result, false
+	}
+	path := sharedASRResultPath(fingerprint)
+	info, err := os.Stat(path)
+	if err != nil || (CacheTTL > 0 && time.Since(info.ModTime()) > CacheTTL) {
+		return result, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &result) != nil || len(result.Segments) == 0 {
+		return result, false
+	}
+	return result, true
+}
+
+// saveSharedASRResult 记录音频内容对应的识别结果，供其他视频复用
+func saveSharedASRResult(fingerprint, provider string, segments []DataSegment, offset *float64) {
+	if fingerprint == "" || len(segments) == 0 {
+		return
+	}
+	if err := os.MkdirAll(CacheDir, 0755); err != nil {
+		Warn("创建缓存目录失败: %v", err)
+		return
+	}
+	data, _ := json.MarshalIndent(sharedASRResult{Provider: provider, Segments: segments, Offset: offset}, "", "  ")
+	if err := os.WriteFile(sharedASRResultPath(fingerprint), data, 0644); err != nil {
+		Warn("保存共享识别结果失败: %v", err)
+	}
+}
+
+// markDuplicateFiles 标记内容相同的文件，后出现的标记为前一个的重复
+// 大小不同的文件内容必然不同，只对大小相同的文件计算指纹，避免列表时读取每个视频的全部内容
+func markDuplicateFiles(files []FileItem) {
+	sizeCounts := map[int64]int{}
+	for _, file := range files {
+		sizeCounts[file.Size]++
+	}
+
+	seen := map[string]string{}
+	for i := range files {
+		if sizeCounts[files[i].Size] < 2 {
+			continue
+		}
+		fingerprint, err := contentFingerprint(files[i].Path)
+		if err != nil {
+			continue
+		}
+		if first, ok := seen[fingerprint]; ok {
+			files[i].DuplicateOf = first
+		} else {
+			seen[fingerprint] = files[i].Path
+		}
+	}
+}
+
+// ==================== 准确率评估 ====================
+
+// AlignmentOp 参考文本与识别结果逐词对齐的一步
+type AlignmentOp struct {
+	Op  string `json:"op"` // equal / substitute / delete (识别漏掉) / insert (识别多出)
+	Ref string `json:"ref,omitempty"`
+	Hyp string `json:"hyp,omitempty"`
+}
+
+// AccuracyReport 识别准确率报告
+type AccuracyReport struct {
+	WER           float64       `json:"wer"` // 词错误率
+	CER           float64       `json:"cer"` // 字错误率
+	RefWords      int           `json:"ref_words"`
+	Substitutions int           `json:"substitutions"`
+	Deletions     int           `json:"deletions"`
+	Insertions    int           `json:"insertions"`
+	Alignment     []AlignmentOp `json:"alignment"`
+	// 文本过长 (超过 maxAlignmentCells) 时不输出逐词对齐，只给出错误率和错误次数
+	AlignmentOmitted bool `json:"alignment_omitted,omitempty"`
+}
+
+// maxAlignmentCells 逐词对齐需要 (参考长度+1)×(识别长度+1) 的矩阵，超过该格数时只计算错误率，不输出对齐
+const maxAlignmentCells = 4_000_000
+
+// tokenizeWords 按词切分用于计算 WER：忽略大小写和标点，英文按空白分词，汉字每字一词
+func tokenizeWords(text string) []string {
+	var words []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			words = append(words, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			words = append(words, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'':
+			current.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// tokenizeChars 按字切分用于计算 CER，忽略空白和标点
+func tokenizeChars(text string) []string {
+	var chars []string
+	for _, r := range normalizeCommandText(text) {
+		chars = append(chars, string(r))
+	}
+	return chars
+}
+
+// alignTokens 用编辑距离对齐两个序列，返回逐步的对齐结果
+func alignTokens(ref, hyp []string) []AlignmentOp {
+	// dist[i][j] 为 ref[:i] 与 hyp[:j] 的编辑距离
+	dist := make([][]int, len(ref)+1)
+	for i := range dist {
+		dist[i] = make([]int, len(hyp)+1)
+		dist[i][0] = i
+	}
+	for j := range dist[0] {
+		dist[0][j] = j
+	}
+	for i := 1; i <= len(ref); i++ {
+		for j := 1; j <= len(hyp); j++ {
+			cost := 1
+			if ref[i-1] == hyp[j-1] {
+				cost = 0
+			}
+			dist[i][j] = min(dist[i-1][j]+1, dist[i][j-1]+1, dist[i-1][j-1]+cost)
+		}
+	}
+
+	// 从末尾回溯，再反转为正序
+	var ops []AlignmentOp
+	i, j := len(ref), len(hyp)
+	for i > 0 || j > 0 {
+		switch {
+		case i > 0 && j > 0 && ref[i-1] == hyp[j-1] && dist[i][j] == dist[i-1][j-1]:
+			ops = append(ops, AlignmentOp{Op: "equal", Ref: ref[i-1], Hyp: hyp[j-1]})
+			i, j = i-1, j-1
+		case i > 0 && j > 0 && dist[i][j] == dist[i-1][j-1]+1:
+			ops = append(ops, AlignmentOp{Op: "substitute", Ref: ref[i-1], Hyp: hyp[j-1]})
+			i, j = i-1, j-1
+		case i > 0 && dist[i][j] == dist[i-1][j]+1:
+			ops = append(ops, AlignmentOp{Op: "delete", Ref: ref[i-1]})
+			i--
+		default:
+			ops = append(ops, AlignmentOp{Op: "insert", Hyp: hyp[j-1]})
+			j--
+		}
+	}
+	for l, r := 0, len(ops)-1; l < r; l, r = l+1, r-1 {
+		ops[l], ops[r] = ops[r], ops[l]
+	}
+	return ops
+}
+
+// editCounts 编辑距离中替换、删除、插入的次数，只保留两行，内存与文本长度成正比
+func editCounts(ref, hyp []string) (substitutions, deletions, insertions int) {
+	type cell struct{ dist, sub, del, ins int }
+	prev := make([]cell, len(hyp)+1)
+	curr := make([]cell, len(hyp)+1)
+	for j := range prev {
+		prev[j] = cell{dist: j, ins: j}
+	}
+	for i := 1; i <= len(ref); i++ {
+		curr[0] = cell{dist: i, del: i}
+		for j := 1; j <= len(hyp); j++ {
+			best := prev[j-1]
+			if ref[i-1] != hyp[j-1] {
+				best.dist++
+				best.sub++
+			}
+			if del := prev[j]; del.dist+1 < best.dist {
+				best = del
+				best.dist++
+				best.del++
+			}
+			if ins := curr[j-1]; ins.dist+1 < best.dist {
+				best = ins
+				best.dist++
+				best.ins++
+			}
+			curr[j] = best
+		}
+		prev, curr = curr, prev
+	}
+	last := prev[len(hyp)]
+	return last.sub, last.del, last.ins
+}
+
+// errorRate 返回 (替换 + 删除 + 插入) / 参考长度 和各类错误的次数
+// 文本较短时同时返回逐词对齐，超过 maxAlignmentCells 时对齐为 nil
+func errorRate(ref, hyp []string) (float64, AccuracyReport, error) {
+	if len(ref) == 0 {
+		return 0, AccuracyReport{}, fmt.Errorf("参考文本为空")
+	}
+
+	var counts AccuracyReport
+	if (len(ref)+1)*(len(hyp)+1) <= maxAlignmentCells {
+		counts.Alignment = alignTokens(ref, hyp)
+		for _, op := range counts.Alignment {
+			switch op.Op {
+			case "substitute":
+				counts.Substitutions++
+			case "delete":
+				counts.Deletions++
+			case "insert":
+				counts.Insertions++
+			}
+		}
+	} else {
+		counts.Substitutions, counts.Deletions, counts.Insertions = editCounts(ref, hyp)
+		counts.AlignmentOmitted = true
+	}
+	mistakes := counts.Substitutions + counts.Deletions + counts.Insertions
+	return float64(mistakes) / float64(len(ref)), counts, nil
+}
+
+// ComputeWER 计算词错误率 (汉字按字计词)
+func ComputeWER(reference, hypothesis string) (float64, error) {
+	rate, _, err := errorRate(tokenizeWords(reference), tokenizeWords(hypothesis))
+	return rate, err
+}
+
+// ComputeCER 计算字错误率
+func ComputeCER(reference, hypothesis string) (float64, error) {
+	rate, _, err := errorRate(tokenizeChars(reference), tokenizeChars(hypothesis))
+	return rate, err
+}
+
+// EvaluateAccuracy 生成包含 WER、CER 和逐词对齐的准确率报告
+func EvaluateAccuracy(reference, hypothesis string) (*AccuracyReport, error) {
+	refWords := tokenizeWords(reference)
+	wer, report, err := errorRate(refWords, tokenizeWords(hypothesis))
+	if err != nil {
+		return nil, err
+	}
+	cer, err := ComputeCER(reference, hypothesis)
+	if err != nil {
+		return nil, err
+	}
+
+	report.WER = wer
+	report.CER = cer
+	report.RefWords = len(refWords)
+	return &report, nil
+}
+
+// ==================== 处理预估 ====================
+
+// 预估用的经验参数，只用于给出量级，实际以处理结果为准
+const (
+	estimatedAudioBytesPerSecond = 128 * 1024 / 8  // ffmpeg libmp3lame 默认 128kbps
+	estimatedUploadPartSize      = 5 * 1024 * 1024 // 必剪分片大小，实际以申请上传返回的 per_size 为准
+	estimatedBcutSpeedFactor     = 0.05            // 必剪识别耗时约为音频时长的 1/20
+	estimatedWhisperSpeedFactor  = 0.5             // 本地 whisper (base 模型) 约为音频时长的一半
+	estimatedFunASRSpeedFactor   = 0.1             // 本地 FunASR (Paraformer) 约为音频时长的 1/10
+	estimatedCloudASRSpeedFactor = 0.1             // Azure/Google 云端识别 (含上传) 约为音频时长的 1/10
+	estimatedCharsPerMinute      = 250             // 中文口语语速 (字/分钟)
+	estimatedSummaryOutputTokens = 1500            // 总结输出的 token 数
+	estimatedPromptTokens        = 500             // 总结提示词本身的 token 数
+	defaultAIPricePerMTokens     = 2.0             // 默认 AI 价格 (元/百万 tokens)，可通过 price 参数覆盖
+)
+
+// ProcessEstimate 处理前的预估报告
+type ProcessEstimate struct {
+	VideoPath       string  `json:"video_path"`
+	Duration        float64 `json:"duration"`           // 视频时长 (秒)
+	AudioSize       int64   `json:"audio_size"`         // 音频大小 (字节)，已提取时为实际大小
+	AudioExtracted  bool    `json:"audio_extracted"`    // 是否已有提取好的音频
+	UploadParts     int     `json:"upload_parts"`       // ASR 上传分片数
+	Provider        string  `json:"provider"`           // 预估使用的ASR服务
+	ASRCached       bool    `json:"asr_cached"`         // 已有识别结果，无需再次识别
+	ASRSeconds      float64 `json:"asr_seconds"`        // 预估ASR耗时 (含上传，秒)
+	EstimatedChars  int     `json:"estimated_chars"`    // 预估字幕字数
+	EstimatedTokens int     `json:"estimated_tokens"`   // 预估AI总结消耗的 tokens
+	EstimatedCost   float64 `json:"estimated_cost"`     // 预估AI总结成本 (元)
+	PricePerMTokens float64 `json:"price_per_m_tokens"` // 计算成本使用的单价
+	SummaryCached   bool    `json:"summary_cached"`     // 已有总结结果
+}
+
+// EstimateProcessing 探测视频并预估处理耗时与成本，不创建输出目录也不做实际处理
+func EstimateProcessing(videoPath, provider string, config ServerConfig, pricePerMTokens float64) (*ProcessEstimate, error) {
+	absPath, err := filepath.Abs(videoPath)
+	if err != nil {
+		return nil, fmt.Errorf("获取文件路径失败: %v", err)
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		return nil, fmt.Errorf("视频文件不存在: %w", err)
+	}
+	if provider == "" {
+		provider = DefaultASRProvider
+	}
+	if pricePerMTokens <= 0 {
+		pricePerMTokens = defaultAIPricePerMTokens
+	}
+
+	vp := &VideoProcessor{
+		VideoPath: absPath,
+		OutputDir: filepath.Join(filepath.Dir(absPath), "output_"+filepath.Base(absPath)),
+	}
+	duration, err := vp.GetVideoDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &ProcessEstimate{
+		VideoPath:       absPath,
+		Duration:        duration,
+		AudioSize:       int64(duration * estimatedAudioBytesPerSecond),
+		Provider:        provider,
+		PricePerMTokens: pricePerMTokens,
+	}
+	if info, err := os.Stat(filepath.Join(vp.OutputDir, "audio.mp3")); err == nil && vp.StageDone(StageAudio) {
+		estimate.AudioSize = info.Size()
+		estimate.AudioExtracted = true
+	}
+	if _, err := os.Stat(filepath.Join(vp.OutputDir, "segments.json")); err == nil {
+		estimate.ASRCached = true
+	}
+	if _, err := os.Stat(filepath.Join(vp.OutputDir, outputFileName("summary", "", ""))); err == nil {
+		estimate.SummaryCached = true
+	}
+
+	if !estimate.ASRCached {
+		switch provider {
+		case "whisper":
+			estimate.ASRSeconds = duration * estimatedWhisperSpeedFactor
+		case "funasr":
+			estimate.ASRSeconds = duration * estimatedFunASRSpeedFactor
+		case "azure", "google":
+			estimate.ASRSeconds = duration * estimatedCloudASRSpeedFactor
+		default:
+			estimate.UploadParts = int((estimate.AudioSize + estimatedUploadPartSize - 1) / estimatedUploadPartSize)
+			estimate.ASRSeconds = duration * estimatedBcutSpeedFactor
+			if config.UploadRateLimit > 0 {
+				estimate.ASRSeconds += float64(estimate.AudioSize) / float64(config.UploadRateLimit)
+			}
+		}
+	}
+
+	estimate.EstimatedChars = int(duration / 60 * estimatedCharsPerMinute)
+	// 中文大致 1 字 ≈ 1 token
+	estimate.EstimatedTokens = estimate.EstimatedChars + estimatedPromptTokens + estimatedSummaryOutputTokens
+	estimate.EstimatedCost = float64(estimate.EstimatedTokens) / 1e6 * pricePerMTokens
+
+	return estimate, nil
+}
+
+// ==================== 资源监控 ====================
+
+var (
+	activeTasks   int64 // 正在进行的视频处理/转写任务数
+	runningFFmpeg int64 // 正在运行的 ffmpeg/ffprobe 子进程数
+)
+
+// trackTask 记录一个进行中的任务，返回结束时调用的函数
+func trackTask() func() {
+	atomic.AddInt64(&activeTasks, 1)
+	return func() { atomic.AddInt64(&activeTasks, -1) }
+}
+
+// trackFFmpeg 记录一个运行中的 ffmpeg/ffprobe 子进程，返回结束时调用的函数
+func trackFFmpeg() func() {
+	atomic.AddInt64(&runningFFmpeg, 1)
+	return func() { atomic.AddInt64(&runningFFmpeg, -1) }
+}
+
+// ResourceUsage 当前进程资源占用
+type ResourceUsage struct {
+	AllocMB       float64 `json:"alloc_mb"` // 堆上正在使用的内存
+	SysMB         float64 `json:"sys_mb"`   // 向系统申请的内存
+	NumGC         uint32  `json:"num_gc"`
+	Goroutines    int     `json:"goroutines"`
+	ActiveTasks   int64   `json:"active_tasks"`
+	FFmpegRunning int64   `json:"ffmpeg_running"`
+	NumCPU        int     `json:"num_cpu"`
+}
+
+// collectResourceUsage 采集内存、goroutine 和任务计数
+func collectResourceUsage() ResourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return ResourceUsage{
+		AllocMB:       float64(mem.Alloc) / 1024 / 1024,
+		SysMB:         float64(mem.Sys) / 1024 / 1024,
+		NumGC:         mem.NumGC,
+		Goroutines:    runtime.NumGoroutine(),
+		ActiveTasks:   atomic.LoadInt64(&activeTasks),
+		FFmpegRunning: atomic.LoadInt64(&runningFFmpeg),
+		NumCPU:        runtime.NumCPU(),
+	}
+}
+
+// ==================== 处理流程编排 ====================
+
+// defaultPipeline 未配置 -pipeline 时的默认流程：提取音频 -> 识别 -> 清洗 -> 合并 -> 生成字幕
+var defaultPipeline = []string{"audio", "asr", "clean", "merge", "subtitles"}
+
+// PipelineRequest /api/pipeline 请求，各步骤的参数与 /api/process 同名字段含义一致
+type PipelineRequest struct {
+	VideoPath     string       `json:"video_path"`
+	Steps         []string     `json:"steps"`           // 可选：有序的步骤名，不传使用服务器默认流程
+	Provider      string       `json:"provider"`        // asr：ASR服务名称
+	Language      string       `json:"language"`        // asr：识别语言
+	Clean         CleanOptions `json:"clean"`           // clean：清洗选项
+	MergeGap      float64      `json:"merge_gap"`       // merge：合并间隔，0 时使用 1 秒
+	MergeMaxChars int          `json:"merge_max_chars"` // merge：合并后单条字幕的最大字符数
+	MaxLineChars  int          `json:"max_line_chars"`  // split：单条字幕超过该字符数时拆分
+	TargetLang    string       `json:"target_lang"`     // translate：目标语言
+}
+
+// PipelineState 流程执行过程中在步骤之间传递的中间结果
+type PipelineState struct {
+	ctx        context.Context
+	vp         *VideoProcessor
+	Request    PipelineRequest
+	AudioPath  string
+	Segments   []DataSegment
+	Translated []DataSegment
+	Summary    *AIResponse
+	Files      map[string]string // 步骤生成的文件：名称 -> 路径
+}
+
+// PipelineStep 流程中的一个步骤，读取并更新 state 中的中间结果
+type PipelineStep func(s *HTTPServer, state *PipelineState) error
+
+// pipelineSteps 可编排的步骤，每个步骤包装一个已有的处理函数
+var pipelineSteps = map[string]PipelineStep{
+	// load 读取已缓存的 segments.json，用于跳过提取和识别
+	"load": func(s *HTTPServer, state *PipelineState) error {
+		segments, err := loadSegmentsFile(state.vp.OutputDir)
+		if err != nil {
+			return err
+		}
+		state.Segments = segments
+		return nil
+	},
+	"audio": func(s *HTTPServer, state *PipelineState) error {
+		audioPath, err := state.vp.ExtractAudio(nil)
+		if err != nil {
+			return fmt.Errorf("提取音频失败: %w", err)
+		}
+		state.AudioPath = audioPath
+		return nil
+	},
+	// asr 识别音频，原始结果写入 segments.json
+	"asr": func(s *HTTPServer, state *PipelineState) error {
+		if state.AudioPath == "" {
+			return fmt.Errorf("asr 之前需要先执行 audio 步骤")
+		}
+		provider, language := resolveASRLanguage(state.ctx, state.Request.Provider, state.Request.Language, state.AudioPath)
+		segments, _, err := s.recognize(state.ctx, provider, language, state.AudioPath, nil, nil)
+		if err != nil {
+			return err
+		}
+		state.Segments = segments
+
+		if data, err := json.MarshalIndent(segments, "", "  "); err == nil {
+			if err := os.WriteFile(filepath.Join(state.vp.OutputDir, "segments.json"), data, 0644); err == nil {
+				state.vp.MarkStage(StageASR)
+				registerProcessedVideo(state.vp)
+			}
+		}
+		return nil
+	},
+	"clean": func(s *HTTPServer, state *PipelineState) error {
+		state.Segments = CleanSegments(state.Segments, state.Request.Clean)
+		return nil
+	},
+	"merge": func(s *HTTPServer, state *PipelineState) error {
+		gap := state.Request.MergeGap
+		if gap <= 0 {
+			gap = variantMergeGap
+		}
+		state.Segments = mergeSegments(state.Segments, gap, state.Request.MergeMaxChars)
+		return nil
+	},
+	"split": func(s *HTTPServer, state *PipelineState) error {
+		state.Segments = splitLongSegments(state.Segments, state.Request.MaxLineChars)
+		return nil
+	},
+	"repunctuate": func(s *HTTPServer, state *PipelineState) error {
+		segments, err := NewAISummarizer(s.getAIConfig()).Repunctuate(state.Segments)
+		if err != nil {
+			return fmt.Errorf("标点恢复失败: %w", err)
+		}
+		state.Segments = segments
+		return nil
+	},
+	// translate 翻译当前字幕并保存 subtitles.<语言>.srt，后续步骤仍使用原文
+	"translate": func(s *HTTPServer, state *PipelineState) error {
+		if state.Request.TargetLang == "" {
+			return fmt.Errorf("translate 步骤缺少target_lang参数")
+		}
+		translated, err := NewAISummarizer(s.getAIConfig()).TranslateSegments(state.Segments, state.Request.TargetLang)
+		if err != nil {
+			return fmt.Errorf("翻译字幕失败: %w", err)
+		}
+		state.Translated = translated
+
+		path := filepath.Join(state.vp.OutputDir, outputFileName("srt", state.Request.TargetLang, ""))
+		if err := saveSRTFile(generateSRT(translated), path); err != nil {
+			return err
+		}
+		state.Files["translated_srt"] = path
+		return nil
+	},
+	// subtitles 用当前字幕生成 subtitles.srt / subtitles.vtt / transcript.txt
+	"subtitles": func(s *HTTPServer, state *PipelineState) error {
+		paths, err := ExportFormats(state.Segments, state.vp.OutputDir, []string{"srt", "vtt", "txt"}, "")
+		if err != nil {
+			return err
+		}
+		for format, path := range paths {
+			state.Files[format] = path
+		}
+		return nil
+	},
+	"summarize": func(s *HTTPServer, state *PipelineState) error {
+		response, err := NewAISummarizer(s.getAIConfig()).Summarize(AIRequest{
+			Segments:  state.Segments,
+			VideoPath: state.vp.VideoPath,
+		})
+		if err != nil {
+			return fmt.Errorf("AI总结失败: %w", err)
+		}
+		state.Summary = &response
+		return nil
+	},
+}
+
+// parsePipeline 解析逗号分隔的步骤列表 (保留顺序和重复的步骤)
+func parsePipeline(value string) []string {
+	var steps []string
+	for _, step := range strings.Split(value, ",") {
+		if step = strings.ToLower(strings.TrimSpace(step)); step != "" {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// validatePipeline 检查步骤名都已注册
+func validatePipeline(steps []string) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("处理流程为空")
+	}
+	for _, step := range steps {
+		if _, ok := pipelineSteps[step]; !ok {
+			names := make([]string, 0, len(pipelineSteps))
+			for name := range pipelineSteps {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("未知的处理步骤: %s (可选 %s)", step, strings.Join(names, "/"))
+		}
+	}
+	return nil
+}
+
+// RunPipeline 按顺序执行各步骤，每一步使用上一步的结果；任一步失败即停止并返回已完成的中间结果
+// 包含 audio 或 asr 步骤时占用处理名额
+func (s *HTTPServer) RunPipeline(ctx context.Context, req PipelineRequest) (*PipelineState, error) {
+	steps := req.Steps
+	if len(steps) == 0 {
+		steps = s.config.Pipeline
+	}
+	if len(steps) == 0 {
+		steps = defaultPipeline
+	}
+	if err := validatePipeline(steps); err != nil {
+		return nil, err
+	}
+
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		return nil, err
+	}
+	state := &PipelineState{ctx: ctx, vp: vp, Request: req, Files: make(map[string]string)}
+
+	for _, step := range steps {
+		if step == "audio" || step == "asr" {
+			release, err := s.limiter.Acquire(ctx, nil)
+			if err != nil {
+				return state, err
+			}
+			defer release()
+			break
+		}
+	}
+	defer trackTask()()
+
+	for i, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return state, err
+		}
+		if step != "load" && step != "audio" && step != "asr" && len(state.Segments) == 0 {
+			return state, fmt.Errorf("步骤 %s 没有可处理的识别结果，请先执行 load 或 asr", step)
+		}
+		Info("处理流程 [%d/%d]: %s", i+1, len(steps), step)
+		if err := pipelineSteps[step](s, state); err != nil {
+			return state, fmt.Errorf("步骤 %s 失败: %w", step, err)
+		}
+	}
+	return state, nil
+}
+
+// ==================== 任务管理 ====================
+
+// TaskInfo 一个视频处理任务的运行状态
+type TaskInfo struct {
+	ID        string    `json:"id"`
+	VideoPath string    `json:"video"`
+	Progress  int       `json:"progress"`
+	Message   string    `json:"message,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Elapsed   float64   `json:"elapsed"` // 已运行秒数
+}
+
+// QueueStatus 处理队列概况
+type QueueStatus struct {
+	Pending   int        `json:"pending"`
+	Running   int        `json:"running"`
+	Completed int        `json:"completed"`
+	Failed    int        `json:"failed"`
+	Tasks     []TaskInfo `json:"tasks"` // 正在运行的任务
+}
+
+// TaskManager 记录进行中的处理任务和已结束任务的计数 (进程内，重启后清零)
+type TaskManager struct {
+	mu        sync.Mutex
+	running   map[string]*TaskInfo
+	nextID    int64
+	completed int
+	failed    int
+}
+
+func NewTaskManager() *TaskManager {
+	return &TaskManager{running: make(map[string]*TaskInfo)}
+}
+
+var taskManager = NewTaskManager()
+
+// Start 登记一个开始运行的任务
+func (tm *TaskManager) Start(videoPath string) *TaskInfo {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.nextID++
+	task := &TaskInfo{
+		ID:        fmt.Sprintf("task_%d", tm.nextID),
+		VideoPath: videoPath,
+		StartedAt: time.Now(),
+	}
+	tm.running[task.ID] = task
+	return task
+}
+
+// Update 更新任务进度
+func (tm *TaskManager) Update(id string, progress int, message string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if task, ok := tm.running[id]; ok {
+		task.Progress = progress
+		task.Message = message
+	}
+}
+
+// Finish 任务结束，err 为 nil 记为完成，主动取消的不计数，否则记为失败
+func (tm *TaskManager) Finish(id string, err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.running[id]; !ok {
+		return
+	}
+	delete(tm.running, id)
+	if errors.Is(err, context.Canceled) {
+		// 主动取消的任务不计入失败
+		return
+	}
+	if err != nil {
+		tm.failed++
+	} else {
+		tm.completed++
+	}
+}
+
+// Status 返回队列概况，运行中的任务按开始时间排序
+func (tm *TaskManager) Status() QueueStatus {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	status := QueueStatus{
+		Running:   len(tm.running),
+		Completed: tm.completed,
+		Failed:    tm.failed,
+		Tasks:     make([]TaskInfo, 0, len(tm.running)),
+	}
+	for _, task := range tm.running {
+		info := *task
+		info.Elapsed = time.Since(task.StartedAt).Seconds()
+		status.Tasks = append(status.Tasks, info)
+	}
+	sort.Slice(status.Tasks, func(i, j int) bool { return status.Tasks[i].StartedAt.Before(status.Tasks[j].StartedAt) })
+	return status
+}
+
+// 异步任务状态
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// jobQueueSize 排队任务上限，超过时拒绝提交
+const jobQueueSize = 100
+
+// finishedJobTTL 已结束的任务在内存中保留的时间，之后只能从持久化的状态文件取回
+const finishedJobTTL = time.Hour
+
+// Job 异步处理任务
+type Job struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Progress   int              `json:"progress"`
+	Message    string           `json:"message,omitempty"`
+	VideoPath  string           `json:"video_path"`
+	OutputDir  string           `json:"output_dir,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Result     *ProcessResponse `json:"result,omitempty"`
+
+	request ProcessRequest
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// JobQueue 内存中的异步任务队列，固定数量的 worker 依次执行处理流程
+// 任务状态同时写入 dir/<id>.json (不含结果)，服务重启后仍可按 ID 取回已完成任务的缓存结果
+type JobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	queue   chan *Job
+	workers int
+	dir     string
+}
+
+func NewJobQueue(workers int, dir string) *JobQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &JobQueue{
+		jobs:    make(map[string]*Job),
+		queue:   make(chan *Job, jobQueueSize),
+		workers: workers,
+		dir:     dir,
+	}
+}
+
+// Start 启动 worker，process 为实际的处理流程
+func (q *JobQueue) Start(process func(ctx context.Context, req ProcessRequest, progress ProgressCallback) ProcessResponse) {
+	os.MkdirAll(q.dir, 0755)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			for job := range q.queue {
+				q.run(job, process)
+			}
+		}()
+	}
+}
+
+// Submit 提交任务，立即返回任务快照
+func (q *JobQueue) Submit(req ProcessRequest) (Job, error) {
+	req.queued = true
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        GenerateRandomString(16),
+		Status:    JobPending,
+		VideoPath: req.VideoPath,
+		CreatedAt: time.Now(),
+		request:   req,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	q.mu.Lock()
+	q.evictFinished()
+	select {
+	case q.queue <- job:
+	default:
+		q.mu.Unlock()
+		cancel()
+		return Job{}, fmt.Errorf("任务队列已满 (%d)，请稍后重试", jobQueueSize)
+	}
+	q.jobs[job.ID] = job
+	snapshot := *job
+	q.mu.Unlock()
+
+	q.persist(snapshot)
+	return snapshot, nil
+}
+
+// run 执行一个任务并记录进度和结果
+func (q *JobQueue) run(job *Job, process func(ctx context.Context, req ProcessRequest, progress ProgressCallback) ProcessResponse) {
+	defer job.cancel()
+	// 排队期间已被取消的任务直接跳过
+	if job.ctx.Err() != nil {
+		return
+	}
+	q.update(job, func(j *Job) { j.Status = JobRunning })
+
+	result := process(job.ctx, job.request, func(percent int, message string) {
+		q.update(job, func(j *Job) {
+			if j.Status == JobCancelled {
+				return
+			}
+			j.Progress = percent
+			j.Message = message
+		})
+	})
+
+	q.update(job, func(j *Job) {
+		if j.Status == JobCancelled {
+			return
+		}
+		now := time.Now()
+		j.FinishedAt = &now
+		j.Result = &result
+		j.OutputDir = result.OutputDir
+		j.Message = result.Message
+		if result.Success {
+			j.Status = JobCompleted
+			j.Progress = 100
+		} else {
+			j.Status = JobFailed
+		}
+	})
+}
+
+// Cancel 取消排队中或运行中的任务 (运行中的任务在识别查询时退出)
+// 已结束的任务不做处理，任务不存在时返回 false
+func (q *JobQueue) Cancel(id string) (Job, bool) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return q.Get(id)
+	}
+	if job.Status != JobPending && job.Status != JobRunning {
+		snapshot := *job
+		q.mu.Unlock()
+		return snapshot, true
+	}
+	job.cancel()
+	now := time.Now()
+	job.Status = JobCancelled
+	job.FinishedAt = &now
+	job.Message = "任务已取消"
+	snapshot := *job
+	q.mu.Unlock()
+
+	Info("已取消任务: %s (%s)", id, snapshot.VideoPath)
+	q.persist(snapshot)
+	return snapshot, true
+}
+
+// evictFinished 清理结束超过 finishedJobTTL 的任务，调用方需持有 q.mu
+func (q *JobQueue) evictFinished() {
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > finishedJobTTL {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// update 在锁内修改任务，状态变化时持久化
+func (q *JobQueue) update(job *Job, change func(j *Job)) {
+	q.mu.Lock()
+	status := job.Status
+	change(job)
+	snapshot := *job
+	q.mu.Unlock()
+
+	if snapshot.Status != status {
+		q.persist(snapshot)
+	}
+}
+
+// persist 保存任务状态 (不含结果，结果以输出目录中的缓存为准)
+func (q *JobQueue) persist(job Job) {
+	job.Result = nil
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(q.dir, job.ID+".json"), data, 0644); err != nil {
+		Warn("保存任务状态失败: %v", err)
+	}
+}
+
+// Get 返回任务快照；内存中没有时 (如服务重启后) 读取持久化的状态，
+// 已完成的任务从输出目录的 segments.json / summary.json 组装结果
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	if job, ok := q.jobs[id]; ok {
+		snapshot := *job
+		q.mu.Unlock()
+		return snapshot, true
+	}
+	q.mu.Unlock()
+
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return Job{}, false
+	}
+	data, err := os.ReadFile(filepath.Join(q.dir, id+".json"))
+	if err != nil {
+		return Job{}, false
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, false
+	}
+
+	switch job.Status {
+	case JobCompleted:
+		segments, err := loadSegmentsFile(job.OutputDir)
+		if err != nil {
+			job.Message = err.Error()
+			break
+		}
+		result := ProcessResponse{
+			Success:      true,
+			VideoPath:    job.VideoPath,
+			OutputDir:    job.OutputDir,
+			Segments:     segments,
+			SegmentCount: len(segments),
+		}
+		if data, err := os.ReadFile(filepath.Join(job.OutputDir, outputFileName("summary", "", ""))); err == nil {
+			var summary AIResponse
+			if json.Unmarshal(data, &summary) == nil {
+				result.AIResult = &summary
+			}
+		}
+		job.Result = &result
+	case JobPending, JobRunning:
+		job.Status = JobFailed
+		job.Message = "服务重启，任务已中断"
+	}
+	return job, true
+}
+
+// Pending 排队中的任务数
+func (q *JobQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	for _, job := range q.jobs {
+		if job.Status == JobPending {
+			count++
+		}
+	}
+	return count
+}
+
+// ErrServerBusy 同时处理的视频数和排队数均已达上限
+var ErrServerBusy = errors.New("服务器繁忙，请稍后重试")
+
+// ProcessLimiter 限制同时提取音频和识别的视频数，超出上限的请求排队等待
+type ProcessLimiter struct {
+	slots    chan struct{}
+	mu       sync.Mutex
+	waiting  int
+	maxQueue int
+}
+
+// NewProcessLimiter 创建处理限流器，concurrency 为同时处理数，maxQueue 为最多排队数
+func NewProcessLimiter(concurrency, maxQueue int) *ProcessLimiter {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	return &ProcessLimiter{
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: maxQueue,
+	}
+}
+
+// Acquire 获取处理名额，需要排队时以排队位置 (从 1 开始) 回调 onQueued
+// 排队已满时返回 ErrServerBusy，等待期间 ctx 取消时返回 ctx.Err()
+func (l *ProcessLimiter) Acquire(ctx context.Context, onQueued func(position int)) (func(), error) {
+	return l.acquire(ctx, onQueued, true)
+}
+
+// Wait 与 Acquire 相同，但不受排队上限限制，一直等到有空闲名额或 ctx 取消
+// 用于异步任务：任务已在任务队列中排过队，不应再因排队已满而失败
+func (l *ProcessLimiter) Wait(ctx context.Context, onQueued func(position int)) (func(), error) {
+	return l.acquire(ctx, onQueued, false)
+}
+
+func (l *ProcessLimiter) acquire(ctx context.Context, onQueued func(position int), limitQueue bool) (func(), error) {
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if limitQueue && l.waiting >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w (处理中 %d 个，排队 %d 个)", ErrServerBusy, cap(l.slots), l.maxQueue)
+	}
+	l.waiting++
+	position := l.waiting
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	Info("处理名额已满，排队第 %d 位", position)
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Waiting 返回正在排队等待处理名额的请求数
+func (l *ProcessLimiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+// ==================== HTTP服务 ====================
+
+// ServerConfig 服务端配置 (来自命令行参数和环境变量)
+type ServerConfig struct {
+	SMTP              SMTPConfig // 处理失败邮件告警
+	UploadRateLimit   int64      // 音频上传速率上限 (字节/秒)，0 表示不限速
+	UploadConcurrency int        // 同时上传的分片数，0 使用默认值
+	JobWorkers        int        // 异步任务并发数
+	MaxConcurrent     int        // 同时提取音频和识别的视频数
+	MaxQueue          int        // 超出并发数时最多排队的请求数
+	CORSOrigins       []string   // 允许跨域访问 /api/ 的来源，"*" 表示任意来源，为空时不启用 CORS
+	APIKey            string     // 访问密钥，设置后除 /api/health 外的所有请求都需要认证
+	AllowedDirs       []string   // DOWNLOAD_DIR 之外额外允许处理的视频目录
+	ServeAllowedDirs  bool       // 是否通过 /files-1/、/files-2/ ... 提供额外目录的访问，默认只允许处理不提供访问
+	KeepAudio         bool       // 识别完成后是否保留 audio.mp3 以便复用，false 时识别结果缓存后删除
+	Pipeline          []string   // /api/pipeline 未指定步骤时使用的默认流程
+	MaxDownloadSize   int64      // 远程视频下载大小上限 (字节)，<=0 时使用 DefaultMaxDownloadSize
+	AllowPrivateURLs  bool       // 是否允许下载本机/内网地址的远程视频，默认拒绝，避免借下载访问内部服务
+}
+
+type HTTPServer struct {
+	port     string
+	aiMu     sync.RWMutex // 保护 aiConfig，/api/config 更新时其他请求可能正在读取
+	aiConfig AIConfig
+	config   ServerConfig
+	alerter  *MailAlerter
+	jobs     *JobQueue
+	limiter  *ProcessLimiter
+}
+
+func NewHTTPServer(port string, serverConfig ServerConfig) *HTTPServer {
+	// 检查环境变量中的 API Key
+	config := AIConfig{}
+	if envKey := os.Getenv("ANTHROPIC_API_KEY"); envKey != "" {
+		config.APIKey = envKey
+		Info("已从环境变量加载 ANTHROPIC_API_KEY")
+	}
+
+	return &HTTPServer{
+		port:     port,
+		aiConfig: config,
+		config:   serverConfig,
+		alerter:  NewMailAlerter(serverConfig.SMTP),
+		jobs:     NewJobQueue(serverConfig.JobWorkers, filepath.Join(CacheDir, "jobs")),
+		limiter:  NewProcessLimiter(serverConfig.MaxConcurrent, serverConfig.MaxQueue),
+	}
+}
+
+func (s *HTTPServer) Start() {
+	s.alerter.Start()
+	s.jobs.Start(s.processJob)
+
+	// API路由
+	http.HandleFunc("/api/list-files", s.handleListFiles)
+	http.HandleFunc("/api/process-video", s.handleProcessVideo)
+	http.HandleFunc("/api/delete-output", s.handleDeleteOutput)
+	http.HandleFunc("/api/get-archive", s.handleGetArchive) // 新增：获取归档内容
+	http.HandleFunc("/api/restore-archive", s.handleRestoreArchive)
+	http.HandleFunc("/api/ai-summarize", s.handleAISummarize)
+	http.HandleFunc("/api/ai-chat", s.handleAIChat)
+	http.HandleFunc("/api/ai-chat/stream", s.handleAIChatStream)
+	http.HandleFunc("/api/config", s.handleConfig)
+	http.HandleFunc("/api/export-anki", s.handleExportAnki)
+	http.HandleFunc("/api/health", s.handleHealth)
+	http.HandleFunc("/feed.xml", s.handleFeed)
+	http.HandleFunc("/api/repunctuate", s.handleRepunctuate)
+	http.HandleFunc("/api/translate-subtitles", s.handleTranslateSubtitles)
+	http.HandleFunc("/api/search", s.handleSearch)
+	http.HandleFunc("/api/mindmap", s.handleMindmap)
+	http.HandleFunc("/api/generate-chapters", s.handleGenerateChapters)
+	http.HandleFunc("/api/extract-keywords", s.handleExtractKeywords)
+	http.HandleFunc("/api/write-chapters", s.handleWriteChapters)
+	http.HandleFunc("/api/stream-asr", s.handleStreamASR)
+	http.HandleFunc("/api/segmentation-score", s.handleSegmentationScore)
+	http.HandleFunc("/api/shift-subtitles", s.handleShiftSubtitles)
+	http.HandleFunc("/api/export-all", s.handleExportAll)
+	http.HandleFunc("/api/tags", s.handleTags)
+	http.HandleFunc("/api/resource-usage", s.handleResourceUsage)
+	http.HandleFunc("/api/generate-script", s.handleGenerateScript)
+	http.HandleFunc("/api/batch-resummarize", s.handleBatchResummarize)
+	http.HandleFunc("/api/export-subtitle", s.handleExportSubtitle)
+	http.HandleFunc("/api/cache", s.handleCache)
+	http.HandleFunc("/api/package-mkv", s.handlePackageMKV)
+	http.HandleFunc("/api/estimate", s.handleEstimate)
+	http.HandleFunc("/api/acronyms", s.handleAcronyms)
+	http.HandleFunc("/api/export-diff", s.handleExportDiff)
+	http.HandleFunc("/api/queue-status", s.handleQueueStatus)
+	http.HandleFunc("/api/notecards", s.handleNoteCards)
+	http.HandleFunc("/api/split-video", s.handleSplitVideo)
+	http.HandleFunc("/api/export-docx", s.handleExportDOCX)
+	http.HandleFunc("/api/process-video/stream", s.handleProcessVideoStream)
+	http.HandleFunc("/api/create-highlight-reel", s.handleCreateHighlightReel)
+	http.HandleFunc("/api/jobs", s.handleJobs)
+	http.HandleFunc("/api/jobs/", s.handleJob)
+	http.HandleFunc("/api/accuracy", s.handleAccuracy)
+	http.HandleFunc("/api/generate-titles", s.handleGenerateTitles)
+	http.HandleFunc("/api/key-sentences", s.handleKeySentences)
+	http.HandleFunc("/api/entities", s.handleEntities)
+	http.HandleFunc("/api/generate-quiz", s.handleGenerateQuiz)
+	http.HandleFunc("/api/pipeline", s.handleRunPipeline)
+
+	// 静态文件服务 (前端页面)
+	http.Handle("/", http.FileServer(http.Dir("./static")))
+
+	// 文件下载服务 (用于展示图片和下载结果)
+	// 映射 /files/ -> D:/download/；额外允许的目录只有显式开启 -serve-allowed-dirs 时才映射到 /files-1/、/files-2/ ...
+	if s.config.ServeAllowedDirs {
+		setExtraWebRoots(s.config.AllowedDirs)
+	}
+	for _, root := range servedWebRoots() {
+		http.Handle(root.Prefix, http.StripPrefix(root.Prefix, http.FileServer(http.Dir(root.Dir))))
+	}
+
+	Info("HTTP服务启动在端口: %s", s.port)
+	// localhost访问
+	Info("访问地址: http://localhost:%s/", s.port)
+	Info("静态文件目录: ./static")
+	Info("下载目录: %s (映射到 /files/)", DOWNLOAD_DIR)
+	for _, root := range extraWebRoots {
+		Info("额外目录: %s (映射到 %s)", root.Dir, root.Prefix)
+	}
+
+	if len(s.config.CORSOrigins) > 0 {
+		Info("已启用CORS，允许来源: %s", strings.Join(s.config.CORSOrigins, ", "))
+	}
+
+	if s.config.APIKey != "" {
+		Info("已启用API密钥认证")
+	}
+
+	err := http.ListenAndServe(":"+s.port, s.withCORS(s.withAuth(http.DefaultServeMux)))
+	if err != nil {
+		Error("HTTP服务启动失败: %v", err)
+	}
+}
+
+// withCORS 为 /api/ 下的接口添加跨域响应头并处理 OPTIONS 预检请求，静态文件不受影响
+func (s *HTTPServer) withCORS(next http.Handler) http.Handler {
+	if len(s.config.CORSOrigins) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := ""
+		for _, o := range s.config.CORSOrigins {
+			if o == "*" {
+				allowed = "*"
+				break
+			}
+			if strings.EqualFold(o, origin) {
+				allowed = origin
+				break
+			}
+		}
+		if allowed != "" {
+			header := w.Header()
+			header.Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				header.Add("Vary", "Origin")
+			}
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+			header.Set("Access-Control-Max-Age", "86400")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyCookie 浏览器通过 ?api_key= 认证一次后保存密钥的 Cookie，后续页面和接口请求自动携带
+const apiKeyCookie = "api_key"
+
+// withAuth 配置了 APIKey 时要求请求携带 Authorization: Bearer <key>、X-API-Key 或认证 Cookie
+// /api/health 保持公开，静态页面和 /files/ 同样需要认证
+func (s *HTTPServer) withAuth(next http.Handler) http.Handler {
+	if s.config.APIKey == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 浏览器打开 /?api_key=xxx 时写入 Cookie
+		if key := r.URL.Query().Get("api_key"); key != "" && s.validAPIKey(key) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     apiKeyCookie,
+				Value:    key,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !s.validAPIKey(requestAPIKey(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ai-video"`)
+			http.Error(w, "未认证或API密钥错误", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAPIKey 依次从 Authorization、X-API-Key 和 Cookie 中取出密钥
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if cookie, err := r.Cookie(apiKeyCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// validAPIKey 以固定时间比较密钥，避免通过响应时间猜测
+func (s *HTTPServer) validAPIKey(key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.config.APIKey)) == 1
+}
+
+// ErrPathNotAllowed 请求的路径不在允许访问的目录内
+var ErrPathNotAllowed = errors.New("路径不在允许访问的目录内")
+
+// allowedDirs 允许处理的目录：DOWNLOAD_DIR (归档、远程下载都在其中) 加上额外配置的目录
+func (s *HTTPServer) allowedDirs() []string {
+	return append([]string{DOWNLOAD_DIR}, s.config.AllowedDirs...)
+}
+
+// checkAllowedPath 检查路径转为绝对路径 (并解析符号链接) 后是否位于允许的目录内，防止 .. 越界
+func (s *HTTPServer) checkAllowedPath(path string) error {
+	for _, dir := range s.allowedDirs() {
+		if isWithinDir(dir, path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPathNotAllowed, path)
+}
+
+// realPath 转为绝对路径并解析符号链接，路径不存在时只转为绝对路径
+func realPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = resolved
+	}
+	return absPath, nil
+}
+
+// isWithinDir path 是否位于 dir 内 (含 dir 本身)，两者都先解析符号链接，防止 .. 和链接越界
+func isWithinDir(dir, path string) bool {
+	base, err := realPath(dir)
+	if err != nil {
+		return false
+	}
+	target, err := realPath(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(base, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkVideoPath 本地视频路径必须在允许的目录内，远程直链固定下载到 DOWNLOAD_DIR，下载时再检查地址
+// 不允许时返回 403 并返回 false
+func (s *HTTPServer) checkVideoPath(w http.ResponseWriter, videoPath string) bool {
+	if isRemoteVideoURL(videoPath) {
+		return true
+	}
+	if err := s.checkAllowedPath(videoPath); err != nil {
+		Warn("拒绝处理目录外的视频: %s", videoPath)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkRequestPaths 检查请求中的本地路径 (视频、输出目录、字幕等)，空值和远程直链跳过
+// 任一路径不在允许的目录内时返回 403 并返回 false
+func (s *HTTPServer) checkRequestPaths(w http.ResponseWriter, paths ...string) bool {
+	for _, path := range paths {
+		if path == "" || isRemoteVideoURL(path) {
+			continue
+		}
+		if err := s.checkAllowedPath(path); err != nil {
+			Warn("拒绝访问目录外的路径: %s", path)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// parseDirList 解析逗号分隔的目录列表
+func parseDirList(value string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// parseCORSOrigins 解析逗号分隔的来源列表，去掉末尾的 /
+func parseCORSOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// handleListFiles 列出下载目录文件
+func (s *HTTPServer) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := listDownloadFiles()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		files = filterFilesByTag(files, tag)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"files":   files,
+		"dir":     DOWNLOAD_DIR,
+	})
+}
+
+// handleGetArchive 获取归档内容
+func (s *HTTPServer) handleGetArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkAllowedPath(req.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	summaryPath := filepath.Join(req.Path, outputFileName("summary", "", ""))
+	data, err := os.ReadFile(summaryPath)
+	if err != nil {
+		http.Error(w, "读取归档失败: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleRestoreArchive 把归档移回 output_* 目录，之后可按正常流程重新处理或继续总结
+func (s *HTTPServer) handleRestoreArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "缺少path参数", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkAllowedPath(req.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	info, err := RestoreArchive(req.Path, s.allowedDirs())
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrRestoreTargetExists) {
+			status = http.StatusConflict
+		} else if errors.Is(err, ErrPathNotAllowed) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, "恢复归档失败: "+err.Error(), status)
+		return
+	}
+
+	message := "已恢复归档"
+	if info.VideoMissing {
+		message = "原视频不存在，仅恢复了总结和截图"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"message":       message,
+		"output_dir":    info.OutputDir,
+		"video_path":    info.VideoPath,
+		"video_missing": info.VideoMissing,
+	})
+}
+
+// handleProcessVideo 处理视频：提取音频 + ASR + SRT + 截图
+func (s *HTTPServer) handleProcessVideo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var req ProcessRequest
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.VideoPath == "" {
+		http.Error(w, "缺少video_path参数", http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = r.URL.Query().Get("format")
+	}
+	if !s.checkVideoPath(w, req.VideoPath) || !checkProcessFormat(w, &req) {
+		return
+	}
+
+	if err := s.resolveVideoPath(r.Context(), &req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ProcessResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// 客户端断开后识别继续在后台完成，结果写入缓存，下次请求直接复用
+	result := s.processVideo(context.Background(), req, nil)
+	w.Header().Set("Content-Type", "application/json")
+	if result.Busy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// processExtraFormats 处理请求的 format 参数支持的额外字幕格式 (srt/vtt/txt 总会生成)
+var processExtraFormats = []string{"ass", "lrc"}
+
+// checkProcessFormat 检查处理请求的 format 参数，不支持时返回 400 并列出支持的格式
+func checkProcessFormat(w http.ResponseWriter, req *ProcessRequest) bool {
+	req.Format = strings.ToLower(strings.TrimSpace(req.Format))
+	if req.Format == "" {
+		return true
+	}
+	for _, format := range processExtraFormats {
+		if req.Format == format {
+			return true
+		}
+	}
+	http.Error(w, fmt.Sprintf("不支持的字幕格式: %s (支持: %s)", req.Format, strings.Join(processExtraFormats, ", ")), http.StatusBadRequest)
+	return false
+}
+
+// resolveVideoPath 远程直链先下载到本地 (仅检查模式不触发下载)，并检查视频文件是否存在
+func (s *HTTPServer) resolveVideoPath(ctx context.Context, req *ProcessRequest) error {
+	if isRemoteVideoURL(req.VideoPath) {
+		if req.CheckOnly {
+			req.VideoPath = remoteVideoPath(req.VideoPath)
+		} else {
+			localPath, err := downloadRemoteVideo(ctx, req.VideoPath, s.config.MaxDownloadSize, s.config.AllowPrivateURLs)
+			if err != nil {
+				s.alerter.Notify(req.VideoPath, "下载视频", err)
+				return err
+			}
+			req.VideoPath = localPath
+		}
+	}
+
+	if _, err := os.Stat(req.VideoPath); os.IsNotExist(err) {
+		return fmt.Errorf("视频文件不存在")
+	}
+	return nil
+}
+
+// processJob 异步任务的处理流程：远程直链先在 worker 中下载，再执行 processVideo
+func (s *HTTPServer) processJob(ctx context.Context, req ProcessRequest, progress ProgressCallback) ProcessResponse {
+	if isRemoteVideoURL(req.VideoPath) {
+		progress(0, "正在下载视频...")
+	}
+	if err := s.resolveVideoPath(ctx, &req); err != nil {
+		return ProcessResponse{Success: false, Message: err.Error()}
+	}
+	return s.processVideo(ctx, req, progress)
+}
+
+// processVideo 处理流程：提取音频 + ASR + 字幕 + 截图，失败时返回 Success 为 false 的结果
+// ctx 取消时中止识别，progress 不为 nil 时回调整体进度
+func (s *HTTPServer) processVideo(ctx context.Context, req ProcessRequest, progress ProgressCallback) ProcessResponse {
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		return ProcessResponse{Success: false, Message: err.Error()}
+	}
+
+	// 只传 start 时识别到视频结尾
+	if req.Start > 0 && req.End <= 0 {
+		duration, err := vp.GetVideoDuration()
+		if err != nil {
+			return ProcessResponse{
+				Success: false,
+				Message: err.Error(),
+			}
+		}
+		req.End = duration
+	}
+
+	// 只识别部分时间段时单独缓存结果，不影响整段视频的 segments.json 和流程状态
+	rangeMode := req.End > 0
+	if rangeMode {
+		if err := vp.ValidateRange(req.Start, req.End); err != nil {
+			return ProcessResponse{
+				Success: false,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	// === 缓存检查开始 ===
+	// 1. 检查是否存在 segments.json (ASR结果)
+	segmentsPath := filepath.Join(vp.OutputDir, "segments.json")
+	if rangeMode {
+		segmentsPath = filepath.Join(vp.OutputDir, "segments_"+audioRangeName(req.Start, req.End)+".json")
+	}
+	var segments []DataSegment
+	segmentsLoaded := false
+
+	if data, err := os.ReadFile(segmentsPath); err == nil {
+		if json.Unmarshal(data, &segments) == nil && len(segments) > 0 {
+			Info("从缓存加载ASR结果: %s", segmentsPath)
+			segmentsLoaded = true
+		}
+	}
+	if segmentsLoaded && !rangeMode && !vp.StageDone(StageASR) {
+		// 兼容旧版本输出：segments.json 只在识别完成后写入
+		vp.MarkStage(StageASR)
+	}
+
+	// 内容相同的视频已处理过时直接复用其结果，避免重复ASR
+	if !segmentsLoaded && !req.CheckOnly && !rangeMode && reuseDuplicateOutput(vp) {
+		if data, err := os.ReadFile(segmentsPath); err == nil && json.Unmarshal(data, &segments) == nil && len(segments) > 0 {
+			segmentsLoaded = true
+			vp.MarkStage(StageASR)
+		}
+	}
+
+	// 2. 检查是否存在 summary.json (AI总结结果)
+	summaryPath := filepath.Join(vp.OutputDir, outputFileName("summary", "", ""))
+	var aiResult *AIResponse
+	if data, err := os.ReadFile(summaryPath); err == nil {
+		var res AIResponse
+		if json.Unmarshal(data, &res) == nil {
+			Info("从缓存加载AI总结: %s", summaryPath)
+			aiResult = &res
+		}
+	}
+	// === 缓存检查结束 ===
+
+	// 如果是仅检查模式
+	if req.CheckOnly {
+		if segmentsLoaded {
+			// 返回缓存数据
+			result := ProcessResponse{
+				Success:      true,
+				VideoPath:    vp.VideoPath,
+				Segments:     segments,
+				OutputDir:    vp.OutputDir,
+				SegmentCount: len(segments),
+				AIResult:     aiResult,
+			}
+			return result
+		} else {
+			// 未处理
+			return ProcessResponse{
+				Success: false,
+				Message: "未处理",
+			}
+		}
+	}
+
+	// 需要提取音频和识别时才占用处理名额，超出并发上限的请求排队
+	// 异步任务不受排队上限限制，等待到有空闲名额为止
+	if !segmentsLoaded {
+		acquire := s.limiter.Acquire
+		if req.queued {
+			acquire = s.limiter.Wait
+		}
+		release, err := acquire(ctx, func(position int) {
+			if progress != nil {
+				progress(0, fmt.Sprintf("服务器繁忙，排队中 (第 %d 位)...", position))
+			}
+		})
+		if err != nil {
+			return ProcessResponse{
+				Success: false,
+				Message: err.Error(),
+				Busy:    errors.Is(err, ErrServerBusy),
+			}
+		}
+		defer release()
+	}
+
+	defer trackTask()()
+
+	// 登记到任务管理，供 /api/queue-status 查看
+	task := taskManager.Start(vp.VideoPath)
+	var taskErr error
+	defer func() { taskManager.Finish(task.ID, taskErr) }()
+	report := func(percent int, message string) {
+		taskManager.Update(task.ID, percent, message)
+		if progress != nil {
+			progress(percent, message)
+		}
+	}
+
+	var audioPath string
+	var duration float64
+	var appliedOffset *float64
+	var providerUsed, language string
+
+	// 如果没有缓存，才进行音频提取和ASR
+	if !segmentsLoaded {
+		// 提取音频 (内部已实现存在检查)
+		if rangeMode {
+			audioPath, err = vp.ExtractAudioRange(req.Start, req.End)
+		} else {
+			audioPath, err = vp.ExtractAudio(func(percent int, message string) {
+				// 音频提取占任务进度的 0%-10%
+				report(percent/10, message)
+			})
+		}
+		if err != nil {
+			taskErr = err
+			message := "提取音频失败: " + err.Error()
+			if errors.Is(err, ErrNoAudioStream) {
+				// 无声视频不是服务故障，不发告警
+				message = ErrNoAudioStream.Error()
+			} else {
+				s.alerter.Notify(req.VideoPath, "提取音频", err)
+			}
+			return ProcessResponse{
+				Success: false,
+				Message: message,
+			}
+		}
+		// 默认不删除音频文件，以便复用；KeepAudio 为 false 时在识别结果缓存后删除
+
+		// ASR识别 - 禁用内部缓存，使用我们自己的文件缓存
+		// 先按音频内容查全局识别结果 (重复素材直接复用，不再消耗配额)
+		// 指定了时间校正、识别语言或其他ASR服务时重新识别
+		// 全局识别结果只保存默认参数 (无时间校正、不指定语言) 的识别，避免影响其他请求
+		// 只有默认参数才需要音频指纹，查找和保存共用同一次计算
+		defaultParams := req.Offset == nil && req.Language == "" && !req.SplitChannels
+		audioFingerprint := ""
+		if defaultParams {
+			if fingerprint, err := contentFingerprint(audioPath); err == nil {
+				audioFingerprint = fingerprint
+			} else {
+				Warn("计算音频指纹失败: %v", err)
+			}
+		}
+		var channelPaths []string // 分声道识别时提取的左右声道音频
+		if shared, ok := loadSharedASRResult(audioFingerprint); ok &&
+			(req.Provider == "" || req.Provider == shared.Provider) {
+			Info("音频内容与已识别的素材相同，复用识别结果 (%s)", shared.Provider)
+			segments = shared.Segments
+			providerUsed = shared.Provider
+			appliedOffset = shared.Offset
+		} else {
+			providerUsed, language = resolveASRLanguage(ctx, req.Provider, req.Language, audioPath)
+			// ASR 进度映射到任务进度的 10%-90%
+			progress := func(percent int, message string) {
+				report(10+percent*80/100, message)
+			}
+			recognizeAudio := func(provider string) ([]DataSegment, *float64, error) {
+				if req.SplitChannels {
+					segments, applied, paths, err := s.recognizeChannels(ctx, vp, provider, language, req.Start, req.End, req.Offset, progress)
+					if paths != nil {
+						channelPaths = paths
+					}
+					return segments, applied, err
+				}
+				return s.recognize(ctx, provider, language, audioPath, req.Offset, progress)
+			}
+			segments, appliedOffset, err = recognizeAudio(providerUsed)
+
+			// 主服务失败时改用备用服务 (主动取消的不重试)
+			if err != nil && req.FallbackProvider != "" && req.FallbackProvider != providerUsed &&
+				ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+				Warn("ASR服务 %s 失败，改用备用服务 %s: %v", providerUsed, req.FallbackProvider, err)
+				providerUsed = req.FallbackProvider
+				segments, appliedOffset, err = recognizeAudio(providerUsed)
+			}
+			if err != nil {
+				taskErr = err
+				s.alerter.Notify(req.VideoPath, "ASR识别", err)
+				return ProcessResponse{
+					Success: false,
+					Message: err.Error(),
+				}
+			}
+
+			saveSharedASRResult(audioFingerprint, providerUsed, segments, appliedOffset)
+		}
+
+		// 时间段识别的时间戳相对于片段开头，平移回原视频的绝对时间
+		if rangeMode {
+			segments = shiftSegments(segments, req.Start)
+		}
+
+		// 保存 segments.json
+		if data, err := json.MarshalIndent(segments, "", "  "); err == nil {
+			if err := os.WriteFile(segmentsPath, data, 0644); err == nil {
+				if !rangeMode {
+					vp.MarkStage(StageASR)
+					registerProcessedVideo(vp)
+				}
+				if !s.config.KeepAudio {
+					Info("清理临时音频文件: %s", audioPath)
+					if err := os.Remove(audioPath); err != nil {
+						Warn("删除音频文件失败: %v", err)
+					} else {
+						if !rangeMode {
+							vp.ClearStage(StageAudio)
+						}
+						audioPath = ""
+					}
+					for _, path := range channelPaths {
+						if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+							Warn("删除声道音频失败: %v", err)
+						}
+					}
+				}
+			}
+		}
+	} else {
+		// 如果加载了缓存，音频路径可能为空，但这不影响后续逻辑
+		audioPath = filepath.Join(vp.OutputDir, "audio.mp3") // 假路径
+		if rangeMode {
+			audioPath = filepath.Join(vp.OutputDir, "audio_"+audioRangeName(req.Start, req.End)+".mp3")
+		}
+	}
+
+	report(90, "正在生成字幕...")
+
+	// 字幕后处理 (仅影响本次返回和SRT，segments.json 保留原始识别结果)
+	if !req.FlagLowConfidence {
+		segments = dropLowConfidence(segments, req.MinConfidence)
+	}
+	segments = CleanSegments(segments, req.Clean)
+	segments = mergeSegments(segments, req.MergeGap, req.MergeMaxChars)
+	segments = splitLongSegments(segments, req.MaxLineChars)
+	if req.TargetCount > 0 {
+		segments = MergeToTargetCount(segments, req.TargetCount)
+	}
+
+	// 探测视频信息 (总是尝试获取，很快)
+	videoInfo, err := vp.GetVideoInfo()
+	if err != nil {
+		Warn("%v", err)
+	} else {
+		duration = videoInfo.Duration
+	}
+
+	// 截图：场景切换太少 (如静态讲座画面) 时回退到等间隔截图
+	screenshots := []string{}
+	var sceneShots []SceneShot
+	switch req.ScreenshotMode {
+	case "scene":
+		shots, sceneErr := vp.ExtractSceneScreenshots(req.SceneThreshold)
+		if sceneErr == nil && len(shots) >= minSceneScreenshots {
+			sceneShots = shots
+			for _, shot := range sceneShots {
+				screenshots = append(screenshots, shot.Path)
+			}
+			break
+		}
+		// 回退前删除已生成的少量场景截图，避免与等间隔截图混在一起
+		Warn("场景截图不足 (%d 张)，改用等间隔截图", len(shots))
+		vp.RemoveSceneScreenshots()
+		if shots, err := vp.ExtractScreenshots(duration); err != nil {
+			Warn("截图失败: %v", err)
+		} else {
+			screenshots = shots
+		}
+	case "interval":
+		if shots, err := vp.ExtractScreenshots(duration); err != nil {
+			Warn("截图失败: %v", err)
+		} else {
+			screenshots = shots
+		}
+	}
+
+	// 生成SRT (总是重新生成或覆盖，很快)
+	cueSegments := wrapSegments(segments, req.WrapChars)
+	srtContent := generateSRT(cueSegments)
+	srtPath := filepath.Join(vp.OutputDir, outputFileName("srt", "", ""))
+	if err := saveSRTFile(srtContent, srtPath); err != nil {
+		Warn("%v", err)
+	}
+
+	// 生成WebVTT (与SRT放在同一目录)
+	vttContent := generateVTT(cueSegments, req.VTTCueIDs)
+	vttPath := filepath.Join(vp.OutputDir, outputFileName("vtt", "", ""))
+	if err := saveSubtitleFile(vttContent, vttPath); err != nil {
+		Warn("%v", err)
+	}
+
+	// 生成纯文本稿
+	textContent := generatePlainText(segments, req.ParagraphGap)
+	textPath := filepath.Join(vp.OutputDir, outputFileName("txt", "", ""))
+	if err := saveSubtitleFile(textContent, textPath); err != nil {
+		Warn("%v", err)
+	}
+
+	// 已知识别语言时另存一份带语言标签的字幕 (subtitles.<lang>.srt)，不同语言的结果不会互相覆盖
+	subtitleLang := language
+	if subtitleLang == "" && req.Language != "auto" {
+		subtitleLang = req.Language
+	}
+	if subtitleLang != "" && subtitleLang != "auto" {
+		for kind, content := range map[string]string{"srt": srtContent, "vtt": vttContent, "txt": textContent} {
+			if err := saveSubtitleFile(content, filepath.Join(vp.OutputDir, outputFileName(kind, subtitleLang, ""))); err != nil {
+				Warn("%v", err)
+			}
+		}
+	}
+
+	// 按需导出的额外格式
+	var formatPath, formatContent string
+	switch req.Format {
+	case "":
+	case "ass":
+		formatContent = generateASS(cueSegments, req.ASSStyle)
+		formatPath = filepath.Join(vp.OutputDir, outputFileName("ass", "", ""))
+	case "lrc":
+		formatContent = generateLRC(segments, req.LRCMeta)
+		formatPath = filepath.Join(vp.OutputDir, outputFileName("lrc", "", ""))
+	default:
+		Warn("不支持的字幕格式: %s", req.Format)
+	}
+	if formatPath != "" {
+		if err := saveSubtitleFile(formatContent, formatPath); err != nil {
+			Warn("%v", err)
+		}
+	}
+
+	warnings := ValidateSegments(segments, req.Validate)
+	if req.FlagLowConfidence {
+		warnings = append(warnings, LowConfidenceSegments(segments, req.MinConfidence)...)
+	}
+
+	// 返回结果
+	result := ProcessResponse{
+		Success:       true,
+		VideoPath:     vp.VideoPath,
+		AudioPath:     audioPath,
+		SrtPath:       srtPath,
+		SrtContent:    srtContent,
+		VttPath:       vttPath,
+		VttContent:    vttContent,
+		TextPath:      textPath,
+		TextContent:   textContent,
+		Format:        req.Format,
+		FormatPath:    formatPath,
+		FormatContent: formatContent,
+		Segments:      segments,
+		Screenshots:   screenshots, // 默认不截图，screenshot_mode 指定时返回
+		SceneShots:    sceneShots,
+		OutputDir:     vp.OutputDir,
+		Duration:      duration,
+		VideoInfo:     videoInfo,
+		SegmentCount:  len(segments),
+		AIResult:      aiResult, // 返回缓存的AI结果
+		Warnings:      warnings,
+		Offset:        appliedOffset,
+		ProviderUsed:  providerUsed,
+		Language:      language,
+	}
+
+	return result
+}
+
+// recognize 用指定的识别服务识别音频，返回结果和实际使用的时间戳校正
+func (s *HTTPServer) recognize(ctx context.Context, provider, language, audioPath string, offset *float64, progress ProgressCallback) ([]DataSegment, *float64, error) {
+	asrClient, provider, _, err := NewASRService(ctx, provider, language, audioPath, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建ASR服务失败: %w", err)
+	}
+
+	// 时间戳校正只作用于新识别的结果，已缓存的 segments.json 不受影响
+	var appliedOffset *float64
+	if setter, ok := asrClient.(timeOffsetSetter); ok {
+		value := TimeOffset
+		if offset != nil {
+			value = *offset
+		}
+		setter.SetTimeOffset(value)
+		appliedOffset = &value
+	}
+	if setter, ok := asrClient.(uploadOptionsSetter); ok {
+		setter.SetUploadOptions(s.config.UploadRateLimit, s.config.UploadConcurrency)
+	}
+
+	segments, err := asrClient.GetResult(ctx, func(percent int, message string) {
+		Info("ASR进度 [%s]: %d%% - %s", provider, percent, message)
+		if progress != nil {
+			progress(percent, message)
+		}
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("ASR识别失败: %w", err)
+	}
+	return segments, appliedOffset, nil
+}
+
+// recognizeChannels 左右声道分别识别，标上说话人后按时间合并
+// end > 0 时只识别 start-end 时间段，时间戳相对于片段开头
+// 同时返回提取的声道音频路径 (识别失败时也返回)，供调用方按 KeepAudio 清理
+func (s *HTTPServer) recognizeChannels(ctx context.Context, vp *VideoProcessor, provider, language string, start, end float64, offset *float64, progress ProgressCallback) ([]DataSegment, *float64, []string, error) {
+	channels, err := vp.ExtractAudioChannels(start, end)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var merged []DataSegment
+	var appliedOffset *float64
+	for i, channelPath := range channels {
+		// 两个声道各占一半进度
+		channelProgress := func(percent int, message string) {
+			if progress != nil {
+				progress((i*100+percent)/len(channels), message)
+			}
+		}
+		segments, applied, err := s.recognize(ctx, provider, language, channelPath, offset, channelProgress)
+		if err != nil {
+			return nil, nil, channels, fmt.Errorf("声道 %d: %w", i+1, err)
+		}
+		speaker := fmt.Sprintf("说话人%d", i+1)
+		for _, seg := range segments {
+			seg.Speaker = speaker
+			merged = append(merged, seg)
+		}
+		appliedOffset = applied
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].StartTime < merged[j].StartTime })
+	return merged, appliedOffset, channels, nil
+}
+
+// handleDeleteOutput 删除输出目录
+func (s *HTTPServer) handleDeleteOutput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 调用新的归档并清理方法
+	if err := vp.ArchiveAndClean(); err != nil {
+		http.Error(w, "删除/归档失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleAISummarize 处理AI总结
+func (s *HTTPServer) handleAISummarize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var req AIRequest
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	// 开启 Vision 时截图会被读取并发送给 AI 服务，绝对路径和 Web 路径同样必须在允许的目录内
+	for _, shot := range req.Screenshots {
+		path, ok := fromWebPath(shot)
+		if !ok {
+			if !filepath.IsAbs(shot) {
+				continue // 相对路径限定在输出目录内，由 resolveScreenshotPaths 检查
+			}
+			path = shot
+		}
+		if err := s.checkAllowedPath(path); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	response, err := aiSummarizer.Summarize(req)
+	if err != nil {
+		http.Error(w, "AI总结失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleAIChat 处理AI对话
+func (s *HTTPServer) handleAIChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	reply, err := aiSummarizer.Chat(req)
+	if err != nil {
+		http.Error(w, "AI对话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"reply":   reply,
+	})
+}
+
+// handleAIChatStream 流式AI对话，以 Server-Sent Events 推送
+// 依次发送 delta 事件 ({content})，结束时发送 done 事件 ({reply})，失败时发送 error 事件 ({message})
+func (s *HTTPServer) handleAIChatStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	controller := http.NewResponseController(w)
+
+	sendEvent := func(event string, data interface{}) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		controller.Flush()
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	reply, err := aiSummarizer.ChatStream(r.Context(), req, func(delta string) {
+		sendEvent("delta", map[string]interface{}{"content": delta})
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		sendEvent("error", map[string]interface{}{"message": "AI对话失败: " + err.Error()})
+		return
+	}
+	sendEvent("done", map[string]interface{}{"reply": reply})
+}
+
+// getAIConfig 返回当前AI配置的副本
+func (s *HTTPServer) getAIConfig() AIConfig {
+	s.aiMu.RLock()
+	defer s.aiMu.RUnlock()
+	return s.aiConfig
+}
+
+// setAIConfig 整体替换AI配置
+func (s *HTTPServer) setAIConfig(config AIConfig) {
+	s.aiMu.Lock()
+	defer s.aiMu.Unlock()
+	s.aiConfig = config
+}
+
+// handleConfig 处理AI配置
+func (s *HTTPServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		var config AIConfig
+		if err := decoder.Decode(&config); err != nil {
+			http.Error(w, "解析配置失败: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.setAIConfig(config)
+		Info("AI配置更新: APIURL=%s, Model=%s, Temperature=%g, MaxTokens=%d, TopP=%g, Vision=%v", config.APIURL, config.Model, config.Temperature, config.MaxTokens, config.TopP, config.Vision)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "配置更新成功",
+			"config":  config,
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"config":  s.getAIConfig(),
+		})
+		return
+	}
+
+	http.Error(w, "只支持GET或POST方法", http.StatusMethodNotAllowed)
+}
+
+func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "healthy",
+		"timestamp": time.Now(),
+	})
+}
+
+// handleExportAnki 导出 Anki 记忆卡
+func (s *HTTPServer) handleExportAnki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath  string        `json:"video_path"`
+		Translated []DataSegment `json:"translated"` // 可选：与原文一一对应的译文
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := loadSegmentsFile(vp.OutputDir)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	csvPath, err := ExportAnki(segments, req.Translated, filepath.Join(vp.OutputDir, "audio.mp3"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "导出Anki失败: " + err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    csvPath,
+	})
+}
+
+// handleFeed 输出视频总结的 RSS 订阅
+func (s *HTTPServer) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	data, err := buildRSSFeed(collectSummaries(), scheme+"://"+r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(data)
+}
+
+// handleRepunctuate AI恢复标点并重新断句
+func (s *HTTPServer) handleRepunctuate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	result, err := aiSummarizer.Repunctuate(segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "标点恢复失败: " + err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"segments": result,
+	})
+}
+
+// handleTranslateSubtitles 翻译字幕并保存为 subtitles.<语言>.srt，时间轴与原字幕一致
+// bilingual 为 true 时另存原文+译文的双语字幕 subtitles.<语言>.bilingual.srt
+func (s *HTTPServer) handleTranslateSubtitles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath  string        `json:"video_path"`
+		Segments   []DataSegment `json:"segments"`    // 可选：不传则读取缓存的 segments.json
+		TargetLang string        `json:"target_lang"` // 目标语言，如 en / ja / 英语
+		Bilingual  bool          `json:"bilingual"`   // 同时生成原文+译文的双语字幕
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+	req.TargetLang = strings.TrimSpace(req.TargetLang)
+	if req.TargetLang == "" {
+		http.Error(w, "缺少target_lang参数", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	translated, err := aiSummarizer.TranslateSegments(segments, req.TargetLang)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "翻译字幕失败: " + err.Error(),
+		})
+		return
+	}
+
+	srtPath := filepath.Join(vp.OutputDir, outputFileName("srt", req.TargetLang, ""))
+	if err := saveSRTFile(generateSRT(translated), srtPath); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	Info("翻译字幕已保存到: %s", srtPath)
+
+	result := map[string]interface{}{
+		"success":  true,
+		"segments": translated,
+		"srt_path": srtPath,
+	}
+	if req.Bilingual {
+		content, err := generateBilingualSRT(segments, translated)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		bilingualPath := filepath.Join(vp.OutputDir, outputFileName("srt", req.TargetLang, "bilingual"))
+		if err := saveSRTFile(content, bilingualPath); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		result["bilingual_path"] = bilingualPath
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleSearch 全局搜索识别结果
+func (s *HTTPServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "缺少q参数", http.StatusBadRequest)
+		return
+	}
+
+	hits := GlobalSearch(query)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"hits":    hits,
+		"count":   len(hits),
+	})
+}
+
+// handleMindmap 生成带时间轴的思维导图
+func (s *HTTPServer) handleMindmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"`
+		Format    string        `json:"format"` // json(默认) / markmap / freemind
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	root, err := aiSummarizer.GenerateMindmap(segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "生成思维导图失败: " + err.Error(),
+		})
+		return
+	}
+
+	result := map[string]interface{}{
+		"success": true,
+		"mindmap": root,
+	}
+	switch req.Format {
+	case "markmap":
+		result["content"] = formatMindmapMarkmap(root)
+	case "freemind":
+		result["content"] = formatMindmapFreemind(root)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleWriteChapters 把章节写入视频元数据
+func (s *HTTPServer) handleWriteChapters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string    `json:"video_path"`
+		Chapters  []Chapter `json:"chapters"` // 可选：不传则读取输出目录的 chapters.json
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(req.Chapters) == 0 {
+		if vp, err := NewVideoProcessor(req.VideoPath); err == nil {
+			if data, err := os.ReadFile(filepath.Join(vp.OutputDir, "chapters.json")); err == nil {
+				json.Unmarshal(data, &req.Chapters)
+			}
+		}
+	}
+
+	outputPath, err := WriteChaptersToMP4(req.VideoPath, req.Chapters)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    outputPath,
+	})
+}
+
+// maxStreamChunkSeconds 流式转写每块的最大时长，避免按客户端参数分配过大的缓冲区
+const maxStreamChunkSeconds = 120
+
+// handleStreamASR 准实时转写 (实验)：接收分块上传的原始 PCM 音频流
+// (s16le / 16kHz / 单声道)，每累积 chunk_seconds 秒送一次必剪ASR，以 NDJSON 逐行返回增量字幕
+func (s *HTTPServer) handleStreamASR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chunkSeconds := 30
+	if value := r.URL.Query().Get("chunk_seconds"); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v <= 0 || v > maxStreamChunkSeconds {
+			http.Error(w, fmt.Sprintf("chunk_seconds 必须在 1-%d 之间", maxStreamChunkSeconds), http.StatusBadRequest)
+			return
+		}
+		chunkSeconds = v
+	}
+	const bytesPerSecond = 16000 * 2 // 16kHz * 16bit 单声道
+	chunkSize := chunkSeconds * bytesPerSecond
+
+	// 整个流占用一个处理名额，与其他识别任务共享并发上限
+	release, err := s.limiter.Acquire(r.Context(), nil)
+	if err != nil {
+		if errors.Is(err, ErrServerBusy) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer release()
+	defer trackTask()()
+
+	tempDir, err := os.MkdirTemp("", "stream_asr_")
+	if err != nil {
+		http.Error(w, "创建临时目录失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 边读请求体边写响应
+	controller := http.NewResponseController(w)
+	if err := controller.EnableFullDuplex(); err != nil {
+		Warn("启用全双工失败，增量结果可能在上传结束后才返回: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+
+	ctx := r.Context()
+	buffer := make([]byte, chunkSize)
+	for chunkIndex := 0; ; chunkIndex++ {
+		n, readErr := io.ReadFull(r.Body, buffer)
+		if n > 0 {
+			offset := float64(chunkIndex * chunkSeconds)
+			segments, err := s.transcribePCMChunk(ctx, tempDir, chunkIndex, buffer[:n], offset)
+			if err != nil {
+				encoder.Encode(map[string]interface{}{"success": false, "chunk": chunkIndex, "message": err.Error()})
+			} else {
+				encoder.Encode(map[string]interface{}{"success": true, "chunk": chunkIndex, "segments": segments})
+			}
+			controller.Flush()
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			Warn("读取音频流失败: %v", readErr)
+			break
+		}
+	}
+}
+
+// transcribePCMChunk 把一块 PCM 数据转为 mp3 后识别，时间戳加上该块在流中的偏移
+func (s *HTTPServer) transcribePCMChunk(ctx context.Context, tempDir string, index int, pcm []byte, offset float64) ([]DataSegment, error) {
+	pcmPath := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.pcm", index))
+	mp3Path := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.mp3", index))
+	if err := os.WriteFile(pcmPath, pcm, 0644); err != nil {
+		return nil, fmt.Errorf("写入音频块失败: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-f", "s16le", "-ar", "16000", "-ac", "1", "-i", pcmPath,
+		"-acodec", "libmp3lame", "-y", mp3Path)
+	done := trackFFmpeg()
+	err := cmd.Run()
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("转换音频块失败: %v", err)
+	}
+
+	asrClient, err := NewBcutASR(mp3Path, false)
+	if err != nil {
+		return nil, err
+	}
+	asrClient.SetUploadOptions(s.config.UploadRateLimit, s.config.UploadConcurrency)
+	segments, err := asrClient.GetResult(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range segments {
+		segments[i].StartTime += offset
+		segments[i].EndTime += offset
+	}
+	return segments, nil
+}
+
+// handleSegmentationScore 评估识别结果的分段质量
+func (s *HTTPServer) handleSegmentationScore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"score":   ScoreSegmentation(segments),
+	})
+}
+
+// handleShiftSubtitles 整体平移已有字幕的时间轴 (不重新提取音频和识别)
+func (s *HTTPServer) handleShiftSubtitles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath     string  `json:"video_path"`
+		OffsetSeconds float64 `json:"offset_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	vp, err := NewVideoProcessor(req.VideoPath)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	segments, err := loadSegmentsFile(vp.OutputDir)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	segments = shiftSegments(segments, req.OffsetSeconds)
+
+	// 写回 segments.json，之后重新生成的字幕也保持平移后的时间
+	data, err := json.MarshalIndent(segments, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(vp.OutputDir, "segments.json"), data, 0644)
+	}
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "保存识别结果失败: " + err.Error(),
+		})
+		return
+	}
+
+	srtPath := filepath.Join(vp.OutputDir, outputFileName("srt", "", ""))
+	if err := saveSRTFile(generateSRT(segments), srtPath); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	Info("字幕整体平移 %.3f 秒: %s", req.OffsetSeconds, srtPath)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"srt_path": srtPath,
+		"segments": segments,
+	})
+}
+
+// handleExportAll 一次导出多种字幕格式 (?output_dir=&formats=srt,vtt,txt&variant=raw,merged,cps&zip=1)
+func (s *HTTPServer) handleExportAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	outputDir := query.Get("output_dir")
+	if outputDir == "" {
+		http.Error(w, "缺少output_dir参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, outputDir) {
+		return
+	}
+	formats := parseFormatList(query.Get("formats"))
+	if len(formats) == 0 {
+		formats = []string{"srt", "vtt", "txt"}
+	}
+
+	encoding, err := normalizeSubtitleEncoding(query.Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	segments, err := loadSegmentsFile(outputDir)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var paths map[string]string
+	if variants := parseFormatList(query.Get("variant")); len(variants) > 0 {
+		paths, err = ExportVariants(segments, outputDir, formats, variants, encoding)
+	} else {
+		paths, err = ExportFormats(segments, outputDir, formats, encoding)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if query.Get("zip") == "1" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(outputDir)+".zip"))
+		if err := writeExportZip(w, paths); err != nil {
+			Error("打包导出文件失败: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"paths":    paths,
+		"encoding": encoding,
+	})
+}
+
+// handleTags GET 返回所有标签及计数，POST 设置某个处理结果的标签
+func (s *HTTPServer) handleTags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"tags":    collectTagCounts(),
+		})
+	case http.MethodPost:
+		var req struct {
+			VideoPath string   `json:"video_path"`
+			OutputDir string   `json:"output_dir"` // 归档项直接传输出目录
+			Tags      []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "解析请求失败", http.StatusBadRequest)
+			return
+		}
+		if !s.checkRequestPaths(w, req.VideoPath, req.OutputDir) {
+			return
+		}
+
+		outputDir := req.OutputDir
+		if outputDir == "" {
+			vp, err := NewVideoProcessor(req.VideoPath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			outputDir = vp.OutputDir
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := saveTags(outputDir, req.Tags); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"tags":    loadTags(outputDir),
+		})
+	default:
+		http.Error(w, "只支持GET/POST方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleResourceUsage 返回当前进程的资源占用，用于判断是否需要降低并发
+func (s *HTTPServer) handleResourceUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"usage":   collectResourceUsage(),
+	})
+}
+
+// handleGenerateScript 把字幕改写成书面文稿
+func (s *HTTPServer) handleGenerateScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	markdown, err := aiSummarizer.GenerateScript(segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "生成文稿失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 有视频路径时把文稿保存到输出目录
+	result := map[string]interface{}{
+		"success":  true,
+		"markdown": markdown,
+	}
+	if req.VideoPath != "" {
+		if vp, err := NewVideoProcessor(req.VideoPath); err == nil {
+			scriptPath := filepath.Join(vp.OutputDir, "script.md")
+			if err := saveSubtitleFile(markdown, scriptPath); err != nil {
+				Warn("%v", err)
+			} else {
+				result["path"] = scriptPath
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// maxResummarizeConcurrency 批量重新总结的最大并发数，避免同时发出过多付费的AI请求
+const maxResummarizeConcurrency = 4
+
+// handleBatchResummarize 用当前AI配置重新总结所有已识别的视频
+// 以 NDJSON 逐行返回每个视频的结果，最后一行为汇总
+func (s *HTTPServer) handleBatchResummarize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Concurrency int  `json:"concurrency"` // 同时进行的总结数，默认 2
+		Overwrite   bool `json:"overwrite"`   // 已有 summary.json 时是否覆盖，默认跳过
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency <= 0 {
+		req.Concurrency = 2
+	}
+	req.Concurrency = min(req.Concurrency, maxResummarizeConcurrency)
+	if s.getAIConfig().APIKey == "" {
+		http.Error(w, "未配置AI API Key", http.StatusBadRequest)
+		return
+	}
+
+	// 只处理有识别结果的输出目录 (归档目录已不含 segments.json)
+	var outputDirs []string
+	for _, dir := range listOutputDirs(false) {
+		if _, err := os.Stat(filepath.Join(dir, "segments.json")); err != nil {
+			continue
+		}
+		if !req.Overwrite {
+			if _, err := os.Stat(filepath.Join(dir, outputFileName("summary", "", ""))); err == nil {
+				continue
+			}
+		}
+		outputDirs = append(outputDirs, dir)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	var writeMu sync.Mutex
+	report := func(v interface{}) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		encoder.Encode(v)
+		controller.Flush()
+	}
+
+	// 客户端断开后不再发起新的总结 (已开始的会完成并保存)
+	ctx := r.Context()
+	var wg sync.WaitGroup
+	var doneCount, failCount int64
+	sem := make(chan struct{}, req.Concurrency)
+dispatch:
+	for _, dir := range outputDirs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// output_<文件名> 与视频在同一目录
+			videoPath := filepath.Join(filepath.Dir(dir), strings.TrimPrefix(filepath.Base(dir), "output_"))
+			err := s.resummarize(dir, videoPath)
+
+			done := atomic.AddInt64(&doneCount, 1)
+			item := map[string]interface{}{
+				"success": err == nil,
+				"video":   videoPath,
+				"done":    done,
+				"total":   len(outputDirs),
+			}
+			if err != nil {
+				atomic.AddInt64(&failCount, 1)
+				item["message"] = err.Error()
+				Warn("重新总结失败 %s: %v", videoPath, err)
+			}
+			report(item)
+		}(dir)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		Warn("客户端已断开，停止批量重新总结 (已完成 %d/%d)", doneCount, len(outputDirs))
+		return
+	}
+
+	report(map[string]interface{}{
+		"finished": true,
+		"total":    len(outputDirs),
+		"failed":   failCount,
+	})
+}
+
+// resummarize 读取输出目录的识别结果重新生成总结 (Summarize 内部保存 summary.json)
+func (s *HTTPServer) resummarize(outputDir, videoPath string) error {
+	segments, err := loadSegmentsFile(outputDir)
+	if err != nil {
+		return err
+	}
+
+	texts := make([]string, len(segments))
+	for i, seg := range segments {
+		texts[i] = seg.Text
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	// 批量重新总结要求重新调用AI，不复用总结缓存
+	_, err = aiSummarizer.Summarize(AIRequest{
+		Text:      strings.Join(texts, "\n"),
+		Segments:  segments,
+		VideoPath: videoPath,
+		Refresh:   true,
+	})
+	return err
+}
+
+// handleExportSubtitle 导出单个格式的字幕，可只导出选中的片段 (序号重新编排)
+func (s *HTTPServer) handleExportSubtitle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		Format    string        `json:"format"`   // srt(默认) / vtt / txt / ass / lrc
+		Indices   []int         `json:"indices"`  // 可选：只导出这些序号 (从 0 开始) 的片段
+		Ranges    []TimeRange   `json:"ranges"`   // 可选：只导出与这些时间范围重叠的片段
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+	if req.Format == "" {
+		req.Format = "srt"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	exporter, ok := subtitleExporters[strings.ToLower(req.Format)]
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "不支持的字幕格式: " + req.Format,
+		})
+		return
+	}
+
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	segments = selectSegments(segments, req.Indices, req.Ranges)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"file_name":     exporter.fileName,
+		"content":       exporter.generate(segments),
+		"segment_count": len(segments),
+	})
+}
+
+// handleCache GET 列出缓存文件，DELETE 按 ?key= 删除单个缓存，?all=true 时清空全部缓存
+func (s *HTTPServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	entries := listCacheEntries()
+
+	switch r.Method {
+	case http.MethodGet:
+		var totalSize int64
+		for _, entry := range entries {
+			totalSize += entry.Size
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"entries":    entries,
+			"total_size": totalSize,
+		})
+	case http.MethodDelete:
+		// 只允许删除列表中的缓存文件；清空全部需要显式传 all=true，避免漏传 key 误删所有缓存
+		key := r.URL.Query().Get("key")
+		if key == "" && r.URL.Query().Get("all") != "true" {
+			http.Error(w, "缺少key参数 (清空全部缓存请传 all=true)", http.StatusBadRequest)
+			return
+		}
+		removed := 0
+		var freed int64
+		for _, entry := range entries {
+			if key != "" && entry.Key != key {
+				continue
+			}
+			if err := os.Remove(entry.Key); err != nil {
+				Warn("删除缓存失败 %s: %v", entry.Key, err)
+				continue
+			}
+			removed++
+			freed += entry.Size
+		}
+		Info("清理缓存 %d 个文件，释放 %d 字节", removed, freed)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"removed":     removed,
+			"bytes_freed": freed,
+		})
+	default:
+		http.Error(w, "只支持GET/DELETE方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePackageMKV 把视频、字幕、章节和封面封装为 MKV
+func (s *HTTPServer) handlePackageMKV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string            `json:"video_path"`
+		Subtitles map[string]string `json:"subtitles"` // 语言代码 -> 字幕文件，不传则使用输出目录的 subtitles.srt
+		Chapters  []Chapter         `json:"chapters"`  // 可选：不传则读取输出目录的 chapters.json
+		Cover     string            `json:"cover"`     // 可选：封面图片路径
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	paths := []string{req.VideoPath, req.Cover}
+	for _, path := range req.Subtitles {
+		paths = append(paths, path)
+	}
+	if !s.checkRequestPaths(w, paths...) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if vp, err := NewVideoProcessor(req.VideoPath); err == nil {
+		if len(req.Subtitles) == 0 {
+			srtPath := filepath.Join(vp.OutputDir, outputFileName("srt", "", ""))
+			if _, err := os.Stat(srtPath); err == nil {
+				req.Subtitles = map[string]string{"und": srtPath}
+			}
+		}
+		if len(req.Chapters) == 0 {
+			if data, err := os.ReadFile(filepath.Join(vp.OutputDir, "chapters.json")); err == nil {
+				json.Unmarshal(data, &req.Chapters)
+			}
+		}
+	}
+
+	outputPath, err := PackageMKV(req.VideoPath, req.Subtitles, req.Chapters, req.Cover)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    outputPath,
+	})
+}
+
+// handleEstimate 预估处理耗时与成本 (dry-run，不实际处理)
+func (s *HTTPServer) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	videoPath := query.Get("video_path")
+	if videoPath == "" {
+		http.Error(w, "缺少video_path参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, videoPath) {
+		return
+	}
+	price, _ := strconv.ParseFloat(query.Get("price"), 64)
+
+	w.Header().Set("Content-Type", "application/json")
+	estimate, err := EstimateProcessing(videoPath, query.Get("provider"), s.config, price)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"estimate": estimate,
+	})
+}
+
+// handleAcronyms 识别字幕中的缩写，返回术语表和首次出现处标注了全称的字幕
+func (s *HTTPServer) handleAcronyms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	annotated, glossary, err := aiSummarizer.AnnotateAcronyms(segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "识别缩写失败: " + err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"glossary": glossary,
+		"appendix": formatGlossaryMarkdown(glossary),
+		"segments": annotated,
+	})
+}
+
+// handleExportDiff 比较两个版本的字幕，只把变更的片段导出为补丁 SRT
+// 目前没有自动保存的版本快照，旧版本由请求传入 (base_segments 或另一份输出目录)
+func (s *HTTPServer) handleExportDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath    string        `json:"video_path"`
+		Segments     []DataSegment `json:"segments"`      // 新版本，不传则读取缓存的 segments.json
+		BaseSegments []DataSegment `json:"base_segments"` // 旧版本
+		BaseDir      string        `json:"base_dir"`      // 或者：旧版本所在的输出目录
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath, req.BaseDir) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	base := req.BaseSegments
+	if len(base) == 0 && req.BaseDir != "" {
+		var err error
+		if base, err = loadSegmentsFile(req.BaseDir); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if len(base) == 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "缺少用于比较的旧版本 (base_segments 或 base_dir)",
+		})
+		return
+	}
+
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	changed, indices := diffSegments(base, segments)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"file_name":     "subtitles_patch.srt",
+		"content":       generateSRT(changed),
+		"indices":       indices,
+		"segment_count": len(changed),
+	})
+}
+
+// handleQueueStatus 处理队列概况：各状态计数和运行中的任务
+func (s *HTTPServer) handleQueueStatus(w http.ResponseWriter, r *http.Request) {
+	status := taskManager.Status()
+	status.Pending = s.jobs.Pending()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"pending":   status.Pending,
+		"running":   status.Running,
+		"completed": status.Completed,
+		"failed":    status.Failed,
+		"waiting":   s.limiter.Waiting(), // 等待处理名额的请求
+		"tasks":     status.Tasks,
+	})
+}
+
+// handleNoteCards 把输出目录的 AI 总结拆成带时间点和截图的笔记卡片
+func (s *HTTPServer) handleNoteCards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	outputDir := r.URL.Query().Get("output_dir")
+	if outputDir == "" {
+		http.Error(w, "缺少output_dir参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, outputDir) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := os.ReadFile(filepath.Join(outputDir, outputFileName("summary", "", "")))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "读取总结失败: " + err.Error(),
+		})
+		return
+	}
+	var summary AIResponse
+	if err := json.Unmarshal(data, &summary); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "解析总结失败: " + err.Error(),
+		})
+		return
+	}
+
+	cards := BuildNoteCards(summary.Markdown)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"cards":   cards,
+		"count":   len(cards),
+	})
+}
+
+// handleSplitVideo 按分割点把视频切成多段 (流复制)
+func (s *HTTPServer) handleSplitVideo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath   string   `json:"video_path"`
+		SplitPoints []string `json:"split_points"` // HH:MM:SS，严格递增
+		OutputDir   string   `json:"output_dir"`   // 可选：默认为视频的输出目录
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath, req.OutputDir) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	parts, err := SplitVideo(req.VideoPath, req.SplitPoints, req.OutputDir)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+			"parts":   parts,
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"parts":   parts,
+	})
+}
+
+// handleExportDOCX 把输出目录的 AI 总结导出为 Word 文档
+func (s *HTTPServer) handleExportDOCX(w http.ResponseWriter, r *http.Request) {
+	outputDir := r.URL.Query().Get("output_dir")
+	if outputDir == "" {
+		http.Error(w, "缺少output_dir参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, outputDir) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := os.ReadFile(filepath.Join(outputDir, outputFileName("summary", "", "")))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "读取总结失败: " + err.Error(),
+		})
+		return
+	}
+	var summary AIResponse
+	if err := json.Unmarshal(data, &summary); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "解析总结失败: " + err.Error(),
+		})
+		return
+	}
+
+	docxPath, err := ExportDOCX(summary, outputDir)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    docxPath,
+	})
+}
+
+// handleProcessVideoStream 处理视频并以 Server-Sent Events 推送真实进度
+// 依次发送 progress 事件 ({percent, message})，最后发送 result 事件 (完整的 ProcessResponse)
+// 客户端断开时取消识别
+func (s *HTTPServer) handleProcessVideoStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.VideoPath == "" {
+		http.Error(w, "缺少video_path参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkVideoPath(w, req.VideoPath) || !checkProcessFormat(w, &req) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	controller := http.NewResponseController(w)
+
+	var mu sync.Mutex
+	sendEvent := func(event string, data interface{}) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		controller.Flush()
+	}
+
+	ctx := r.Context()
+	var result ProcessResponse
+	if err := s.resolveVideoPath(ctx, &req); err != nil {
+		result = ProcessResponse{Success: false, Message: err.Error()}
+	} else {
+		result = s.processVideo(ctx, req, func(percent int, message string) {
+			sendEvent("progress", map[string]interface{}{"percent": percent, "message": message})
+		})
+	}
+	if ctx.Err() != nil {
+		Warn("客户端已断开，处理已取消: %s", req.VideoPath)
+		return
+	}
+	sendEvent("result", result)
+}
+
+// handleCreateHighlightReel 把标记的精彩时间段剪成一个合集视频并生成合集字幕
+func (s *HTTPServer) handleCreateHighlightReel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath  string      `json:"video_path"`
+		Ranges     []TimeRange `json:"ranges"`     // 按合集中的顺序排列
+		Transition float64     `json:"transition"` // 可选：淡入淡出秒数，0 为直接拼接
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	// 有识别结果时一并生成合集字幕
+	var segments []DataSegment
+	if vp, err := NewVideoProcessor(req.VideoPath); err == nil {
+		segments, _ = loadSegmentsFile(vp.OutputDir)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	reel, err := CreateHighlightReel(req.VideoPath, req.Ranges, segments, req.Transition)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"reel":    reel,
+	})
+}
+
+// handleJobs POST 提交异步处理任务，立即返回 job_id
+func (s *HTTPServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.VideoPath == "" {
+		http.Error(w, "缺少video_path参数", http.StatusBadRequest)
+		return
+	}
+	if !s.checkVideoPath(w, req.VideoPath) || !checkProcessFormat(w, &req) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// 远程直链在任务中下载 (processJob)，本地文件提交时先检查是否存在
+	if !isRemoteVideoURL(req.VideoPath) {
+		if _, err := os.Stat(req.VideoPath); os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "视频文件不存在",
+			})
+			return
+		}
+	}
+
+	job, err := s.jobs.Submit(req)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.ID,
+		"status":  job.Status,
+	})
+}
+
+// handleJob GET /api/jobs/{id} 查询任务状态、进度和结果，DELETE 取消任务
+func (s *HTTPServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := s.jobs.Get(id)
+		if !ok {
+			http.Error(w, "任务不存在", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"job":     job,
+		})
+	case http.MethodDelete:
+		// 已结束的任务重复取消也返回成功
+		job, ok := s.jobs.Cancel(id)
+		if !ok {
+			http.Error(w, "任务不存在", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"job":     job,
+		})
+	default:
+		http.Error(w, "只支持GET和DELETE方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAccuracy 把输出目录的识别结果与人工转写对照，返回 WER/CER 和对齐详情
+func (s *HTTPServer) handleAccuracy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Reference string `json:"reference"`  // 人工转写的参考文本
+		OutputDir string `json:"output_dir"` // 识别结果所在的输出目录
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.OutputDir) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := loadSegmentsFile(req.OutputDir)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	texts := make([]string, len(segments))
+	for i, seg := range segments {
+		texts[i] = seg.Text
+	}
+	report, err := EvaluateAccuracy(req.Reference, strings.Join(texts, " "))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"report":  report,
+	})
+}
+
+// handleGenerateTitles 根据识别结果让 AI 生成候选标题
+func (s *HTTPServer) handleGenerateTitles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		Count     int           `json:"count"`    // 可选：候选数量，默认 5，最多 20
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	titles, err := aiSummarizer.GenerateTitles(segments, req.Count)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "生成标题失败: " + err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"titles":  titles,
+	})
+}
+
+// handleKeySentences 不调用 AI，用抽取式算法从识别结果中选出关键句
+func (s *HTTPServer) handleKeySentences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		Count     int           `json:"count"`    // 可选：句子数，默认 5
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"sentences": ExtractKeySentences(segments, req.Count),
+	})
+}
+
+// handleEntities 让 AI 提取字幕中的人名、地名、机构，返回带首次出现时间的实体列表
+func (s *HTTPServer) handleEntities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
+		return
+	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
 		return
 	}
 
-	files, err := listDownloadFiles()
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	entities, err := aiSummarizer.ExtractEntities(segments)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"message": err.Error(),
+			"message": "提取实体失败: " + err.Error(),
 		})
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"files":   files,
-		"dir":     DOWNLOAD_DIR,
+		"success":  true,
+		"entities": entities,
 	})
 }
 
-// handleGetArchive 获取归档内容
-func (s *HTTPServer) handleGetArchive(w http.ResponseWriter, r *http.Request) {
+// handleGenerateQuiz 根据视频内容生成结构化的选择题
+func (s *HTTPServer) handleGenerateQuiz(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req struct {
-		Path string `json:"path"`
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		Context   string        `json:"context"`  // 可选：直接指定出题内容 (如当前文档)，优先于字幕
+		Count     int           `json:"count"`    // 可选：题目数量，默认 3，最多 10
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "解析请求失败", http.StatusBadRequest)
 		return
 	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
 
-	summaryPath := filepath.Join(req.Path, "summary.json")
-	data, err := os.ReadFile(summaryPath)
+	w.Header().Set("Content-Type", "application/json")
+	text := req.Context
+	if text == "" {
+		segments, err := resolveSegments(req.VideoPath, req.Segments)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		var textBuilder strings.Builder
+		for _, seg := range segments {
+			textBuilder.WriteString(seg.Text)
+			textBuilder.WriteString("\n")
+		}
+		text = textBuilder.String()
+	}
+
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	questions, raw, err := aiSummarizer.GenerateQuiz(text, req.Count)
 	if err != nil {
-		http.Error(w, "读取归档失败: "+err.Error(), http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "生成测验题失败: " + err.Error(),
+		})
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	result := map[string]interface{}{
+		"success":   true,
+		"questions": questions,
+	}
+	if questions == nil {
+		// 回复不是预期的 JSON，返回原始文本
+		result["questions"] = []QuizQuestion{}
+		result["raw"] = raw
+	}
+	json.NewEncoder(w).Encode(result)
 }
 
-// handleProcessVideo 处理视频：提取音频 + ASR + SRT + 截图
-func (s *HTTPServer) handleProcessVideo(w http.ResponseWriter, r *http.Request) {
+// handleRunPipeline 按请求或服务器配置的步骤顺序处理视频
+func (s *HTTPServer) handleRunPipeline(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var req ProcessRequest
-	if err := decoder.Decode(&req); err != nil {
-		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
+	var req PipelineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "解析请求失败", http.StatusBadRequest)
 		return
 	}
-
 	if req.VideoPath == "" {
 		http.Error(w, "缺少video_path参数", http.StatusBadRequest)
 		return
 	}
-
-	// 检查文件是否存在
-	if _, err := os.Stat(req.VideoPath); os.IsNotExist(err) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ProcessResponse{
-			Success: false,
-			Message: "视频文件不存在",
-		})
-		return
-	}
-
-	// 处理视频
-	vp, err := NewVideoProcessor(req.VideoPath)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !s.checkVideoPath(w, req.VideoPath) {
 		return
 	}
-
-	// === 缓存检查开始 ===
-	// 1. 检查是否存在 segments.json (ASR结果)
-	segmentsPath := filepath.Join(vp.OutputDir, "segments.json")
-	var segments []DataSegment
-	segmentsLoaded := false
-
-	if data, err := os.ReadFile(segmentsPath); err == nil {
-		if json.Unmarshal(data, &segments) == nil && len(segments) > 0 {
-			Info("从缓存加载ASR结果: %s", segmentsPath)
-			segmentsLoaded = true
-		}
+	for i := range req.Steps {
+		req.Steps[i] = strings.ToLower(strings.TrimSpace(req.Steps[i]))
 	}
 
-	// 2. 检查是否存在 summary.json (AI总结结果)
-	summaryPath := filepath.Join(vp.OutputDir, "summary.json")
-	var aiResult *AIResponse
-	if data, err := os.ReadFile(summaryPath); err == nil {
-		var res AIResponse
-		if json.Unmarshal(data, &res) == nil {
-			Info("从缓存加载AI总结: %s", summaryPath)
-			aiResult = &res
-		}
+	w.Header().Set("Content-Type", "application/json")
+	// 远程直链先下载到本地，与 /api/process-video 一致
+	resolved := ProcessRequest{VideoPath: req.VideoPath}
+	if err := s.resolveVideoPath(r.Context(), &resolved); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
 	}
-	// === 缓存检查结束 ===
+	req.VideoPath = resolved.VideoPath
 
-	// 如果是仅检查模式
-	if req.CheckOnly {
-		if segmentsLoaded {
-			// 返回缓存数据
-			result := ProcessResponse{
-				Success:      true,
-				Segments:     segments,
-				OutputDir:    vp.OutputDir,
-				SegmentCount: len(segments),
-				AIResult:     aiResult,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
-			return
-		} else {
-			// 未处理
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(ProcessResponse{
-				Success: false,
-				Message: "未处理",
-			})
-			return
-		}
+	state, err := s.RunPipeline(r.Context(), req)
+	if errors.Is(err, ErrServerBusy) {
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}
-
-	var audioPath string
-	var duration float64
-
-	// 如果没有缓存，才进行音频提取和ASR
-	if !segmentsLoaded {
-		// 提取音频 (内部已实现存在检查)
-		audioPath, err = vp.ExtractAudio()
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(ProcessResponse{
-				Success: false,
-				Message: "提取音频失败: " + err.Error(),
-			})
-			return
-		}
-		// 移除：不再自动删除音频文件，以便复用
-		// defer func() {
-		// 	Info("清理临时音频文件: %s", audioPath)
-		// 	os.Remove(audioPath)
-		// }()
-
-		// ASR识别 - 禁用内部缓存，使用我们自己的文件缓存
-		asrClient, err := NewBcutASR(audioPath, false)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(ProcessResponse{
-				Success: false,
-				Message: "创建ASR服务失败: " + err.Error(),
-			})
-			return
-		}
-
-		ctx := context.Background()
-		segments, err = asrClient.GetResult(ctx, func(percent int, message string) {
-			Info("ASR进度: %d%% - %s", percent, message)
+	if state == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		})
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(ProcessResponse{
-				Success: false,
-				Message: "ASR识别失败: " + err.Error(),
-			})
-			return
-		}
-
-		// 保存 segments.json
-		if data, err := json.MarshalIndent(segments, "", "  "); err == nil {
-			os.WriteFile(segmentsPath, data, 0644)
-		}
-	} else {
-		// 如果加载了缓存，音频路径可能为空，但这不影响后续逻辑
-		audioPath = filepath.Join(vp.OutputDir, "audio.mp3") // 假路径
+		return
 	}
 
-	// 提取视频时长 (总是尝试获取，很快)
-	duration, err = vp.GetVideoDuration()
-	if err != nil {
-		duration = 0
+	result := map[string]interface{}{
+		"success":    err == nil,
+		"segments":   state.Segments,
+		"translated": state.Translated,
+		"summary":    state.Summary,
+		"files":      state.Files,
 	}
-
-	// 生成SRT (总是重新生成或覆盖，很快)
-	srtContent := generateSRT(segments)
-	srtPath := filepath.Join(vp.OutputDir, "subtitles.srt")
-	saveSRTFile(srtContent, srtPath)
-
-	// 返回结果
-	result := ProcessResponse{
-		Success:      true,
-		AudioPath:    audioPath,
-		SrtPath:      srtPath,
-		SrtContent:   srtContent,
-		Segments:     segments,
-		Screenshots:  []string{}, // 不再返回预设截图
-		OutputDir:    vp.OutputDir,
-		Duration:     duration,
-		SegmentCount: len(segments),
-		AIResult:     aiResult, // 返回缓存的AI结果
+	if err != nil {
+		// 失败时同时返回已完成步骤的中间结果
+		result["message"] = err.Error()
 	}
-
-	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-// handleDeleteOutput 删除输出目录
-func (s *HTTPServer) handleDeleteOutput(w http.ResponseWriter, r *http.Request) {
+// handleGenerateChapters 用AI生成章节并保存到输出目录的 chapters.json，youtube 为 true 时另存 chapters.txt
+func (s *HTTPServer) handleGenerateChapters(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req ProcessRequest
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		YouTube   bool          `json:"youtube"`  // 可选：同时生成 YouTube 格式的章节列表
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "解析请求失败", http.StatusBadRequest)
 		return
 	}
+	if !s.checkRequestPaths(w, req.VideoPath) {
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	vp, err := NewVideoProcessor(req.VideoPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
 		return
 	}
-
-	// 调用新的归档并清理方法
-	if err := vp.ArchiveAndClean(); err != nil {
-		http.Error(w, "删除/归档失败: "+err.Error(), http.StatusInternalServerError)
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
-}
-
-// handleAISummarize 处理AI总结
-func (s *HTTPServer) handleAISummarize(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
+	aiSummarizer := NewAISummarizer(s.getAIConfig())
+	chapters, err := aiSummarizer.GenerateChapters(segments)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": "生成章节失败: " + err.Error(),
+		})
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var req AIRequest
-	if err := decoder.Decode(&req); err != nil {
-		http.Error(w, "解析请求失败: "+err.Error(), http.StatusBadRequest)
-		return
+	// chapters.json 供写入视频章节 (/api/write-chapters) 和封装 MKV 时读取
+	result := map[string]interface{}{
+		"success":  true,
+		"chapters": chapters,
+	}
+	chaptersPath := filepath.Join(vp.OutputDir, "chapters.json")
+	if data, err := json.MarshalIndent(chapters, "", "  "); err == nil {
+		if err := os.WriteFile(chaptersPath, data, 0644); err != nil {
+			Warn("保存章节失败: %v", err)
+		} else {
+			result["path"] = chaptersPath
+		}
 	}
 
-	aiSummarizer := NewAISummarizer(s.aiConfig)
-	response, err := aiSummarizer.Summarize(req)
-	if err != nil {
-		http.Error(w, "AI总结失败: "+err.Error(), http.StatusInternalServerError)
-		return
+	if req.YouTube {
+		youtube := formatYouTubeChapters(chapters)
+		youtubePath := filepath.Join(vp.OutputDir, "chapters.txt")
+		if err := os.WriteFile(youtubePath, []byte(youtube), 0644); err != nil {
+			Warn("保存章节列表失败: %v", err)
+		} else {
+			result["youtube_path"] = youtubePath
+		}
+		result["youtube"] = youtube
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(result)
 }
 
-// handleAIChat 处理AI对话
-func (s *HTTPServer) handleAIChat(w http.ResponseWriter, r *http.Request) {
+// handleExtractKeywords 提取关键词及首次出现的时间点，未配置 AI 时使用本地词频统计
+func (s *HTTPServer) handleExtractKeywords(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST方法", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req ChatRequest
+	var req struct {
+		VideoPath string        `json:"video_path"`
+		Segments  []DataSegment `json:"segments"` // 可选：不传则读取缓存的 segments.json
+		Count     int           `json:"count"`    // 可选：关键词数量，默认 10，最多 50
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "解析请求失败", http.StatusBadRequest)
 		return
 	}
-
-	aiSummarizer := NewAISummarizer(s.aiConfig)
-	reply, err := aiSummarizer.Chat(req)
-	if err != nil {
-		http.Error(w, "AI对话失败: "+err.Error(), http.StatusInternalServerError)
+	if !s.checkRequestPaths(w, req.VideoPath) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"reply":   reply,
-	})
-}
-
-// handleConfig 处理AI配置
-func (s *HTTPServer) handleConfig(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		decoder := json.NewDecoder(r.Body)
-		var config AIConfig
-		if err := decoder.Decode(&config); err != nil {
-			http.Error(w, "解析配置失败: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-		s.aiConfig = config
-		Info("AI配置更新: APIURL=%s, Model=%s", config.APIURL, config.Model)
-
+	w.Header().Set("Content-Type", "application/json")
+	segments, err := resolveSegments(req.VideoPath, req.Segments)
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"message": "配置更新成功",
-			"config":  config,
+			"success": false,
+			"message": err.Error(),
 		})
 		return
 	}
 
-	if r.Method == http.MethodGet {
-		w.Header().Set("Content-Type", "application/json")
+	config := s.getAIConfig()
+	keywords, err := NewAISummarizer(config).ExtractKeywords(segments, req.Count)
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"config":  s.aiConfig,
+			"success": false,
+			"message": "提取关键词失败: " + err.Error(),
 		})
 		return
 	}
 
-	http.Error(w, "只支持GET或POST方法", http.StatusMethodNotAllowed)
-}
-
-func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	source := "ai"
+	if config.APIKey == "" {
+		source = "local"
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now(),
+		"success":  true,
+		"keywords": keywords,
+		"source":   source,
 	})
 }
 
@@ -1782,19 +11815,63 @@ func main() {
 	audioFile := flag.String("audio", "", "音频文件路径")
 	videoFile := flag.String("video", "", "视频文件路径(用于提取音频)")
 	useCache := flag.Bool("cache", true, "是否使用缓存")
+	cacheDir := flag.String("cache-dir", envOrDefault("ASR_CACHE_DIR", CacheDir), "缓存目录")
+	archiveLayout := flag.String("archive-layout", envOrDefault("ARCHIVE_LAYOUT", ArchiveLayout), "归档按日期分层的模板 (Go 时间格式，如 2006-01 或 2006/01)，传空字符串则不分层")
+	cacheTTL := flag.Duration("cache-ttl", 0, "ASR缓存有效期(如 168h)，0表示永不过期")
 	timeout := flag.Int("timeout", 300, "超时时间(秒)")
+	format := flag.String("format", "srt,vtt", "导出字幕格式，逗号分隔 (srt/vtt/txt/ass/lrc)")
 
 	// Server参数
 	port := flag.String("port", HTTP_PORT, "HTTP服务端口")
+	uploadLimit := flag.Int64("upload-limit", 0, "音频上传速率上限(KB/s)，0表示不限速")
+	uploadWorkers := flag.Int("upload-workers", DefaultUploadConcurrency, "同时上传的音频分片数")
+	jobWorkers := flag.Int("job-workers", 2, "异步任务 (/api/jobs) 的并发处理数")
+	maxConcurrent := flag.Int("max-concurrent", 2, "同时提取音频和识别的视频数")
+	maxQueue := flag.Int("max-queue", 10, "超出并发数时最多排队的请求数，排满后返回服务器繁忙")
+	pipeline := flag.String("pipeline", envOrDefault("PIPELINE", strings.Join(defaultPipeline, ",")), "/api/pipeline 的默认处理步骤，逗号分隔 (load/audio/asr/clean/merge/split/repunctuate/translate/subtitles/summarize)")
+	maxDownload := flag.Int64("max-download-size", DefaultMaxDownloadSize>>20, "远程视频下载大小上限(MB)")
+	allowPrivateURLs := flag.Bool("allow-private-urls", false, "允许下载本机/内网地址的远程视频，默认拒绝")
+	keepAudio := flag.Bool("keep-audio", true, "识别完成后保留提取的音频以便复用，磁盘紧张时可设为 false")
+	allowedDirs := flag.String("allowed-dirs", envOrDefault("ALLOWED_DIRS", ""), "下载目录之外额外允许处理的视频目录，逗号分隔")
+	serveAllowedDirs := flag.Bool("serve-allowed-dirs", false, "通过 /files-1/、/files-2/ ... 提供 -allowed-dirs 目录的 HTTP 访问 (截图、总结链接)，默认不提供")
+	apiKey := flag.String("api-key", envOrDefault("API_KEY", ""), "访问密钥，设置后 /api/* (除 /api/health)、页面和 /files/ 都需要认证")
+	corsOrigin := flag.String("cors-origin", envOrDefault("CORS_ORIGIN", ""), "允许跨域调用 /api/ 的来源，逗号分隔，* 表示任意来源，默认不启用")
 
 	flag.Parse()
 
+	CacheDir = *cacheDir
+	AICacheDir = filepath.Join(CacheDir, "ai")
+	CacheTTL = *cacheTTL
+	ArchiveLayout = *archiveLayout
+	if removed := purgeExpiredCache(CacheDir, CacheTTL); removed > 0 {
+		Info("已清理 %d 个过期ASR缓存", removed)
+	}
+
 	if *mode == "server" {
 		// 创建static目录
 		os.MkdirAll("static", 0755)
 
+		if err := validatePipeline(parsePipeline(*pipeline)); err != nil {
+			log.Fatalf("-pipeline 配置错误: %v", err)
+		}
+
 		// 启动HTTP服务
-		server := NewHTTPServer(*port)
+		server := NewHTTPServer(*port, ServerConfig{
+			SMTP:              loadSMTPConfigFromEnv(),
+			UploadRateLimit:   *uploadLimit * 1024,
+			UploadConcurrency: *uploadWorkers,
+			JobWorkers:        *jobWorkers,
+			MaxConcurrent:     *maxConcurrent,
+			MaxQueue:          *maxQueue,
+			CORSOrigins:       parseCORSOrigins(*corsOrigin),
+			APIKey:            *apiKey,
+			AllowedDirs:       parseDirList(*allowedDirs),
+			ServeAllowedDirs:  *serveAllowedDirs,
+			KeepAudio:         *keepAudio,
+			Pipeline:          parsePipeline(*pipeline),
+			MaxDownloadSize:   *maxDownload << 20,
+			AllowPrivateURLs:  *allowPrivateURLs,
+		})
 		server.Start()
 		return
 	}
@@ -1822,6 +11899,13 @@ func main() {
 	if *videoFile != "" {
 		fmt.Printf("视频文件: %s\n", *videoFile)
 
+		// 识别前先检查导出格式，避免识别完才报错
+		for _, f := range parseFormatList(*format) {
+			if _, ok := subtitleExporters[f]; !ok {
+				log.Fatalf("不支持的字幕格式: %s", f)
+			}
+		}
+
 		// 创建视频处理器
 		vp, err := NewVideoProcessor(*videoFile)
 		if err != nil {
@@ -1830,11 +11914,14 @@ func main() {
 
 		// 提取音频
 		fmt.Println("\n[1/4] 提取音频...")
-		audioPath, err := vp.ExtractAudio()
+		audioPath, err := vp.ExtractAudio(func(percent int, message string) {
+			fmt.Printf("\r进度: [%-40s] %d%% %s",
+				strings.Repeat("=", percent/2), percent, message)
+		})
 		if err != nil {
 			log.Fatalf("提取音频失败: %v", err)
 		}
-		fmt.Printf("音频提取成功: %s\n", audioPath)
+		fmt.Printf("\n音频提取成功: %s\n", audioPath)
 
 		// 获取视频时长
 		duration, err := vp.GetVideoDuration()
@@ -1880,14 +11967,16 @@ func main() {
 		fmt.Printf("\n\n✅ ASR完成！耗时: %.2f秒\n", time.Since(startTime).Seconds())
 		fmt.Printf("识别结果: %d 段\n", len(segments))
 
-		// 生成SRT
-		fmt.Println("\n[4/4] 生成SRT字幕...")
-		srtContent := generateSRT(segments)
-		srtPath := filepath.Join(vp.OutputDir, "subtitles.srt")
-		if err := saveSRTFile(srtContent, srtPath); err != nil {
-			log.Fatalf("保存SRT失败: %v", err)
+		// 生成字幕
+		fmt.Println("\n[4/4] 生成字幕...")
+		formats := parseFormatList(*format)
+		paths, err := ExportFormats(segments, vp.OutputDir, formats, "")
+		if err != nil {
+			log.Fatalf("保存字幕失败: %v", err)
+		}
+		for _, f := range formats {
+			fmt.Printf("%s字幕保存成功: %s\n", strings.ToUpper(f), paths[f])
 		}
-		fmt.Printf("SRT字幕保存成功: %s\n", srtPath)
 
 		// 保存JSON结果
 		jsonPath := filepath.Join(vp.OutputDir, "segments.json")
@@ -1909,7 +11998,9 @@ func main() {
 		fmt.Printf("输出目录: %s\n", vp.OutputDir)
 		fmt.Println("文件列表:")
 		fmt.Printf("  - audio.mp3 (音频)\n")
-		fmt.Printf("  - subtitles.srt (字幕)\n")
+		for _, f := range formats {
+			fmt.Printf("  - %s (字幕)\n", filepath.Base(paths[f]))
+		}
 		fmt.Printf("  - segments.json (JSON数据)\n")
 		fmt.Printf("  - screenshot_*.jpg (截图)\n")
 	} else if *audioFile != "" {
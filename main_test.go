@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestWrapSubtitleText(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		maxLineChars int
+		want         string
+	}{
+		{"空文本", "", 10, ""},
+		{"不限制行宽", "今天我们来讲一下机器学习", 0, "今天我们来讲一下机器学习"},
+		{"短于行宽", "短句", 10, "短句"},
+		{"正好等于行宽", "正好十个字的一句话啊", 10, "正好十个字的一句话啊"},
+		{"去掉首尾空白", "  短句  ", 10, "短句"},
+		{"中文两行", "今天我们来讲一下机器学习的基本概念和方法", 10, "今天我们来讲一下机器\n学习的基本概念和方法"},
+		{"优先在标点后断开", "今天天气不错，我们去公园散步吧", 10, "今天天气不错，\n我们去公园散步吧"},
+		{"末行孤字时均分最后两行", "一二三四五六七八九十一二", 10, "一二三四五六\n七八九十一二"},
+		{"三行", "今天我们来讲一下机器学习的基本概念，和方法啊", 10, "今天我们来讲一下机器\n学习的基本概念，\n和方法啊"},
+		{"英文在空格处断开", "This is a fairly long English sentence for wrapping", 20, "This is a fairly\nlong English\nsentence for\nwrapping"},
+		{"标点不放到行首", "hello, world", 8, "hello,\nworld"},
+		{"超长单词按字数硬断", "Supercalifragilisticexpialidocious word", 10, "Supercalif\nragilistic\nexpialidoc\nious word"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wrapSubtitleText(tt.text, tt.maxLineChars)
+			if got != tt.want {
+				t.Errorf("wrapSubtitleText(%q, %d) = %q, want %q", tt.text, tt.maxLineChars, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapSubtitleTextLineWidth(t *testing.T) {
+	text := "我们今天要讨论的话题是，如何在有限的时间里，高效地完成一个复杂的软件项目，并且保证质量"
+	for width := 4; width <= len([]rune(text)); width++ {
+		wrapped := wrapSubtitleText(text, width)
+		for _, line := range strings.Split(wrapped, "\n") {
+			// 标点不放到行首，允许行尾的标点超出行宽
+			if n := len([]rune(strings.TrimRightFunc(line, unicode.IsPunct))); n > width {
+				t.Errorf("width=%d: 行 %q 有 %d 字，超过行宽", width, line, n)
+			}
+		}
+		if joined := strings.ReplaceAll(wrapped, "\n", ""); joined != text {
+			t.Errorf("width=%d: 断行后内容改变: %q", width, joined)
+		}
+	}
+}
+
+func TestBalanceLines(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		maxLineChars int
+		want         []string
+	}{
+		{"从中间断开", "一二三四五六七八九十一二", 10, []string{"一二三四五六", "七八九十一二"}},
+		{"优先在标点后断开", "今天天气不错，我们去公园散步吧", 10, []string{"今天天气不错，", "我们去公园散步吧"}},
+		{"不在单词中间断开", "hello big world", 10, []string{"hello", "big world"}},
+		{"英文在空格处断开", "hello world", 8, []string{"hello", "world"}},
+		{"两行放不下时按行宽拆分", "一二三四五六七八九十", 4, []string{"一二三四", "五六七八", "九十"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := balanceLines(tt.text, tt.maxLineChars)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("balanceLines(%q, %d) = %q, want %q", tt.text, tt.maxLineChars, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitLongSegmentsKeepsSpeakerAndConfidence(t *testing.T) {
+	segments := []DataSegment{
+		{Text: "一二三四五六七八", StartTime: 0, EndTime: 8, Speaker: "说话人1", Confidence: 0.62},
+		{Text: "短句", StartTime: 8, EndTime: 9, Confidence: 0.9},
+	}
+
+	got := splitLongSegments(segments, 4)
+	if len(got) != 3 {
+		t.Fatalf("splitLongSegments() 返回 %d 段, want 3: %+v", len(got), got)
+	}
+	for _, seg := range got[:2] {
+		if seg.Speaker != "说话人1" || seg.Confidence != 0.62 {
+			t.Errorf("拆分后的片段 %+v 丢失了说话人或置信度", seg)
+		}
+	}
+	if got[2] != segments[1] {
+		t.Errorf("未超长的片段 = %+v, want %+v", got[2], segments[1])
+	}
+}
+
+func TestReverseTimeline(t *testing.T) {
+	tests := []struct {
+		name          string
+		segments      []DataSegment
+		totalDuration float64
+		want          []DataSegment
+	}{
+		{"nil", nil, 10, []DataSegment{}},
+		{"空切片", []DataSegment{}, 10, []DataSegment{}},
+		{
+			"结束于总时长的片段从 0 开始",
+			[]DataSegment{{Text: "a", StartTime: 2, EndTime: 4}, {Text: "b", StartTime: 7, EndTime: 10}},
+			10,
+			[]DataSegment{{Text: "b", StartTime: 0, EndTime: 3}, {Text: "a", StartTime: 6, EndTime: 8}},
+		},
+		{
+			"从 0 开始的片段结束于总时长",
+			[]DataSegment{{Text: "a", StartTime: 0, EndTime: 1}},
+			5,
+			[]DataSegment{{Text: "a", StartTime: 4, EndTime: 5}},
+		},
+		{
+			"重叠片段保持重叠",
+			[]DataSegment{{Text: "a", StartTime: 1, EndTime: 5}, {Text: "b", StartTime: 3, EndTime: 8}},
+			10,
+			[]DataSegment{{Text: "b", StartTime: 2, EndTime: 7}, {Text: "a", StartTime: 5, EndTime: 9}},
+		},
+		{
+			"未给总时长时取最晚的结束时间",
+			[]DataSegment{{Text: "a", StartTime: 0, EndTime: 2}, {Text: "b", StartTime: 3, EndTime: 6}},
+			0,
+			[]DataSegment{{Text: "b", StartTime: 0, EndTime: 3}, {Text: "a", StartTime: 4, EndTime: 6}},
+		},
+		{
+			"超出总时长的部分截断",
+			[]DataSegment{{Text: "a", StartTime: 8, EndTime: 12}},
+			10,
+			[]DataSegment{{Text: "a", StartTime: 0, EndTime: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ReverseTimeline(tt.segments, tt.totalDuration)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReverseTimeline() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVideoInfoWithoutAudio(t *testing.T) {
+	// 无声录屏的 ffprobe 输出：只有一条视频流
+	probe := `{
+		"streams": [
+			{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "avg_frame_rate": "30000/1001", "r_frame_rate": "30/1"}
+		],
+		"format": {"duration": "125.500000", "bit_rate": "2500000"}
+	}`
+
+	info, err := parseVideoInfo([]byte(probe))
+	if err != nil {
+		t.Fatalf("parseVideoInfo() error = %v", err)
+	}
+	if info.HasAudio || info.AudioCodec != "" {
+		t.Errorf("HasAudio = %v, AudioCodec = %q, want false, \"\"", info.HasAudio, info.AudioCodec)
+	}
+	if info.Duration != 125.5 || info.Width != 1920 || info.Height != 1080 || info.Codec != "h264" {
+		t.Errorf("parseVideoInfo() = %+v", info)
+	}
+
+	vp := &VideoProcessor{info: info}
+	if err := vp.checkAudioStream(); !errors.Is(err, ErrNoAudioStream) {
+		t.Errorf("checkAudioStream() error = %v, want ErrNoAudioStream", err)
+	}
+}
+
+func TestParseVideoInfoWithAudio(t *testing.T) {
+	probe := `{
+		"streams": [
+			{"codec_type": "video", "codec_name": "h264", "width": 1280, "height": 720, "avg_frame_rate": "25/1"},
+			{"codec_type": "audio", "codec_name": "aac"}
+		],
+		"format": {"duration": "10", "bit_rate": "800000"}
+	}`
+
+	info, err := parseVideoInfo([]byte(probe))
+	if err != nil {
+		t.Fatalf("parseVideoInfo() error = %v", err)
+	}
+	if !info.HasAudio || info.AudioCodec != "aac" {
+		t.Errorf("HasAudio = %v, AudioCodec = %q, want true, \"aac\"", info.HasAudio, info.AudioCodec)
+	}
+
+	vp := &VideoProcessor{info: info}
+	if err := vp.checkAudioStream(); err != nil {
+		t.Errorf("checkAudioStream() error = %v, want nil", err)
+	}
+}
+
+func TestCaptureMarkerPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string // 匹配到的秒数
+	}{
+		{"单个标记", "重点内容 [[CAPTURE: 12.5]]", []string{"12.5"}},
+		{"一行多个标记", "对比 [[CAPTURE: 30]] 和 [[CAPTURE:45.25]] 两个画面[[CAPTURE: 60 ]]", []string{"30", "45.25", "60"}},
+		{"没有标记", "普通段落 [[TIME: 10]]", nil},
+		{"非数字不匹配", "[[CAPTURE: abc]]", nil},
+		{"缺少秒数不匹配", "[[CAPTURE:]]", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, match := range captureMarkerPattern.FindAllStringSubmatch(tt.line, -1) {
+				got = append(got, match[1])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("captureMarkerPattern 匹配 %q = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadCaptureMarkerPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string // 去掉格式不对的标记后
+	}{
+		{"非数字", "前 [[CAPTURE: abc]] 后", "前  后"},
+		{"缺少秒数", "[[CAPTURE:]]结尾", "结尾"},
+		{"一行多个", "[[CAPTURE: x]]a[[CAPTURE: -]]b", "ab"},
+		{"不影响时间标记", "[[TIME: 5]] 内容", "[[TIME: 5]] 内容"},
+		{"未闭合的标记保留", "[[CAPTURE: 10", "[[CAPTURE: 10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := badCaptureMarkerPattern.ReplaceAllString(tt.line, ""); got != tt.want {
+				t.Errorf("去掉 %q 中的无效标记 = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTimeMarkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{"秒", "[[TIME: 45]] 开场", `<span class="time-marker" data-time="45">⏱ 45s</span> 开场`},
+		{"分秒", "- [[TIME:750.5]] 要点", `- <span class="time-marker" data-time="750.5">⏱ 12m30s</span> 要点`},
+		{"带 s 后缀", "[[TIME: 12s]]", `<span class="time-marker" data-time="12">⏱ 12s</span>`},
+		{
+			"一行多个",
+			"[[TIME: 1]] 和 [[TIME: 61]]",
+			`<span class="time-marker" data-time="1">⏱ 1s</span> 和 <span class="time-marker" data-time="61">⏱ 1m1s</span>`,
+		},
+		{"格式不对的保留原样", "[[TIME: abc]] [[TIME: ]]", "[[TIME: abc]] [[TIME: ]]"},
+		{"没有标记", "普通文本", "普通文本"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderTimeMarkers(tt.markdown); got != tt.want {
+				t.Errorf("renderTimeMarkers(%q) = %q, want %q", tt.markdown, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditCountsMatchesAlignment(t *testing.T) {
+	tests := []struct{ ref, hyp string }{
+		{"今天我们来讲机器学习", "今天我们讲一下机器学"},
+		{"abc", ""},
+		{"", "abc"},
+		{"一二三四五", "一二三四五"},
+		{"深度学习的基本概念", "浅度学习基本的概念和方法"},
+	}
+
+	for _, tt := range tests {
+		ref, hyp := tokenizeChars(tt.ref), tokenizeChars(tt.hyp)
+		var want [3]int
+		for _, op := range alignTokens(ref, hyp) {
+			switch op.Op {
+			case "substitute":
+				want[0]++
+			case "delete":
+				want[1]++
+			case "insert":
+				want[2]++
+			}
+		}
+		sub, del, ins := editCounts(ref, hyp)
+		if sub+del+ins != want[0]+want[1]+want[2] {
+			t.Errorf("editCounts(%q, %q) = %d/%d/%d, 对齐结果为 %v", tt.ref, tt.hyp, sub, del, ins, want)
+		}
+	}
+}
+
+func TestErrorRateOmitsLongAlignment(t *testing.T) {
+	ref := tokenizeChars(strings.Repeat("机器学习", 1000))
+	hyp := tokenizeChars(strings.Repeat("机器学习", 999) + "机器学")
+
+	rate, report, err := errorRate(ref, hyp)
+	if err != nil {
+		t.Fatalf("errorRate() error = %v", err)
+	}
+	if !report.AlignmentOmitted || report.Alignment != nil {
+		t.Errorf("超过 maxAlignmentCells 时应省略对齐，AlignmentOmitted = %v, len(Alignment) = %d", report.AlignmentOmitted, len(report.Alignment))
+	}
+	if report.Deletions != 1 || report.Substitutions != 0 || report.Insertions != 0 {
+		t.Errorf("错误次数 = %d/%d/%d, want 0/1/0", report.Substitutions, report.Deletions, report.Insertions)
+	}
+	if want := 1.0 / 4000; rate != want {
+		t.Errorf("rate = %v, want %v", rate, want)
+	}
+}
+
+func TestNewASRServiceAutoLanguage(t *testing.T) {
+	// 找不到 whisper 时无法检测语言，auto 回退到默认服务
+	t.Setenv("WHISPER_BIN", "")
+	t.Setenv("PATH", t.TempDir())
+	audioPath := filepath.Join(t.TempDir(), "audio.mp3")
+	if err := os.WriteFile(audioPath, []byte("fake audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, language     string
+		wantName, wantLang string
+	}{
+		{"", "auto", DefaultASRProvider, "auto"},
+		{"", "", DefaultASRProvider, ""},
+		{"bcut", "en", "bcut", "en"},
+	}
+	for _, tt := range tests {
+		client, name, language, err := NewASRService(context.Background(), tt.name, tt.language, audioPath, false)
+		if err != nil {
+			t.Fatalf("NewASRService(%q, %q) error = %v", tt.name, tt.language, err)
+		}
+		if client == nil || name != tt.wantName || language != tt.wantLang {
+			t.Errorf("NewASRService(%q, %q) = %q, %q, want %q, %q", tt.name, tt.language, name, language, tt.wantName, tt.wantLang)
+		}
+	}
+
+	if _, _, _, err := NewASRService(context.Background(), "unknown", "auto", audioPath, false); err == nil {
+		t.Error("NewASRService() 未知服务应返回错误")
+	}
+}